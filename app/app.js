@@ -1,10 +1,13 @@
 document.addEventListener('DOMContentLoaded', async () => {
+  await handleEmailLinks();
+
   const token = localStorage.getItem('token');
 
   if (token) {
     document.getElementById('auth-section').style.display = 'none';
     document.getElementById('video-section').style.display = 'block';
     await getVideos();
+    await getSessions();
   } else {
     document.getElementById('auth-section').style.display = 'block';
     document.getElementById('video-section').style.display = 'none';
@@ -26,17 +29,16 @@ async function createVideoDraft() {
   const description = document.getElementById('video-description').value;
 
   try {
-    const res = await fetch('/api/videos', {
+    const res = await authFetch('/api/videos', {
       method: 'POST',
       headers: {
         'Content-Type': 'application/json',
-        Authorization: `Bearer ${localStorage.getItem('token')}`,
       },
       body: JSON.stringify({ title, description }),
     });
     const data = await res.json();
     if (!res.ok) {
-      throw new Error(`Failed to create video draft: ${data.error}`);
+      throw new Error(`Failed to create video draft: ${data.detail}`);
     }
 
     const videoID = data.id;
@@ -63,22 +65,77 @@ async function login() {
     });
     const data = await res.json();
     if (!res.ok) {
-      throw new Error(`Failed to login: ${data.error}`);
+      throw new Error(`Failed to login: ${data.detail}`);
     }
+    await finishLogin(data);
+  } catch (error) {
+    alert(`Error: ${error.message}`);
+  }
+}
 
-    if (data.token) {
-      localStorage.setItem('token', data.token);
-      document.getElementById('auth-section').style.display = 'none';
-      document.getElementById('video-section').style.display = 'block';
-      await getVideos();
-    } else {
-      alert('Login failed. Please check your credentials.');
+function loginWithSSO() {
+  window.location.href = '/api/oidc/login';
+}
+
+// The single sign-on callback redirects back to the app with a short-lived
+// code to trade for a session.
+async function loginWithCode(code) {
+  try {
+    const res = await fetch('/api/login/oidc', {
+      method: 'POST',
+      headers: {
+        'Content-Type': 'application/json',
+      },
+      body: JSON.stringify({ code }),
+    });
+    const data = await res.json();
+    if (!res.ok) {
+      throw new Error(`Failed to login: ${data.detail}`);
     }
+    await finishLogin(data);
   } catch (error) {
     alert(`Error: ${error.message}`);
   }
 }
 
+async function finishLogin(data) {
+  if (data.mfa_required) {
+    data = await completeMFALogin(data.mfa_token);
+  }
+
+  if (data.token) {
+    localStorage.setItem('token', data.token);
+    localStorage.setItem('refreshToken', data.refresh_token);
+    localStorage.setItem('sessionID', data.session_id);
+    document.getElementById('auth-section').style.display = 'none';
+    document.getElementById('video-section').style.display = 'block';
+    await getVideos();
+    await getSessions();
+  } else {
+    alert('Login failed. Please check your credentials.');
+  }
+}
+
+async function completeMFALogin(mfaToken) {
+  const code = prompt('Enter the code from your authenticator app or a recovery code:');
+  if (!code) {
+    throw new Error('Login cancelled');
+  }
+
+  const res = await fetch('/api/login/mfa', {
+    method: 'POST',
+    headers: {
+      'Content-Type': 'application/json',
+    },
+    body: JSON.stringify({ mfa_token: mfaToken, code }),
+  });
+  const data = await res.json();
+  if (!res.ok) {
+    throw new Error(`Failed to login: ${data.detail}`);
+  }
+  return data;
+}
+
 async function signup() {
   const email = document.getElementById('email').value;
   const password = document.getElementById('password').value;
@@ -93,7 +150,7 @@ async function signup() {
     });
     if (!res.ok) {
       const data = await res.json();
-      throw new Error(`Failed to create user: ${data.error}`);
+      throw new Error(`Failed to create user: ${data.detail}`);
     }
     console.log('User created!');
     await login();
@@ -102,12 +159,372 @@ async function signup() {
   }
 }
 
-function logout() {
+// Links in verification and password reset emails, and the single sign-on
+// callback, open the app with a token in the query string.
+async function handleEmailLinks() {
+  const params = new URLSearchParams(window.location.search);
+  const verifyToken = params.get('verify_token');
+  const resetToken = params.get('reset_token');
+  const loginCode = params.get('login_code');
+  if (!verifyToken && !resetToken && !loginCode) {
+    return;
+  }
+  window.history.replaceState(null, '', window.location.pathname);
+
+  if (verifyToken) {
+    await verifyEmail(verifyToken);
+  } else if (resetToken) {
+    await resetPassword(resetToken);
+  } else {
+    await loginWithCode(loginCode);
+  }
+}
+
+async function verifyEmail(token) {
+  try {
+    const res = await fetch('/api/email_verification/confirm', {
+      method: 'POST',
+      headers: {
+        'Content-Type': 'application/json',
+      },
+      body: JSON.stringify({ token }),
+    });
+    if (!res.ok) {
+      const data = await res.json();
+      throw new Error(`Failed to verify email: ${data.detail}`);
+    }
+    alert('Your email address is verified.');
+  } catch (error) {
+    alert(`Error: ${error.message}`);
+  }
+}
+
+async function forgotPassword() {
+  const email = document.getElementById('email').value || prompt('Email address:');
+  if (!email) {
+    return;
+  }
+
+  try {
+    const res = await fetch('/api/password_reset', {
+      method: 'POST',
+      headers: {
+        'Content-Type': 'application/json',
+      },
+      body: JSON.stringify({ email }),
+    });
+    if (!res.ok) {
+      const data = await res.json();
+      throw new Error(`Failed to request password reset: ${data.detail}`);
+    }
+    alert('If that address has an account, a reset link is on its way.');
+  } catch (error) {
+    alert(`Error: ${error.message}`);
+  }
+}
+
+async function resetPassword(token) {
+  const password = prompt('Choose a new password:');
+  if (!password) {
+    return;
+  }
+
+  try {
+    const res = await fetch('/api/password_reset/confirm', {
+      method: 'POST',
+      headers: {
+        'Content-Type': 'application/json',
+      },
+      body: JSON.stringify({ token, password }),
+    });
+    if (!res.ok) {
+      const data = await res.json();
+      throw new Error(`Failed to reset password: ${data.detail}`);
+    }
+    clearSession();
+    alert('Your password has been changed. Log in with the new password.');
+  } catch (error) {
+    alert(`Error: ${error.message}`);
+  }
+}
+
+async function logout() {
+  const refreshToken = localStorage.getItem('refreshToken');
+  if (refreshToken) {
+    try {
+      await fetch('/api/revoke', {
+        method: 'POST',
+        headers: {
+          Authorization: `Bearer ${refreshToken}`,
+        },
+      });
+    } catch (error) {
+      console.error(error);
+    }
+  }
+  clearSession();
+}
+
+// authFetch sends the access token with a request. Access tokens are
+// short-lived, so when one is rejected the session's refresh token is traded
+// for a new one and the request is retried once.
+async function authFetch(url, options = {}) {
+  const send = () =>
+    fetch(url, {
+      ...options,
+      headers: {
+        ...options.headers,
+        Authorization: `Bearer ${localStorage.getItem('token')}`,
+      },
+    });
+
+  const res = await send();
+  if (res.status !== 401 || !(await refreshSession())) {
+    return res;
+  }
+  return send();
+}
+
+// Refresh tokens are single-use, so concurrent requests share one refresh.
+let pendingRefresh = null;
+
+function refreshSession() {
+  if (!pendingRefresh) {
+    pendingRefresh = rotateTokens().finally(() => {
+      pendingRefresh = null;
+    });
+  }
+  return pendingRefresh;
+}
+
+async function rotateTokens() {
+  const refreshToken = localStorage.getItem('refreshToken');
+  if (!refreshToken) {
+    return false;
+  }
+  const res = await fetch('/api/refresh', {
+    method: 'POST',
+    headers: {
+      Authorization: `Bearer ${refreshToken}`,
+    },
+  });
+  if (!res.ok) {
+    clearSession();
+    return false;
+  }
+  const data = await res.json();
+  localStorage.setItem('token', data.token);
+  localStorage.setItem('refreshToken', data.refresh_token);
+  localStorage.setItem('sessionID', data.session_id);
+  return true;
+}
+
+function clearSession() {
   localStorage.removeItem('token');
+  localStorage.removeItem('refreshToken');
+  localStorage.removeItem('sessionID');
   document.getElementById('auth-section').style.display = 'block';
   document.getElementById('video-section').style.display = 'none';
 }
 
+async function getSessions() {
+  try {
+    const res = await authFetch('/api/sessions', {
+      method: 'GET',
+    });
+    if (!res.ok) {
+      const data = await res.json();
+      throw new Error(`Failed to get sessions. Error: ${data.detail}`);
+    }
+
+    const sessions = await res.json();
+    const currentSessionID = localStorage.getItem('sessionID');
+    const sessionList = document.getElementById('session-list');
+    sessionList.innerHTML = '';
+    for (const session of sessions) {
+      const listItem = document.createElement('li');
+      const lastUsed = new Date(session.last_used_at).toLocaleString();
+      let label = `${session.user_agent || 'Unknown device'} (${session.ip}), last used ${lastUsed}`;
+      if (session.id === currentSessionID) {
+        label += ' - this session';
+      }
+      listItem.textContent = label;
+
+      const revokeBtn = document.createElement('button');
+      revokeBtn.textContent = 'Revoke';
+      revokeBtn.onclick = (event) => {
+        event.stopPropagation();
+        revokeSession(session.id);
+      };
+      listItem.appendChild(revokeBtn);
+      sessionList.appendChild(listItem);
+    }
+  } catch (error) {
+    alert(`Error: ${error.message}`);
+  }
+}
+
+async function revokeSession(sessionID) {
+  try {
+    const res = await authFetch(`/api/sessions/${sessionID}`, {
+      method: 'DELETE',
+    });
+    if (!res.ok) {
+      const data = await res.json();
+      throw new Error(`Failed to revoke session. Error: ${data.detail}`);
+    }
+
+    if (sessionID === localStorage.getItem('sessionID')) {
+      clearSession();
+      return;
+    }
+    await getSessions();
+  } catch (error) {
+    alert(`Error: ${error.message}`);
+  }
+}
+
+async function logoutEverywhere() {
+  try {
+    const res = await authFetch('/api/sessions', {
+      method: 'DELETE',
+    });
+    if (!res.ok) {
+      const data = await res.json();
+      throw new Error(`Failed to log out everywhere. Error: ${data.detail}`);
+    }
+    clearSession();
+  } catch (error) {
+    alert(`Error: ${error.message}`);
+  }
+}
+
+async function changeEmail() {
+  const email = prompt('New email address:');
+  if (!email) {
+    return;
+  }
+  const password = prompt('Current password:');
+  if (!password) {
+    return;
+  }
+
+  try {
+    const res = await authFetch('/api/users/me/email', {
+      method: 'PUT',
+      headers: {
+        'Content-Type': 'application/json',
+      },
+      body: JSON.stringify({ email, password }),
+    });
+    const data = await res.json();
+    if (!res.ok) {
+      throw new Error(`Failed to change email: ${data.detail}`);
+    }
+    alert(`Your email is now ${data.email}. Check your inbox to verify it.`);
+  } catch (error) {
+    alert(`Error: ${error.message}`);
+  }
+}
+
+async function changePassword() {
+  const currentPassword = prompt('Current password:');
+  if (!currentPassword) {
+    return;
+  }
+  const newPassword = prompt('New password:');
+  if (!newPassword) {
+    return;
+  }
+
+  try {
+    const res = await authFetch('/api/users/me/password', {
+      method: 'PUT',
+      headers: {
+        'Content-Type': 'application/json',
+      },
+      body: JSON.stringify({
+        current_password: currentPassword,
+        new_password: newPassword,
+      }),
+    });
+    if (!res.ok) {
+      const data = await res.json();
+      throw new Error(`Failed to change password: ${data.detail}`);
+    }
+    clearSession();
+    alert('Your password has been changed. Log in with the new password.');
+  } catch (error) {
+    alert(`Error: ${error.message}`);
+  }
+}
+
+async function enableTwoFactor() {
+  try {
+    const headers = {
+      'Content-Type': 'application/json',
+    };
+    const res = await authFetch('/api/users/me/totp', {
+      method: 'POST',
+      headers,
+    });
+    const enrollment = await res.json();
+    if (!res.ok) {
+      throw new Error(`Failed to start two-factor setup: ${enrollment.detail}`);
+    }
+
+    const code = prompt(
+      `Add this account to your authenticator app with the secret ${enrollment.secret} ` +
+        `or the link below, then enter the code it shows.\n\n${enrollment.uri}`,
+    );
+    if (!code) {
+      return;
+    }
+
+    const confirmRes = await authFetch('/api/users/me/totp/confirm', {
+      method: 'POST',
+      headers,
+      body: JSON.stringify({ code }),
+    });
+    const data = await confirmRes.json();
+    if (!confirmRes.ok) {
+      throw new Error(`Failed to enable two-factor authentication: ${data.detail}`);
+    }
+    alert(
+      'Two-factor authentication is on. Store these recovery codes somewhere safe; ' +
+        `each works once if you lose your device:\n\n${data.recovery_codes.join('\n')}`,
+    );
+  } catch (error) {
+    alert(`Error: ${error.message}`);
+  }
+}
+
+async function deleteAccount() {
+  const password = prompt(
+    'This deletes your account and all of your videos. Enter your password to confirm:',
+  );
+  if (!password) {
+    return;
+  }
+
+  try {
+    const res = await authFetch('/api/users/me', {
+      method: 'DELETE',
+      headers: {
+        'Content-Type': 'application/json',
+      },
+      body: JSON.stringify({ password }),
+    });
+    if (!res.ok) {
+      const data = await res.json();
+      throw new Error(`Failed to delete account: ${data.detail}`);
+    }
+    clearSession();
+  } catch (error) {
+    alert(`Error: ${error.message}`);
+  }
+}
+
 function setUploadButtonState(uploading, selector) {
   const uploadBtn = document.getElementById(selector);
   if (uploading) {
@@ -130,16 +547,13 @@ async function uploadThumbnail(videoID) {
   setUploadButtonState(true, uploadBtnSelector);
 
   try {
-    const res = await fetch(`/api/thumbnail_upload/${videoID}`, {
+    const res = await authFetch(`/api/thumbnail_upload/${videoID}`, {
       method: 'POST',
-      headers: {
-        Authorization: `Bearer ${localStorage.getItem('token')}`,
-      },
       body: formData,
     });
     if (!res.ok) {
       const data = await res.json();
-      throw new Error(`Failed to upload thumbnail. Error: ${data.error}`);
+      throw new Error(`Failed to upload thumbnail. Error: ${data.detail}`);
     }
 
     await res.json();
@@ -163,16 +577,13 @@ async function uploadVideoFile(videoID) {
   setUploadButtonState(true, uploadBtnSelector);
 
   try {
-    const res = await fetch(`/api/video_upload/${videoID}`, {
+    const res = await authFetch(`/api/video_upload/${videoID}`, {
       method: 'POST',
-      headers: {
-        Authorization: `Bearer ${localStorage.getItem('token')}`,
-      },
       body: formData,
     });
     if (!res.ok) {
       const data = await res.json();
-      throw new Error(`Failed to upload video file. Error: ${data.error}`);
+      throw new Error(`Failed to upload video file. Error: ${data.detail}`);
     }
 
     console.log('Video uploaded!');
@@ -188,15 +599,12 @@ const videoStateHandler = createVideoStateHandler();
 
 async function getVideos() {
   try {
-    const res = await fetch('/api/videos', {
+    const res = await authFetch('/api/videos', {
       method: 'GET',
-      headers: {
-        Authorization: `Bearer ${localStorage.getItem('token')}`,
-      },
     });
     if (!res.ok) {
       const data = await res.json();
-      throw new Error(`Failed to get videos. Error: ${data.error}`);
+      throw new Error(`Failed to get videos. Error: ${data.detail}`);
     }
 
     const videos = await res.json();
@@ -231,11 +639,8 @@ function createVideoStateHandler() {
 
 async function getVideo(videoID) {
   try {
-    const res = await fetch(`/api/videos/${videoID}`, {
+    const res = await authFetch(`/api/videos/${videoID}`, {
       method: 'GET',
-      headers: {
-        Authorization: `Bearer ${localStorage.getItem('token')}`,
-      },
     });
     if (!res.ok) {
       throw new Error('Failed to get video.');
@@ -283,11 +688,8 @@ async function deleteVideo() {
   }
 
   try {
-    const res = await fetch(`/api/videos/${currentVideo.id}`, {
+    const res = await authFetch(`/api/videos/${currentVideo.id}`, {
       method: 'DELETE',
-      headers: {
-        Authorization: `Bearer ${localStorage.getItem('token')}`,
-      },
     });
     if (!res.ok) {
       throw new Error('Failed to delete video.');
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"log/slog"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	auditTargetUser  = "user"
+	auditTargetVideo = "video"
+)
+
+// audit records a privileged action. actorID is nil for commands run from the
+// command line. Failing to write the entry doesn't fail the action.
+func (cfg *apiConfig) audit(actorID *uuid.UUID, action, targetType, targetID, details string) {
+	err := cfg.db.CreateAuditLogEntry(database.CreateAuditLogEntryParams{
+		ActorID:    actorID,
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		Details:    details,
+	})
+	if err != nil {
+		slog.Error("Couldn't write audit log entry", slog.String("action", action), slog.String("target_type", targetType), slog.String("target_id", targetID), slog.Any("err", err))
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import "github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+
+// permission names a privileged action beyond managing one's own videos.
+type permission string
+
+const (
+	permListUsers      permission = "users:list"
+	permManageUsers    permission = "users:manage"
+	permViewAnyVideo   permission = "videos:view_any"
+	permDeleteAnyVideo permission = "videos:delete_any"
+	permViewAuditLog   permission = "audit_log:view"
+)
+
+// rolePermissions grants moderators content moderation and admins everything.
+var rolePermissions = map[database.Role][]permission{
+	database.RoleUser: {},
+	database.RoleModerator: {
+		permListUsers,
+		permViewAnyVideo,
+		permDeleteAnyVideo,
+	},
+	database.RoleAdmin: {
+		permListUsers,
+		permManageUsers,
+		permViewAnyVideo,
+		permDeleteAnyVideo,
+		permViewAuditLog,
+	},
+}
+
+func roleHasPermission(role database.Role, perm permission) bool {
+	for _, p := range rolePermissions[role] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// canView reports whether the principal may see a video. Private videos are
+// only shown to their owner and to moderators.
+func (p principal) canView(video database.Video) bool {
+	if video.Visibility == database.VisibilityPublic {
+		return true
+	}
+	if p.authenticated() && video.UserID == p.UserID {
+		return true
+	}
+	return p.can(permViewAnyVideo)
+}
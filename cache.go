@@ -1,10 +1,174 @@
 package main
 
-import "net/http"
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
 
-func noCacheMiddleware(next http.Handler) http.Handler {
+	"github.com/andybalholm/brotli"
+)
+
+// immutableCacheMiddleware serves files that are written once under a random
+// name and never modified, so browsers may keep them for a year without
+// revalidating. Directory listings change with every upload and are never
+// stored.
+func immutableCacheMiddleware(root string, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Cache-Control", "no-store")
+		info, ok := statRequestedFile(root, r.URL.Path)
+		if !ok {
+			w.Header().Set("Cache-Control", "no-store")
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		w.Header().Set("ETag", fileETag(info))
 		next.ServeHTTP(w, r)
 	})
 }
+
+// revalidateCacheMiddleware serves files that change between deploys. They
+// may be cached but must be revalidated with If-None-Match or
+// If-Modified-Since on every use. Text responses are compressed with brotli
+// or gzip when the client accepts it.
+func revalidateCacheMiddleware(root string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-cache")
+
+		info, ok := statRequestedFile(root, r.URL.Path)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		etag := fileETag(info)
+
+		if !isCompressible(mime.TypeByExtension(filepath.Ext(info.Name()))) {
+			w.Header().Set("ETag", etag)
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == http.MethodHead {
+			w.Header().Set("ETag", etag)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Each encoding is a different representation and needs its own
+		// validator. Byte ranges of the compressed stream are not supported.
+		w.Header().Set("ETag", strings.TrimSuffix(etag, `"`)+"-"+encoding+`"`)
+		r.Header.Del("Range")
+
+		cw := &compressResponseWriter{ResponseWriter: w, encoding: encoding}
+		defer cw.Close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+func statRequestedFile(root, urlPath string) (os.FileInfo, bool) {
+	name := filepath.Join(root, filepath.FromSlash(path.Clean("/"+urlPath)))
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, false
+	}
+	if info.IsDir() {
+		index, err := os.Stat(filepath.Join(name, "index.html"))
+		if err != nil {
+			return nil, false
+		}
+		return index, true
+	}
+	return info, true
+}
+
+func fileETag(info os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+}
+
+func isCompressible(contentType string) bool {
+	mediatype, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(mediatype, "text/"):
+		return true
+	case mediatype == "application/javascript", mediatype == "application/json", mediatype == "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+// negotiateEncoding picks brotli over gzip from an Accept-Encoding header,
+// honoring q=0 exclusions.
+func negotiateEncoding(acceptEncoding string) string {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err == nil {
+				q = parsed
+			}
+		}
+		accepted[strings.ToLower(coding)] = q > 0
+	}
+	for _, encoding := range []string{"br", "gzip"} {
+		if accepted[encoding] {
+			return encoding
+		}
+	}
+	return ""
+}
+
+type compressResponseWriter struct {
+	http.ResponseWriter
+	encoding    string
+	encoder     io.WriteCloser
+	wroteHeader bool
+}
+
+func (cw *compressResponseWriter) WriteHeader(code int) {
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+	if code == http.StatusOK {
+		cw.Header().Set("Content-Encoding", cw.encoding)
+		cw.Header().Del("Content-Length")
+		cw.Header().Del("Accept-Ranges")
+		switch cw.encoding {
+		case "br":
+			cw.encoder = brotli.NewWriter(cw.ResponseWriter)
+		case "gzip":
+			cw.encoder = gzip.NewWriter(cw.ResponseWriter)
+		}
+	}
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *compressResponseWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.encoder != nil {
+		return cw.encoder.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+func (cw *compressResponseWriter) Close() error {
+	if cw.encoder == nil {
+		return nil
+	}
+	return cw.encoder.Close()
+}
@@ -0,0 +1,217 @@
+// Package client is a Go client of the Tubely API. Its types and methods are
+// generated from openapi.json at the root of the repository; run go generate
+// after changing the document.
+//
+// Failed requests return a *Problem, the server's RFC 7807 error response,
+// whose Code is safe to branch on:
+//
+//	_, err := c.CreateUser(ctx, client.CreateUserRequest{Email: email, Password: password})
+//	var problem *client.Problem
+//	if errors.As(err, &problem) && problem.Code == client.ErrorCodeEmailTaken {
+//		...
+//	}
+package client
+
+//go:generate go run ../internal/genclient -spec ../openapi.json -out client_gen.go
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+)
+
+// Client calls a Tubely server. It is safe for concurrent use.
+type Client struct {
+	baseURL       string
+	httpClient    *http.Client
+	authorization string
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient sends requests with hc instead of http.DefaultClient.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = hc
+	}
+}
+
+// WithToken authenticates requests with an access token from logging in.
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.authorization = "Bearer " + token
+	}
+}
+
+// WithAPIKey authenticates requests with an API key.
+func WithAPIKey(key string) Option {
+	return func(c *Client) {
+		c.authorization = "ApiKey " + key
+	}
+}
+
+// New returns a client of the server at baseURL, e.g. http://localhost:8091.
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: http.DefaultClient,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// File is a file to upload.
+type File struct {
+	Name string
+	// ContentType is the file's media type, e.g. video/mp4.
+	ContentType string
+	Content     io.Reader
+}
+
+// Error makes a problem response usable as an error.
+func (p *Problem) Error() string {
+	if p.Detail == "" {
+		return fmt.Sprintf("tubely: %d %s", p.Status, p.Title)
+	}
+	return fmt.Sprintf("tubely: %d %s: %s (%s)", p.Status, p.Title, p.Detail, p.Code)
+}
+
+// request is a call of an API operation.
+type request struct {
+	method string
+	path   string
+	query  url.Values
+	// body is sent as JSON unless it is nil.
+	body any
+	// file is sent as the multipart form field fileField unless it is nil.
+	file      *File
+	fileField string
+	// authorization overrides the client's credentials.
+	authorization string
+}
+
+// do sends req and decodes the response into out, which is a *string for
+// text, an *io.ReadCloser the caller must close for other media, or a
+// pointer to decode JSON into. Error responses are returned as a *Problem.
+func (c *Client) do(ctx context.Context, req request, out any) error {
+	u := c.baseURL + req.path
+	if len(req.query) > 0 {
+		u += "?" + req.query.Encode()
+	}
+
+	var body io.Reader
+	var contentType string
+	switch {
+	case req.body != nil:
+		dat, err := json.Marshal(req.body)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(dat)
+		contentType = "application/json"
+	case req.file != nil:
+		// The multipart body is streamed so large videos aren't held in
+		// memory.
+		pr, pw := io.Pipe()
+		mw := multipart.NewWriter(pw)
+		go func() {
+			pw.CloseWithError(writeFile(mw, req.fileField, *req.file))
+		}()
+		body = pr
+		contentType = mw.FormDataContentType()
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, req.method, u, body)
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		httpReq.Header.Set("Content-Type", contentType)
+	}
+	authorization := c.authorization
+	if req.authorization != "" {
+		authorization = req.authorization
+	}
+	if authorization != "" {
+		httpReq.Header.Set("Authorization", authorization)
+	}
+
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	if rc, ok := out.(*io.ReadCloser); ok && resp.StatusCode < 300 {
+		*rc = resp.Body
+		return nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return responseProblem(resp)
+	}
+	switch out := out.(type) {
+	case nil:
+		return nil
+	case *string:
+		dat, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		*out = string(dat)
+		return nil
+	default:
+		err := json.NewDecoder(resp.Body).Decode(out)
+		if err != nil {
+			return fmt.Errorf("tubely: couldn't decode %s %s response: %w", req.method, req.path, err)
+		}
+		return nil
+	}
+}
+
+func writeFile(mw *multipart.Writer, field string, file File) error {
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", mime.FormatMediaType("form-data", map[string]string{
+		"name":     field,
+		"filename": file.Name,
+	}))
+	header.Set("Content-Type", file.ContentType)
+	part, err := mw.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(part, file.Content)
+	if err != nil {
+		return err
+	}
+	return mw.Close()
+}
+
+// responseProblem reads the problem of an error response. Responses that
+// aren't problem details, e.g. from a proxy, get one made from the status.
+func responseProblem(resp *http.Response) *Problem {
+	problem := &Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(resp.StatusCode),
+		Status: resp.StatusCode,
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "application/problem+json" {
+		return problem
+	}
+	err := json.NewDecoder(resp.Body).Decode(problem)
+	if err != nil {
+		problem.Detail = "couldn't decode problem details: " + err.Error()
+	}
+	return problem
+}
@@ -0,0 +1,858 @@
+// Code generated by genclient from ../openapi.json. DO NOT EDIT.
+
+package client
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// APIKey is an API key, without the key itself.
+type APIKey struct {
+	ID         uuid.UUID  `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	UserID     uuid.UUID  `json:"user_id"`
+	Name       string     `json:"name"`
+
+	// The start of the key, to tell keys apart.
+	Prefix    string     `json:"prefix"`
+	Scopes    []Scope    `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// AuditLogEntry is a record of a sensitive action.
+type AuditLogEntry struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// The user who acted, if any.
+	ActorID *uuid.UUID `json:"actor_id"`
+
+	// E.g. user.disable or video.delete.
+	Action     string `json:"action"`
+	TargetType string `json:"target_type"`
+	TargetID   string `json:"target_id"`
+	Details    string `json:"details"`
+}
+
+// CodeRequest is a code from an authenticator app.
+type CodeRequest struct {
+	Code string `json:"code"`
+}
+
+// CreateAPIKeyRequest is a new API key.
+type CreateAPIKeyRequest struct {
+	Name   string  `json:"name"`
+	Scopes []Scope `json:"scopes"`
+
+	// When the key stops working. Keys without one never expire.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// CreateUserRequest is a sign up.
+type CreateUserRequest struct {
+	Email string `json:"email"`
+
+	// At least PASSWORD_MIN_LENGTH characters, not a known breached password and
+	// not the email.
+	Password string `json:"password"`
+}
+
+// CreateVideoRequest is a new video's metadata.
+type CreateVideoRequest struct {
+	Title       string  `json:"title"`
+	Description *string `json:"description,omitempty"`
+
+	// Defaults to public.
+	Visibility *Visibility `json:"visibility,omitempty"`
+}
+
+// CreatedAPIKey is a new API key with the key itself.
+type CreatedAPIKey struct {
+	APIKey
+	// Sent as "Authorization: ApiKey <key>". Only returned on creation.
+	Key string `json:"key"`
+}
+
+// DisableTOTPRequest is the current password and, while two-factor login is
+// enabled, a second factor.
+type DisableTOTPRequest struct {
+	Password string `json:"password"`
+
+	// A code from an authenticator app or an unused recovery code.
+	Code *string `json:"code,omitempty"`
+}
+
+// ErrorCode is a stable identifier of the kind of error. New codes may be
+// added.
+type ErrorCode string
+
+const (
+	ErrorCodeInvalidRequest       ErrorCode = "invalid_request"
+	ErrorCodeMalformedBody        ErrorCode = "malformed_body"
+	ErrorCodeValidationFailed     ErrorCode = "validation_failed"
+	ErrorCodeInvalidID            ErrorCode = "invalid_id"
+	ErrorCodeUnauthorized         ErrorCode = "unauthorized"
+	ErrorCodeInvalidCredentials   ErrorCode = "invalid_credentials"
+	ErrorCodeInvalidToken         ErrorCode = "invalid_token"
+	ErrorCodeForbidden            ErrorCode = "forbidden"
+	ErrorCodeAccountDisabled      ErrorCode = "account_disabled"
+	ErrorCodeInsufficientScope    ErrorCode = "insufficient_scope"
+	ErrorCodeNotFound             ErrorCode = "not_found"
+	ErrorCodeConflict             ErrorCode = "conflict"
+	ErrorCodeEmailTaken           ErrorCode = "email_taken"
+	ErrorCodeQuotaExceeded        ErrorCode = "quota_exceeded"
+	ErrorCodeUnsupportedMediaType ErrorCode = "unsupported_media_type"
+	ErrorCodeInvalidMedia         ErrorCode = "invalid_media"
+	ErrorCodeRateLimited          ErrorCode = "rate_limited"
+	ErrorCodeInternalError        ErrorCode = "internal_error"
+	ErrorCodeUpstreamError        ErrorCode = "upstream_error"
+)
+
+// FieldError is a problem with a single field of a request.
+type FieldError struct {
+	// The JSON name of the field, or the query parameter.
+	Field string `json:"field"`
+
+	// E.g. required, invalid, invalid_choice or too_short.
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Health is the liveness of the process.
+type Health struct {
+	Status string `json:"status"`
+}
+
+// HealthCheck is the result of a readiness check.
+type HealthCheck struct {
+	Status string  `json:"status"`
+	Error  *string `json:"error,omitempty"`
+
+	// The tool's version, for ffmpeg and ffprobe.
+	Version    *string `json:"version,omitempty"`
+	DurationMS float64 `json:"duration_ms"`
+}
+
+// Identity is a single sign-on identity linked to a user.
+type Identity struct {
+	Issuer    string    `json:"issuer"`
+	Subject   string    `json:"subject"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// JWK is a public key in JSON Web Key form (RFC 7517).
+type JWK struct {
+	Kty string  `json:"kty"`
+	Kid string  `json:"kid"`
+	Use string  `json:"use"`
+	Alg string  `json:"alg"`
+	N   *string `json:"n,omitempty"`
+	E   *string `json:"e,omitempty"`
+	Crv *string `json:"crv,omitempty"`
+	X   *string `json:"x,omitempty"`
+}
+
+// JWKS is a JSON Web Key Set.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// LoginAttempt is a recorded login attempt.
+type LoginAttempt struct {
+	ID        int64       `json:"id"`
+	CreatedAt time.Time   `json:"created_at"`
+	Email     string      `json:"email"`
+	IP        string      `json:"ip"`
+	UserAgent string      `json:"user_agent"`
+	Result    LoginResult `json:"result"`
+}
+
+// LoginMFARequest is the second step of a two-factor login.
+type LoginMFARequest struct {
+	MFAToken string `json:"mfa_token"`
+
+	// A TOTP code or a recovery code.
+	Code string `json:"code"`
+}
+
+// LoginOIDCRequest is the login code from the single sign-on callback.
+type LoginOIDCRequest struct {
+	Code string `json:"code"`
+}
+
+// LoginRequest is the credentials of a password login.
+type LoginRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// LoginResponse is a new session, or an MFA challenge for users with
+// two-factor login.
+type LoginResponse struct {
+	*MFAChallenge
+	*LoginSession
+}
+
+// LoginResult is the outcome of a login attempt.
+type LoginResult string
+
+const (
+	LoginResultSuccess       LoginResult = "success"
+	LoginResultFailure       LoginResult = "failure"
+	LoginResultBlocked       LoginResult = "blocked"
+	LoginResultDisabled      LoginResult = "disabled"
+	LoginResultPasswordReset LoginResult = "password_reset"
+)
+
+// LoginSession is a user who logged in and the credentials of their new
+// session.
+type LoginSession struct {
+	User
+	Tokens
+}
+
+// MFAChallenge is the second step of a two-factor login.
+type MFAChallenge struct {
+	MFARequired bool `json:"mfa_required"`
+
+	// Sent to /api/login/mfa with the code, within five minutes.
+	MFAToken string `json:"mfa_token"`
+}
+
+// PasswordRequest is the current password, confirming a sensitive change.
+type PasswordRequest struct {
+	Password string `json:"password"`
+}
+
+// PasswordResetConfirmRequest is a new password with the token from a reset
+// link.
+type PasswordResetConfirmRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// PasswordResetRequest is the email of an account to reset the password of.
+type PasswordResetRequest struct {
+	Email string `json:"email"`
+}
+
+// PlanLimits is the limits of a quota plan.
+type PlanLimits struct {
+	MaxStorageBytes   int64 `json:"max_storage_bytes"`
+	MaxVideos         int   `json:"max_videos"`
+	MaxVideoBytes     int64 `json:"max_video_bytes"`
+	MaxThumbnailBytes int64 `json:"max_thumbnail_bytes"`
+}
+
+// Problem is an RFC 7807 problem details object describing a failed request.
+type Problem struct {
+	Type string `json:"type"`
+
+	// The status text.
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+
+	// What went wrong, for people.
+	Detail string    `json:"detail"`
+	Code   ErrorCode `json:"code"`
+
+	// Identifies the request in the server's logs.
+	RequestID *string `json:"request_id,omitempty"`
+
+	// The invalid fields of a validation_failed problem.
+	Errors []FieldError `json:"errors,omitempty"`
+}
+
+// Readiness is the results of the readiness checks.
+type Readiness struct {
+	Status string `json:"status"`
+
+	// The checks by name: database, assets, storage, ffmpeg and ffprobe.
+	Checks map[string]HealthCheck `json:"checks"`
+}
+
+// RecoveryCodes is single-use codes that stand in for a TOTP code.
+type RecoveryCodes struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// Role is what a user is allowed to do.
+type Role string
+
+const (
+	RoleUser      Role = "user"
+	RoleModerator Role = "moderator"
+	RoleAdmin     Role = "admin"
+)
+
+// Scope is a permission granted to an API key.
+type Scope string
+
+const (
+	ScopeVideosRead  Scope = "videos:read"
+	ScopeVideosWrite Scope = "videos:write"
+)
+
+// Session is a logged in device.
+type Session struct {
+	ID         uuid.UUID `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+}
+
+// TOTPEnrollment is a new TOTP secret, pending confirmation.
+type TOTPEnrollment struct {
+	// The base32 secret, for manual entry.
+	Secret string `json:"secret"`
+
+	// An otpauth URI, to show as a QR code.
+	URI string `json:"uri"`
+}
+
+// TokenRequest is the token from a link mailed to the user.
+type TokenRequest struct {
+	Token string `json:"token"`
+}
+
+// Tokens is the credentials of a session.
+type Tokens struct {
+	// A short-lived access JWT.
+	Token string `json:"token"`
+
+	// A single-use token for /api/refresh.
+	RefreshToken string    `json:"refresh_token"`
+	SessionID    uuid.UUID `json:"session_id"`
+}
+
+// UpdateEmailRequest is a new email, confirmed with the current password.
+type UpdateEmailRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// UpdatePasswordRequest is a new password, confirmed with the current one.
+type UpdatePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// UpdateRoleRequest is a user's new role.
+type UpdateRoleRequest struct {
+	Role Role `json:"role"`
+}
+
+// Usage is a user's plan and how much of it they use.
+type Usage struct {
+	Plan           string     `json:"plan"`
+	Limits         PlanLimits `json:"limits"`
+	UsedBytes      int64      `json:"used_bytes"`
+	VideoCount     int        `json:"video_count"`
+	RemainingBytes int64      `json:"remaining_bytes"`
+}
+
+// User is a Tubely account.
+type User struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Email     string    `json:"email"`
+
+	// The quota plan, e.g. free.
+	Plan            string     `json:"plan"`
+	Role            Role       `json:"role"`
+	DisabledAt      *time.Time `json:"disabled_at"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
+
+	// When two-factor login was turned on.
+	TOTPEnabledAt *time.Time `json:"totp_enabled_at"`
+}
+
+// Video is a video's metadata and the URLs of its files.
+type Video struct {
+	ID            uuid.UUID `json:"id"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+	ThumbnailURL  *string   `json:"thumbnail_url"`
+	ThumbnailSize int64     `json:"thumbnail_size"`
+
+	// Where to play the video. For private videos this is a signed URL that
+	// expires after two hours; fetch the video again for a fresh one.
+	VideoURL  *string `json:"video_url"`
+	VideoSize int64   `json:"video_size"`
+
+	// Base64 SHA-256 of the video file.
+	ChecksumSHA256 *string    `json:"checksum_sha256"`
+	Title          string     `json:"title"`
+	Description    string     `json:"description"`
+	Visibility     Visibility `json:"visibility"`
+	UserID         uuid.UUID  `json:"user_id"`
+}
+
+// Visibility is who can watch a video.
+type Visibility string
+
+const (
+	VisibilityPublic  Visibility = "public"
+	VisibilityPrivate Visibility = "private"
+)
+
+// GetJWKS returns the public keys access tokens are signed with. HMAC secrets
+// are never published, so the set is empty when tokens are signed with
+// JWT_SECRET.
+func (c *Client) GetJWKS(ctx context.Context) (*JWKS, error) {
+	var out JWKS
+	err := c.do(ctx, request{method: "GET", path: "/.well-known/jwks.json"}, &out)
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ListAuditLogParams are the optional query parameters of ListAuditLog. Zero
+// values are left out.
+type ListAuditLogParams struct {
+	// How many entries to return, at most 1000.
+	Limit int
+}
+
+// ListAuditLog lists the most recent audit log entries.
+func (c *Client) ListAuditLog(ctx context.Context, params ListAuditLogParams) ([]AuditLogEntry, error) {
+	query := url.Values{}
+	if params.Limit != 0 {
+		query.Set("limit", strconv.Itoa(params.Limit))
+	}
+	var out []AuditLogEntry
+	err := c.do(ctx, request{method: "GET", path: "/admin/audit_log", query: query}, &out)
+	return out, err
+}
+
+// ListLoginAttemptsParams are the optional query parameters of
+// ListLoginAttempts. Zero values are left out.
+type ListLoginAttemptsParams struct {
+	// Only attempts for this email.
+	Email string
+	// Only attempts from this client address.
+	IP string
+	// How many entries to return, at most 1000.
+	Limit int
+}
+
+// ListLoginAttempts lists the most recent login attempts.
+func (c *Client) ListLoginAttempts(ctx context.Context, params ListLoginAttemptsParams) ([]LoginAttempt, error) {
+	query := url.Values{}
+	if params.Email != "" {
+		query.Set("email", params.Email)
+	}
+	if params.IP != "" {
+		query.Set("ip", params.IP)
+	}
+	if params.Limit != 0 {
+		query.Set("limit", strconv.Itoa(params.Limit))
+	}
+	var out []LoginAttempt
+	err := c.do(ctx, request{method: "GET", path: "/admin/login_attempts", query: query}, &out)
+	return out, err
+}
+
+// ResetDatabase deletes all data. Only allowed when PLATFORM is dev.
+func (c *Client) ResetDatabase(ctx context.Context) (string, error) {
+	var out string
+	err := c.do(ctx, request{method: "POST", path: "/admin/reset"}, &out)
+	return out, err
+}
+
+// ListUsers lists all users.
+func (c *Client) ListUsers(ctx context.Context) ([]User, error) {
+	var out []User
+	err := c.do(ctx, request{method: "GET", path: "/admin/users"}, &out)
+	return out, err
+}
+
+// DisableUser disables a user and ends all of their sessions.
+func (c *Client) DisableUser(ctx context.Context, userID uuid.UUID) (*User, error) {
+	var out User
+	err := c.do(ctx, request{method: "POST", path: "/admin/users/" + url.PathEscape(userID.String()) + "/disable"}, &out)
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// EnableUser enables a disabled user.
+func (c *Client) EnableUser(ctx context.Context, userID uuid.UUID) (*User, error) {
+	var out User
+	err := c.do(ctx, request{method: "POST", path: "/admin/users/" + url.PathEscape(userID.String()) + "/enable"}, &out)
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// UpdateUserRole changes a user's role.
+func (c *Client) UpdateUserRole(ctx context.Context, userID uuid.UUID, body UpdateRoleRequest) (*User, error) {
+	var out User
+	err := c.do(ctx, request{method: "PUT", path: "/admin/users/" + url.PathEscape(userID.String()) + "/role", body: body}, &out)
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// AdminGetVideo returns any user's video, private ones included.
+func (c *Client) AdminGetVideo(ctx context.Context, videoID uuid.UUID) (*Video, error) {
+	var out Video
+	err := c.do(ctx, request{method: "GET", path: "/admin/videos/" + url.PathEscape(videoID.String())}, &out)
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// AdminDeleteVideoParams are the optional query parameters of
+// AdminDeleteVideo. Zero values are left out.
+type AdminDeleteVideoParams struct {
+	// Why the video was removed, for the audit log.
+	Reason string
+}
+
+// AdminDeleteVideo deletes any user's video with its files.
+func (c *Client) AdminDeleteVideo(ctx context.Context, videoID uuid.UUID, params AdminDeleteVideoParams) error {
+	query := url.Values{}
+	if params.Reason != "" {
+		query.Set("reason", params.Reason)
+	}
+	return c.do(ctx, request{method: "DELETE", path: "/admin/videos/" + url.PathEscape(videoID.String()), query: query}, nil)
+}
+
+// ListAPIKeys lists the current user's API keys, including revoked and
+// expired ones.
+func (c *Client) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	var out []APIKey
+	err := c.do(ctx, request{method: "GET", path: "/api/api_keys"}, &out)
+	return out, err
+}
+
+// CreateAPIKey creates an API key. The key itself is only returned this once.
+func (c *Client) CreateAPIKey(ctx context.Context, body CreateAPIKeyRequest) (*CreatedAPIKey, error) {
+	var out CreatedAPIKey
+	err := c.do(ctx, request{method: "POST", path: "/api/api_keys", body: body}, &out)
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// RevokeAPIKey revokes one of the current user's API keys.
+func (c *Client) RevokeAPIKey(ctx context.Context, keyID uuid.UUID) error {
+	return c.do(ctx, request{method: "DELETE", path: "/api/api_keys/" + url.PathEscape(keyID.String())}, nil)
+}
+
+// RequestEmailVerification mails the current user a new email verification
+// link.
+func (c *Client) RequestEmailVerification(ctx context.Context) error {
+	return c.do(ctx, request{method: "POST", path: "/api/email_verification"}, nil)
+}
+
+// ConfirmEmailVerification marks an email as verified with the token from a
+// verification link.
+func (c *Client) ConfirmEmailVerification(ctx context.Context, body TokenRequest) error {
+	return c.do(ctx, request{method: "POST", path: "/api/email_verification/confirm", body: body}, nil)
+}
+
+// Login logs in with an email and password. Users with two-factor login
+// enabled get an MFA challenge to complete at /api/login/mfa instead of a
+// session.
+func (c *Client) Login(ctx context.Context, body LoginRequest) (*LoginResponse, error) {
+	var out LoginResponse
+	err := c.do(ctx, request{method: "POST", path: "/api/login", body: body}, &out)
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// LoginMFA completes a two-factor login with a TOTP code or a recovery code.
+func (c *Client) LoginMFA(ctx context.Context, body LoginMFARequest) (*LoginSession, error) {
+	var out LoginSession
+	err := c.do(ctx, request{method: "POST", path: "/api/login/mfa", body: body}, &out)
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// LoginOIDC trades the one-time login code from the single sign-on callback
+// for a session, or an MFA challenge.
+func (c *Client) LoginOIDC(ctx context.Context, body LoginOIDCRequest) (*LoginResponse, error) {
+	var out LoginResponse
+	err := c.do(ctx, request{method: "POST", path: "/api/login/oidc", body: body}, &out)
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetOpenAPI returns this document.
+func (c *Client) GetOpenAPI(ctx context.Context) (map[string]any, error) {
+	var out map[string]any
+	err := c.do(ctx, request{method: "GET", path: "/api/openapi.json"}, &out)
+	return out, err
+}
+
+// RequestPasswordReset mails a password reset link if the email belongs to an
+// account. The response is the same either way.
+func (c *Client) RequestPasswordReset(ctx context.Context, body PasswordResetRequest) error {
+	return c.do(ctx, request{method: "POST", path: "/api/password_reset", body: body}, nil)
+}
+
+// ConfirmPasswordReset sets a new password with the token from a reset link,
+// ends all of the user's sessions and revokes their API keys.
+func (c *Client) ConfirmPasswordReset(ctx context.Context, body PasswordResetConfirmRequest) error {
+	return c.do(ctx, request{method: "POST", path: "/api/password_reset/confirm", body: body}, nil)
+}
+
+// RefreshSession trades a refresh token for a new access token and refresh
+// token. Each refresh token works once; reusing one revokes its whole
+// session.
+func (c *Client) RefreshSession(ctx context.Context, refreshToken string) (*Tokens, error) {
+	var out Tokens
+	err := c.do(ctx, request{method: "POST", path: "/api/refresh", authorization: "Bearer " + refreshToken}, &out)
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Logout ends the session of a refresh token. Unknown tokens are ignored.
+func (c *Client) Logout(ctx context.Context, refreshToken string) error {
+	return c.do(ctx, request{method: "POST", path: "/api/revoke", authorization: "Bearer " + refreshToken}, nil)
+}
+
+// ListSessions lists the current user's active sessions.
+func (c *Client) ListSessions(ctx context.Context) ([]Session, error) {
+	var out []Session
+	err := c.do(ctx, request{method: "GET", path: "/api/sessions"}, &out)
+	return out, err
+}
+
+// RevokeAllSessions logs the current user out everywhere, including the
+// session making the request.
+func (c *Client) RevokeAllSessions(ctx context.Context) error {
+	return c.do(ctx, request{method: "DELETE", path: "/api/sessions"}, nil)
+}
+
+// RevokeSession ends one of the current user's sessions.
+func (c *Client) RevokeSession(ctx context.Context, sessionID uuid.UUID) error {
+	return c.do(ctx, request{method: "DELETE", path: "/api/sessions/" + url.PathEscape(sessionID.String())}, nil)
+}
+
+// UploadThumbnail sets a video's thumbnail, replacing any previous one.
+func (c *Client) UploadThumbnail(ctx context.Context, videoID uuid.UUID, file File) (*Video, error) {
+	var out Video
+	err := c.do(ctx, request{method: "POST", path: "/api/thumbnail_upload/" + url.PathEscape(videoID.String()), file: &file, fileField: "thumbnail"}, &out)
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetUsage returns the current user's plan and how much of it they use.
+func (c *Client) GetUsage(ctx context.Context) (*Usage, error) {
+	var out Usage
+	err := c.do(ctx, request{method: "GET", path: "/api/usage"}, &out)
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// CreateUser signs up a new user and mails them a link to verify their email.
+func (c *Client) CreateUser(ctx context.Context, body CreateUserRequest) (*User, error) {
+	var out User
+	err := c.do(ctx, request{method: "POST", path: "/api/users", body: body}, &out)
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetCurrentUser returns the current user.
+func (c *Client) GetCurrentUser(ctx context.Context) (*User, error) {
+	var out User
+	err := c.do(ctx, request{method: "GET", path: "/api/users/me"}, &out)
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// DeleteCurrentUser deletes the current user's account with all of its
+// videos.
+func (c *Client) DeleteCurrentUser(ctx context.Context, body PasswordRequest) error {
+	return c.do(ctx, request{method: "DELETE", path: "/api/users/me", body: body}, nil)
+}
+
+// UpdateEmail changes the current user's email. The new address has to be
+// verified again.
+func (c *Client) UpdateEmail(ctx context.Context, body UpdateEmailRequest) (*User, error) {
+	var out User
+	err := c.do(ctx, request{method: "PUT", path: "/api/users/me/email", body: body}, &out)
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ListIdentities lists the single sign-on identities linked to the current
+// user.
+func (c *Client) ListIdentities(ctx context.Context) ([]Identity, error) {
+	var out []Identity
+	err := c.do(ctx, request{method: "GET", path: "/api/users/me/identities"}, &out)
+	return out, err
+}
+
+// UpdatePassword changes the current user's password, ends all of their
+// sessions and revokes their API keys.
+func (c *Client) UpdatePassword(ctx context.Context, body UpdatePasswordRequest) error {
+	return c.do(ctx, request{method: "PUT", path: "/api/users/me/password", body: body}, nil)
+}
+
+// RegenerateRecoveryCodes replaces the current user's recovery codes.
+func (c *Client) RegenerateRecoveryCodes(ctx context.Context, body PasswordRequest) (*RecoveryCodes, error) {
+	var out RecoveryCodes
+	err := c.do(ctx, request{method: "POST", path: "/api/users/me/recovery_codes", body: body}, &out)
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// EnrollTOTP starts two-factor enrollment with a new TOTP secret.
+func (c *Client) EnrollTOTP(ctx context.Context) (*TOTPEnrollment, error) {
+	var out TOTPEnrollment
+	err := c.do(ctx, request{method: "POST", path: "/api/users/me/totp"}, &out)
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// DisableTOTP turns off two-factor login. Once it is enabled, this takes a
+// second factor as well as the password.
+func (c *Client) DisableTOTP(ctx context.Context, body DisableTOTPRequest) error {
+	return c.do(ctx, request{method: "DELETE", path: "/api/users/me/totp", body: body}, nil)
+}
+
+// ConfirmTOTP turns on two-factor login once a code from the authenticator
+// app checks out.
+func (c *Client) ConfirmTOTP(ctx context.Context, body CodeRequest) (*RecoveryCodes, error) {
+	var out RecoveryCodes
+	err := c.do(ctx, request{method: "POST", path: "/api/users/me/totp/confirm", body: body}, &out)
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// UploadVideo uploads a video's file, replacing any previous one. The file is
+// processed for fast start before it is stored.
+func (c *Client) UploadVideo(ctx context.Context, videoID uuid.UUID, file File) (*Video, error) {
+	var out Video
+	err := c.do(ctx, request{method: "POST", path: "/api/video_upload/" + url.PathEscape(videoID.String()), file: &file, fileField: "video"}, &out)
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ListVideos lists the current user's videos.
+func (c *Client) ListVideos(ctx context.Context) ([]Video, error) {
+	var out []Video
+	err := c.do(ctx, request{method: "GET", path: "/api/videos"}, &out)
+	return out, err
+}
+
+// CreateVideo creates a video's metadata. Its files are uploaded separately.
+func (c *Client) CreateVideo(ctx context.Context, body CreateVideoRequest) (*Video, error) {
+	var out Video
+	err := c.do(ctx, request{method: "POST", path: "/api/videos", body: body}, &out)
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetVideo returns a video's metadata. Private videos are only found by their
+// owner and moderators.
+func (c *Client) GetVideo(ctx context.Context, videoID uuid.UUID) (*Video, error) {
+	var out Video
+	err := c.do(ctx, request{method: "GET", path: "/api/videos/" + url.PathEscape(videoID.String())}, &out)
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// DeleteVideo deletes one of the current user's videos with its files.
+func (c *Client) DeleteVideo(ctx context.Context, videoID uuid.UUID) error {
+	return c.do(ctx, request{method: "DELETE", path: "/api/videos/" + url.PathEscape(videoID.String())}, nil)
+}
+
+// StreamVideoParams are the optional query parameters of StreamVideo. Zero
+// values are left out.
+type StreamVideoParams struct {
+	// Unix time the signed URL expires at.
+	Expires string
+	// Signature of the video and expiry time.
+	Signature string
+}
+
+// StreamVideo streams a video's file from the filesystem storage backend.
+// Public videos need no credentials, nor do private ones through the signed
+// video_url; Range requests are supported.
+func (c *Client) StreamVideo(ctx context.Context, videoID uuid.UUID, params StreamVideoParams) (io.ReadCloser, error) {
+	query := url.Values{}
+	if params.Expires != "" {
+		query.Set("expires", params.Expires)
+	}
+	if params.Signature != "" {
+		query.Set("signature", params.Signature)
+	}
+	var out io.ReadCloser
+	err := c.do(ctx, request{method: "GET", path: "/api/videos/" + url.PathEscape(videoID.String()) + "/stream", query: query}, &out)
+	return out, err
+}
+
+// CheckHealth reports whether the process is up, without checking its
+// dependencies.
+func (c *Client) CheckHealth(ctx context.Context) (*Health, error) {
+	var out Health
+	err := c.do(ctx, request{method: "GET", path: "/healthz"}, &out)
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// CheckReadiness checks the database, storage, ffmpeg and ffprobe.
+func (c *Client) CheckReadiness(ctx context.Context) (*Readiness, error) {
+	var out Readiness
+	err := c.do(ctx, request{method: "GET", path: "/readyz"}, &out)
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// clientIP is the address of the client that sent the request, as set by
+// withClientAddr.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// withClientAddr replaces the RemoteAddr of requests relayed by a trusted
+// proxy with the client address the proxy forwarded, so that login
+// throttling, sessions and logs see the client rather than the proxy. The
+// headers of anyone else are ignored since clients can send whatever they
+// like.
+func withClientAddr(trusted []netip.Prefix, next http.Handler) http.Handler {
+	if len(trusted) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if client, ok := forwardedClient(r, trusted); ok {
+			r.RemoteAddr = net.JoinHostPort(client.String(), "0")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// forwardedClient walks the chain of forwarded addresses back from the
+// peer, trusting each hop only while it is a trusted proxy. X-Forwarded-For
+// is preferred over Forwarded since that's what most proxies send.
+func forwardedClient(r *http.Request, trusted []netip.Prefix) (netip.Addr, bool) {
+	peer, err := netip.ParseAddr(clientIP(r))
+	if err != nil || !isTrusted(peer.Unmap(), trusted) {
+		return netip.Addr{}, false
+	}
+
+	chain := forwardedFor(r.Header.Values("X-Forwarded-For"))
+	if len(chain) == 0 {
+		chain = forwardedElements(r.Header.Values("Forwarded"))
+	}
+	client := netip.Addr{}
+	for i := len(chain) - 1; i >= 0; i-- {
+		addr, err := parseForwardedAddr(chain[i])
+		if err != nil {
+			// Unknown or obfuscated hops end the chain; what's before them
+			// can't be attributed.
+			break
+		}
+		client = addr
+		if !isTrusted(addr, trusted) {
+			break
+		}
+	}
+	return client, client.IsValid()
+}
+
+func forwardedFor(values []string) []string {
+	var chain []string
+	for _, v := range values {
+		for _, addr := range strings.Split(v, ",") {
+			chain = append(chain, strings.TrimSpace(addr))
+		}
+	}
+	return chain
+}
+
+// forwardedElements returns the for= parameters of RFC 7239 Forwarded
+// headers.
+func forwardedElements(values []string) []string {
+	var chain []string
+	for _, v := range values {
+		for _, element := range strings.Split(v, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(name, "for") {
+					chain = append(chain, strings.Trim(value, `"`))
+				}
+			}
+		}
+	}
+	return chain
+}
+
+// parseForwardedAddr parses an address that may carry a port and, for IPv6,
+// brackets.
+func parseForwardedAddr(s string) (netip.Addr, error) {
+	if addrPort, err := netip.ParseAddrPort(s); err == nil {
+		return addrPort.Addr().Unmap(), nil
+	}
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"))
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return addr.Unmap(), nil
+}
+
+func isTrusted(addr netip.Addr, trusted []netip.Prefix) bool {
+	for _, prefix := range trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const commandUsage = `usage: tubely [flags] [command]
+
+Without a command the API server is started. Every setting can be given in
+the YAML file named by -config, as an environment variable or as a flag;
+run tubely -h for the list.
+
+Commands:
+  config                   print the effective configuration, secrets redacted
+  verify                   re-check stored videos against their recorded checksums
+  set-plan <email> <plan>  move a user to a different quota plan
+  set-role <email> <role>  make a user a user, moderator or admin
+`
+
+// runCommand runs the maintenance command named by args[0] and returns the
+// process exit code.
+func (cfg *apiConfig) runCommand(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	switch args[0] {
+	case "verify":
+		failed, err := cfg.verifyObjects(ctx, stdout)
+		if err != nil {
+			fmt.Fprintf(stderr, "Couldn't verify stored videos: %v\n", err)
+			return 1
+		}
+		if failed > 0 {
+			return 1
+		}
+		return 0
+
+	case "set-plan":
+		if len(args) != 3 {
+			fmt.Fprint(stderr, commandUsage)
+			return 2
+		}
+		email, planName := args[1], args[2]
+		if _, ok := cfg.plans[planName]; !ok {
+			fmt.Fprintf(stderr, "Unknown plan %q\n", planName)
+			return 1
+		}
+		user, err := cfg.db.WithContext(ctx).GetUserByEmail(strings.ToLower(strings.TrimSpace(email)))
+		if err != nil {
+			fmt.Fprintf(stderr, "Couldn't get user: %v\n", err)
+			return 1
+		}
+		if user.Email == "" {
+			fmt.Fprintf(stderr, "No user with email %q\n", email)
+			return 1
+		}
+		err = cfg.db.WithContext(ctx).UpdateUserPlan(user.ID, planName)
+		if err != nil {
+			fmt.Fprintf(stderr, "Couldn't update plan: %v\n", err)
+			return 1
+		}
+		fmt.Fprintf(stdout, "%s is now on the %s plan\n", email, planName)
+		return 0
+
+	case "set-role":
+		if len(args) != 3 {
+			fmt.Fprint(stderr, commandUsage)
+			return 2
+		}
+		email, role := args[1], database.Role(args[2])
+		if !role.Valid() {
+			fmt.Fprintf(stderr, "Unknown role %q\n", role)
+			return 1
+		}
+		user, err := cfg.db.WithContext(ctx).GetUserByEmail(strings.ToLower(strings.TrimSpace(email)))
+		if err != nil {
+			fmt.Fprintf(stderr, "Couldn't get user: %v\n", err)
+			return 1
+		}
+		if user.Email == "" {
+			fmt.Fprintf(stderr, "No user with email %q\n", email)
+			return 1
+		}
+		err = cfg.db.WithContext(ctx).UpdateUserRole(user.ID, role)
+		if err != nil {
+			fmt.Fprintf(stderr, "Couldn't update role: %v\n", err)
+			return 1
+		}
+		cfg.audit(nil, "user.set_role", auditTargetUser, user.ID.String(), fmt.Sprintf("%s -> %s", user.Role, role))
+		fmt.Fprintf(stdout, "%s now has the %s role\n", email, role)
+		return 0
+	}
+
+	fmt.Fprint(stderr, commandUsage)
+	return 2
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// denylistReloadInterval bounds how long a revocation written by another
+// process, such as a command, takes to be noticed. Revocations made by the
+// server itself apply at once.
+const denylistReloadInterval = 30 * time.Second
+
+// accessTokenDenylist keeps revoked token and session IDs in memory so
+// checking an access token doesn't cost a database query.
+type accessTokenDenylist struct {
+	db       database.Client
+	mu       sync.RWMutex
+	denied   map[string]time.Time
+	loadedAt time.Time
+	// reload is the reload in flight, if any. Checks that find the list stale
+	// wait for it rather than each querying the database.
+	reload *denylistReload
+}
+
+type denylistReload struct {
+	done chan struct{}
+	err  error
+}
+
+func newAccessTokenDenylist(db database.Client) *accessTokenDenylist {
+	return &accessTokenDenylist{db: db}
+}
+
+func (d *accessTokenDenylist) IsRevoked(token auth.AccessToken) (bool, error) {
+	err := d.refresh()
+	if err != nil {
+		return false, err
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if _, ok := d.denied[token.ID]; ok {
+		return true, nil
+	}
+	if _, ok := d.denied[token.SessionID]; ok && token.SessionID != "" {
+		return true, nil
+	}
+	return false, nil
+}
+
+// refresh reloads the list if it is stale, without holding the lock during
+// the query.
+func (d *accessTokenDenylist) refresh() error {
+	d.mu.RLock()
+	fresh := time.Since(d.loadedAt) <= denylistReloadInterval
+	d.mu.RUnlock()
+	if fresh {
+		return nil
+	}
+
+	d.mu.Lock()
+	if time.Since(d.loadedAt) <= denylistReloadInterval {
+		d.mu.Unlock()
+		return nil
+	}
+	reload := d.reload
+	if reload != nil {
+		d.mu.Unlock()
+		<-reload.done
+		return reload.err
+	}
+	reload = &denylistReload{done: make(chan struct{})}
+	d.reload = reload
+	d.mu.Unlock()
+
+	denied, err := d.db.GetDeniedAccessTokens()
+
+	d.mu.Lock()
+	if err == nil {
+		now := time.Now()
+		// Keep what deny added while the query ran; it may not have seen it.
+		for id, expiresAt := range d.denied {
+			if expiresAt.After(now) && expiresAt.After(denied[id]) {
+				denied[id] = expiresAt
+			}
+		}
+		d.denied = denied
+		d.loadedAt = now
+	}
+	d.reload = nil
+	d.mu.Unlock()
+
+	reload.err = err
+	close(reload.done)
+	return err
+}
+
+func (d *accessTokenDenylist) deny(id string, expiresAt time.Time) error {
+	err := d.db.DenyAccessTokens(id, expiresAt)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.denied != nil && expiresAt.After(d.denied[id]) {
+		d.denied[id] = expiresAt
+	}
+	return nil
+}
+
+// revokeSessionAccessTokens makes the access tokens issued for the sessions
+// invalid at once instead of when they expire. Their refresh tokens have to
+// be revoked separately.
+func (cfg *apiConfig) revokeSessionAccessTokens(sessionIDs ...string) error {
+	// No token issued before now outlives this.
+	expiresAt := time.Now().UTC().Add(cfg.accessTokenTTL)
+	for _, id := range sessionIDs {
+		if id == "" {
+			continue
+		}
+		err := cfg.denylist.deny(id, expiresAt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// revokeAllSessions logs the user out everywhere, access tokens included.
+func (cfg *apiConfig) revokeAllSessions(ctx context.Context, userID uuid.UUID) error {
+	sessionIDs, err := cfg.db.WithContext(ctx).RevokeAllSessions(userID)
+	if err != nil {
+		return err
+	}
+	return cfg.revokeSessionAccessTokens(sessionIDs...)
+}
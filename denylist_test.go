@@ -0,0 +1,131 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func newTestDB(t *testing.T) database.Client {
+	t.Helper()
+	db, err := database.NewClient(filepath.Join(t.TempDir(), "tubely.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// expire makes the next check reload the denylist.
+func (d *accessTokenDenylist) expire() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.loadedAt = time.Time{}
+}
+
+func wantRevoked(t *testing.T, d *accessTokenDenylist, token auth.AccessToken, want bool) {
+	t.Helper()
+	revoked, err := d.IsRevoked(token)
+	if err != nil {
+		t.Errorf("IsRevoked(%+v) failed: %v", token, err)
+		return
+	}
+	if revoked != want {
+		t.Errorf("IsRevoked(%+v) = %v, want %v", token, revoked, want)
+	}
+}
+
+func TestDenylistExpiry(t *testing.T) {
+	db := newTestDB(t)
+	d := newAccessTokenDenylist(db)
+	wantRevoked(t, d, auth.AccessToken{ID: "token"}, false)
+
+	now := time.Now().UTC()
+	for id, expiresAt := range map[string]time.Time{
+		"token":   now.Add(time.Hour),
+		"session": now.Add(time.Hour),
+		"expired": now.Add(50 * time.Millisecond),
+	} {
+		err := d.deny(id, expiresAt)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	wantRevoked(t, d, auth.AccessToken{ID: "token"}, true)
+	wantRevoked(t, d, auth.AccessToken{ID: "other", SessionID: "session"}, true)
+	wantRevoked(t, d, auth.AccessToken{ID: "expired"}, true)
+
+	time.Sleep(100 * time.Millisecond)
+	d.expire()
+	wantRevoked(t, d, auth.AccessToken{ID: "expired"}, false)
+	wantRevoked(t, d, auth.AccessToken{ID: "token"}, true)
+	wantRevoked(t, d, auth.AccessToken{ID: "other", SessionID: "session"}, true)
+
+	denied, err := db.GetDeniedAccessTokens()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := denied["expired"]; ok {
+		t.Error("Expired entry is still in the database")
+	}
+	if len(denied) != 2 {
+		t.Errorf("Database has %d denylist entries, want 2", len(denied))
+	}
+}
+
+// TestDenylistReload holds up a reload mid-query and checks that revoking a
+// session doesn't wait for it and that other checks share it.
+func TestDenylistReload(t *testing.T) {
+	db := newTestDB(t)
+	var block atomic.Bool
+	var queries atomic.Int32
+	inQuery := make(chan struct{})
+	release := make(chan struct{})
+	db.ObserveQueries(func(operation string, _ time.Duration) {
+		if operation != "GetDeniedAccessTokens" || !block.Load() {
+			return
+		}
+		if queries.Add(1) == 1 {
+			close(inQuery)
+			<-release
+		}
+	})
+	d := newAccessTokenDenylist(db)
+	wantRevoked(t, d, auth.AccessToken{ID: "token"}, false)
+
+	block.Store(true)
+	d.expire()
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wantRevoked(t, d, auth.AccessToken{ID: "token", SessionID: "session"}, true)
+		}()
+	}
+	<-inQuery
+
+	denied := make(chan error, 1)
+	go func() {
+		denied <- d.deny("session", time.Now().Add(time.Hour))
+	}()
+	select {
+	case err := <-denied:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Revoking a session waited for the denylist reload")
+	}
+
+	close(release)
+	wg.Wait()
+	// One reload is a DELETE and a SELECT.
+	if n := queries.Load(); n != 2 {
+		t.Errorf("Checks made %d denylist queries, want 2", n)
+	}
+}
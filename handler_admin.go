@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultAuditLogLimit = 100
+	maxAuditLogLimit     = 1000
+)
+
+func (cfg *apiConfig) handlerAdminUsersList(w http.ResponseWriter, r *http.Request) {
+	p := principalFromContext(r.Context())
+
+	users, err := cfg.db.WithContext(r.Context()).GetUsers()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve users", err)
+		return
+	}
+
+	cfg.audit(&p.UserID, "users.list", auditTargetUser, "*", "")
+	respondWithJSON(w, http.StatusOK, users)
+}
+
+func (cfg *apiConfig) handlerAdminUserDisable(w http.ResponseWriter, r *http.Request) {
+	cfg.setUserDisabled(w, r, true)
+}
+
+func (cfg *apiConfig) handlerAdminUserEnable(w http.ResponseWriter, r *http.Request) {
+	cfg.setUserDisabled(w, r, false)
+}
+
+func (cfg *apiConfig) setUserDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	p := principalFromContext(r.Context())
+
+	user, ok := cfg.adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+	if user.ID == p.UserID {
+		respondWithError(w, http.StatusForbidden, "You can't change your own account status", nil)
+		return
+	}
+
+	err := cfg.db.WithContext(r.Context()).SetUserDisabled(user.ID, disabled)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update user", err)
+		return
+	}
+
+	action := "user.enable"
+	if disabled {
+		action = "user.disable"
+		// Ending the sessions denies their access tokens too, so they don't
+		// come back to life if the account is enabled again.
+		err = cfg.revokeAllSessions(r.Context(), user.ID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't revoke sessions", err)
+			return
+		}
+	}
+	cfg.audit(&p.UserID, action, auditTargetUser, user.ID.String(), "")
+
+	updated, err := cfg.db.WithContext(r.Context()).GetUser(user.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, updated)
+}
+
+func (cfg *apiConfig) handlerAdminUserRoleUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Role database.Role `json:"role"`
+	}
+
+	p := principalFromContext(r.Context())
+
+	user, ok := cfg.adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+	if user.ID == p.UserID {
+		respondWithError(w, http.StatusForbidden, "You can't change your own role", nil)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, codeMalformedBody, "Couldn't decode parameters", err)
+		return
+	}
+	if !params.Role.Valid() {
+		respondWithFieldErrors(w, fieldErrors{{Field: "role", Code: "invalid_choice", Message: "Role must be user, moderator or admin"}})
+		return
+	}
+
+	err = cfg.db.WithContext(r.Context()).UpdateUserRole(user.ID, params.Role)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update role", err)
+		return
+	}
+	cfg.audit(&p.UserID, "user.set_role", auditTargetUser, user.ID.String(), fmt.Sprintf("%s -> %s", user.Role, params.Role))
+
+	updated, err := cfg.db.WithContext(r.Context()).GetUser(user.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, updated)
+}
+
+// adminTargetUser loads the user named by the userID path value, responding
+// with an error if there is none.
+func (cfg *apiConfig) adminTargetUser(w http.ResponseWriter, r *http.Request) (*database.User, bool) {
+	userID, err := uuid.Parse(r.PathValue("userID"))
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, codeInvalidID, "Invalid user ID", err)
+		return nil, false
+	}
+	user, err := cfg.db.WithContext(r.Context()).GetUser(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return nil, false
+	}
+	if user == nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't find user", nil)
+		return nil, false
+	}
+	return user, true
+}
+
+func (cfg *apiConfig) handlerAdminVideoGet(w http.ResponseWriter, r *http.Request) {
+	p := principalFromContext(r.Context())
+
+	video, ok := cfg.adminTargetVideo(w, r)
+	if !ok {
+		return
+	}
+
+	cfg.audit(&p.UserID, "video.view", auditTargetVideo, video.ID.String(), "")
+	cfg.respondWithVideo(w, r, http.StatusOK, video)
+}
+
+func (cfg *apiConfig) handlerAdminVideoDelete(w http.ResponseWriter, r *http.Request) {
+	p := principalFromContext(r.Context())
+
+	video, ok := cfg.adminTargetVideo(w, r)
+	if !ok {
+		return
+	}
+
+	err := cfg.deleteVideo(r.Context(), video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete video", err)
+		return
+	}
+
+	details := fmt.Sprintf("owner=%s title=%q", video.UserID, video.Title)
+	if reason := r.URL.Query().Get("reason"); reason != "" {
+		details += fmt.Sprintf(" reason=%q", reason)
+	}
+	cfg.audit(&p.UserID, "video.delete", auditTargetVideo, video.ID.String(), details)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adminTargetVideo loads the video named by the videoID path value regardless
+// of its owner, responding with an error if there is none.
+func (cfg *apiConfig) adminTargetVideo(w http.ResponseWriter, r *http.Request) (database.Video, bool) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, codeInvalidID, "Invalid video ID", err)
+		return database.Video{}, false
+	}
+	video, err := cfg.db.WithContext(r.Context()).GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return database.Video{}, false
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't find video", nil)
+		return database.Video{}, false
+	}
+	return video, true
+}
+
+func (cfg *apiConfig) handlerAdminAuditLog(w http.ResponseWriter, r *http.Request) {
+	limit, err := auditLogLimit(r)
+	if err != nil {
+		respondWithFieldErrors(w, fieldErrors{{Field: "limit", Code: "invalid", Message: "Limit must be a positive integer"}})
+		return
+	}
+
+	entries, err := cfg.db.WithContext(r.Context()).GetAuditLog(limit)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve audit log", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, entries)
+}
+
+func (cfg *apiConfig) handlerAdminLoginAttempts(w http.ResponseWriter, r *http.Request) {
+	limit, err := auditLogLimit(r)
+	if err != nil {
+		respondWithFieldErrors(w, fieldErrors{{Field: "limit", Code: "invalid", Message: "Limit must be a positive integer"}})
+		return
+	}
+
+	attempts, err := cfg.db.WithContext(r.Context()).GetLoginAttempts(loginAttemptEmail(r.URL.Query().Get("email")), r.URL.Query().Get("ip"), limit)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve login attempts", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, attempts)
+}
+
+// auditLogLimit reads the limit query parameter of audit listings.
+func auditLogLimit(r *http.Request) (int, error) {
+	s := r.URL.Query().Get("limit")
+	if s == "" {
+		return defaultAuditLogLimit, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+	if n < 1 {
+		return 0, fmt.Errorf("limit %d is not positive", n)
+	}
+	return min(n, maxAuditLogLimit), nil
+}
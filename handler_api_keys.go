@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// API keys are managed with an access JWT only, so a leaked key can't be
+// used to mint more keys.
+
+func (cfg *apiConfig) handlerAPIKeyCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Name      string     `json:"name"`
+		Scopes    []string   `json:"scopes"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+	type response struct {
+		database.APIKey
+		Key string `json:"key"`
+	}
+
+	userID := principalFromContext(r.Context()).UserID
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, codeMalformedBody, "Couldn't decode parameters", err)
+		return
+	}
+	var errs fieldErrors
+	if params.Name == "" {
+		errs.add("name", "required", "Name is required")
+	}
+	if len(params.Scopes) == 0 {
+		errs.add("scopes", "required", "At least one scope is required")
+	}
+	for _, scope := range params.Scopes {
+		if !auth.ValidScope(scope) {
+			errs.add("scopes", "invalid_choice", fmt.Sprintf("Unknown scope %q", scope))
+		}
+	}
+	if params.ExpiresAt != nil && !params.ExpiresAt.After(time.Now()) {
+		errs.add("expires_at", "not_in_future", "Expiry must be in the future")
+	}
+	if len(errs) > 0 {
+		respondWithFieldErrors(w, errs)
+		return
+	}
+
+	rawKey, keyID, err := auth.MakeAPIKey()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create API key", err)
+		return
+	}
+
+	var expiresAt *time.Time
+	if params.ExpiresAt != nil {
+		utc := params.ExpiresAt.UTC()
+		expiresAt = &utc
+	}
+	key, err := cfg.db.WithContext(r.Context()).CreateAPIKey(database.CreateAPIKeyParams{
+		UserID:    userID,
+		Name:      params.Name,
+		Prefix:    keyID,
+		KeyHash:   auth.HashAPIKey(rawKey),
+		Scopes:    params.Scopes,
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save API key", err)
+		return
+	}
+
+	// The key itself is only ever shown in this response.
+	respondWithJSON(w, http.StatusCreated, response{
+		APIKey: key,
+		Key:    rawKey,
+	})
+}
+
+func (cfg *apiConfig) handlerAPIKeysList(w http.ResponseWriter, r *http.Request) {
+	userID := principalFromContext(r.Context()).UserID
+
+	keys, err := cfg.db.WithContext(r.Context()).GetAPIKeys(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve API keys", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, keys)
+}
+
+func (cfg *apiConfig) handlerAPIKeyRevoke(w http.ResponseWriter, r *http.Request) {
+	keyIDString := r.PathValue("keyID")
+	keyID, err := uuid.Parse(keyIDString)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, codeInvalidID, "Invalid API key ID", err)
+		return
+	}
+
+	userID := principalFromContext(r.Context()).UserID
+
+	found, err := cfg.db.WithContext(r.Context()).RevokeAPIKey(userID, keyID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke API key", err)
+		return
+	}
+	if !found {
+		respondWithError(w, http.StatusNotFound, "Couldn't find API key", nil)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
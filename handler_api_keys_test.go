@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/client"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func TestAPIKeyRefused(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := context.Background()
+	_, session := ts.signup(t, "ivan@example.com")
+
+	// createKey stores a key the way handlerAPIKeysCreate does, but with
+	// any expiry.
+	createKey := func(t *testing.T, expiresAt *time.Time) (string, database.APIKey) {
+		t.Helper()
+		key, id, err := auth.MakeAPIKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored, err := ts.cfg.db.CreateAPIKey(database.CreateAPIKeyParams{
+			UserID:    session.User.ID,
+			Name:      "test",
+			Prefix:    id,
+			KeyHash:   auth.HashAPIKey(key),
+			Scopes:    []string{auth.ScopeVideosRead},
+			ExpiresAt: expiresAt,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key, stored
+	}
+
+	future := time.Now().Add(time.Hour)
+	valid, _ := createKey(t, &future)
+	_, err := ts.client(client.WithAPIKey(valid)).ListVideos(ctx)
+	if err != nil {
+		t.Fatalf("Valid key was refused: %v", err)
+	}
+
+	past := time.Now().Add(-time.Minute)
+	expired, _ := createKey(t, &past)
+	revoked, revokedKey := createKey(t, nil)
+	ok, err := ts.cfg.db.RevokeAPIKey(session.User.ID, revokedKey.ID)
+	if err != nil || !ok {
+		t.Fatalf("Couldn't revoke key: %v", err)
+	}
+	// The right id with another secret must not match the stored hash.
+	id, _ := auth.ParseAPIKeyID(valid)
+	otherSecret := "tubely_" + id + "_" + strings.Repeat("0", 64)
+
+	for name, key := range map[string]string{
+		"bad hash":  otherSecret,
+		"unknown":   "tubely_" + strings.ReplaceAll(uuid.NewString(), "-", "") + "_secret",
+		"malformed": "not a key",
+		"expired":   expired,
+		"revoked":   revoked,
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := ts.client(client.WithAPIKey(key)).ListVideos(ctx)
+			wantProblem(t, err, http.StatusUnauthorized)
+		})
+	}
+}
+
+// TestAPIKeysRevokedWithPassword checks that changing or resetting the
+// password takes away the API keys made with the old one.
+func TestAPIKeysRevokedWithPassword(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := context.Background()
+	anon := ts.client()
+
+	createKey := func(t *testing.T, c *client.Client) *client.Client {
+		t.Helper()
+		created, err := c.CreateAPIKey(ctx, client.CreateAPIKeyRequest{Name: "test", Scopes: []client.Scope{client.ScopeVideosRead}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ts.client(client.WithAPIKey(created.Key))
+	}
+
+	judy, _ := ts.signup(t, "judy@example.com")
+	judyKey := createKey(t, judy)
+	other, _ := ts.signup(t, "ken@example.com")
+	otherKey := createKey(t, other)
+
+	err := judy.UpdatePassword(ctx, client.UpdatePasswordRequest{CurrentPassword: testPassword, NewPassword: testPassword + " changed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = judyKey.ListVideos(ctx)
+	wantProblem(t, err, http.StatusUnauthorized)
+
+	login, err := anon.Login(ctx, client.LoginRequest{Email: "judy@example.com", Password: testPassword + " changed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	judyKey = createKey(t, ts.client(client.WithToken(login.Token)))
+	err = anon.RequestPasswordReset(ctx, client.PasswordResetRequest{Email: "judy@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = anon.ConfirmPasswordReset(ctx, client.PasswordResetConfirmRequest{Token: ts.mailedToken(t, "judy@example.com"), Password: testPassword + " reset"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = judyKey.ListVideos(ctx)
+	wantProblem(t, err, http.StatusUnauthorized)
+
+	_, err = otherKey.ListVideos(ctx)
+	if err != nil {
+		t.Errorf("Another user's key was revoked too: %v", err)
+	}
+}
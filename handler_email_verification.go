@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// handlerEmailVerificationRequest mails the logged in user a new
+// verification link.
+func (cfg *apiConfig) handlerEmailVerificationRequest(w http.ResponseWriter, r *http.Request) {
+	userID := principalFromContext(r.Context()).UserID
+
+	user, err := cfg.db.WithContext(r.Context()).GetUser(userID)
+	if err != nil || user == nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+	if user.EmailVerifiedAt != nil {
+		respondWithError(w, http.StatusConflict, "Email is already verified", nil)
+		return
+	}
+
+	err = cfg.sendVerificationEmail(r.Context(), *user)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create verification token", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (cfg *apiConfig) handlerEmailVerificationConfirm(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Token string `json:"token"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, codeMalformedBody, "Couldn't decode parameters", err)
+		return
+	}
+
+	token, err := cfg.db.WithContext(r.Context()).ConsumeUserToken(auth.HashToken(params.Token), database.TokenPurposeEmailVerification)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check token", err)
+		return
+	}
+	if token.TokenHash == "" {
+		respondWithErrorCode(w, http.StatusBadRequest, codeInvalidToken, "Invalid or expired token", nil)
+		return
+	}
+
+	ok, err := cfg.db.WithContext(r.Context()).MarkEmailVerified(token.UserID, token.Email)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't verify email", err)
+		return
+	}
+	if !ok {
+		respondWithErrorCode(w, http.StatusBadRequest, codeInvalidToken, "Email address has changed since the token was sent", nil)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// readinessTimeout bounds all readiness checks together, so a hung
+// dependency makes the probe fail instead of time out.
+const readinessTimeout = 5 * time.Second
+
+type healthCheck struct {
+	Status     string  `json:"status"`
+	Error      string  `json:"error,omitempty"`
+	Version    string  `json:"version,omitempty"`
+	DurationMS float64 `json:"duration_ms"`
+}
+
+// handlerHealthz reports that the process is up and serving requests. It
+// checks nothing else, so a failing dependency doesn't get the server
+// restarted.
+func (cfg *apiConfig) handlerHealthz(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handlerReadyz reports whether everything needed to serve uploads works,
+// with the outcome of each check. It answers 503 if any of them failed.
+func (cfg *apiConfig) handlerReadyz(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Status string                 `json:"status"`
+		Checks map[string]healthCheck `json:"checks"`
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	checks := map[string]func(context.Context) (string, error){
+		"database": func(ctx context.Context) (string, error) {
+			return "", cfg.db.WithContext(ctx).Ping(ctx)
+		},
+		"assets": func(ctx context.Context) (string, error) {
+			return "", checkWritable(cfg.assetsRoot)
+		},
+		"storage": func(ctx context.Context) (string, error) {
+			return "", cfg.store.Check(ctx)
+		},
+		"ffmpeg": func(ctx context.Context) (string, error) {
+			return binaryVersion(ctx, "ffmpeg")
+		},
+		"ffprobe": func(ctx context.Context) (string, error) {
+			return binaryVersion(ctx, "ffprobe")
+		},
+	}
+
+	resp := response{Status: "ok", Checks: make(map[string]healthCheck, len(checks))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			version, err := check(ctx)
+			result := healthCheck{
+				Status:     "ok",
+				Version:    version,
+				DurationMS: float64(time.Since(start).Microseconds()) / 1000,
+			}
+			if err != nil {
+				result.Status = "error"
+				result.Error = err.Error()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			resp.Checks[name] = result
+			if err != nil {
+				resp.Status = "unavailable"
+			}
+		}()
+	}
+	wg.Wait()
+
+	status := http.StatusOK
+	if resp.Status != "ok" {
+		status = http.StatusServiceUnavailable
+		requestLogger(r.Context()).Warn("Readiness check failed", "checks", resp.Checks)
+	}
+	respondWithJSON(w, status, resp)
+}
+
+// checkWritable makes sure files can be created in dir.
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".readyz-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// binaryVersion runs name -version and returns the version it reports,
+// e.g. "6.1.1-3ubuntu5" from "ffmpeg version 6.1.1-3ubuntu5 Copyright ...".
+func binaryVersion(ctx context.Context, name string) (string, error) {
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, "-version")
+	cmd.Stdout = &out
+	err := cmd.Run()
+	if err != nil {
+		return "", err
+	}
+
+	line, _, _ := bufio.NewReader(&out).ReadLine()
+	fields := strings.Fields(string(line))
+	if len(fields) >= 3 && fields[1] == "version" {
+		return fields[2], nil
+	}
+	return strings.TrimSpace(string(line)), nil
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+)
+
+// handlerJWKS publishes the public keys access tokens are signed with, so
+// other services can verify them without sharing a secret.
+func (cfg *apiConfig) handlerJWKS(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Keys []auth.JWK `json:"keys"`
+	}
+
+	// Verifiers refetch the set when they see an unknown key ID, so a short
+	// cache is enough to pick up rotations.
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	respondWithJSON(w, http.StatusOK, response{
+		Keys: cfg.jwtKeys.JWKS(),
+	})
+}
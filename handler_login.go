@@ -7,72 +7,222 @@ import (
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
 )
 
+// mfaChallengeDuration is how long a user has to enter their code after the
+// password step of a two-factor login.
+const mfaChallengeDuration = 5 * time.Minute
+
+// dummyPasswordHash is checked when no account has the email, so that an
+// unknown email costs the same argon2id hash as a wrong password and response
+// times don't reveal which accounts exist.
+const dummyPasswordHash = "$argon2id$v=19$m=65536,t=1,p=1$47TAQeVEPujR4zzLvVAmEw$vz41GvfuQaVL8+sXCqw9O0v6REjgZPDYKcrY3dJYLF4"
+
 func (cfg *apiConfig) handlerLogin(w http.ResponseWriter, r *http.Request) {
 	type parameters struct {
 		Password string `json:"password"`
 		Email    string `json:"email"`
 	}
-	type response struct {
-		database.User
-		Token        string `json:"token"`
-		RefreshToken string `json:"refresh_token"`
-	}
 
 	decoder := json.NewDecoder(r.Body)
 	params := parameters{}
 	err := decoder.Decode(&params)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters", err)
+		respondWithErrorCode(w, http.StatusBadRequest, codeMalformedBody, "Couldn't decode parameters", err)
+		return
+	}
+
+	// Throttle before hashing: every guess costs an argon2id hash.
+	now := time.Now().UTC()
+	attemptEmail := loginAttemptEmail(params.Email)
+	if !cfg.allowLoginAttempt(w, r, attemptEmail, now) {
+		return
+	}
+
+	user, err := cfg.db.WithContext(r.Context()).GetUserByEmail(attemptEmail)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
 		return
 	}
 
-	user, err := cfg.db.GetUserByEmail(params.Email)
+	passwordHash := user.Password
+	if passwordHash == "" {
+		// No such account, or one that only signs in through single sign-on.
+		passwordHash = dummyPasswordHash
+	}
+	match, err := auth.CheckPasswordHash(params.Password, passwordHash)
+	if err != nil || !match || user.Password == "" {
+		cfg.recordLoginAttempt(r, attemptEmail, now, database.LoginResultFailure)
+		respondWithErrorCode(w, http.StatusUnauthorized, codeInvalidCredentials, "Incorrect email or password", err)
+		return
+	}
+	if user.DisabledAt != nil {
+		// Not a success: that would reset the account's failure count.
+		cfg.recordLoginAttempt(r, attemptEmail, now, database.LoginResultDisabled)
+		respondWithErrorCode(w, http.StatusForbidden, codeAccountDisabled, "Account is disabled", nil)
+		return
+	}
+
+	cfg.completeLogin(w, r, user, attemptEmail, now)
+}
+
+// completeLogin starts a session for a user who passed the first login step,
+// or asks for their second factor if they have two-factor login enabled.
+func (cfg *apiConfig) completeLogin(w http.ResponseWriter, r *http.Request, user database.User, attemptEmail string, now time.Time) {
+	type mfaResponse struct {
+		MFARequired bool   `json:"mfa_required"`
+		MFAToken    string `json:"mfa_token"`
+	}
+
+	if user.TOTPEnabledAt != nil {
+		// The login is only a success once the second factor checks out.
+		challenge, err := cfg.issueUserToken(r.Context(), user, database.TokenPurposeMFAChallenge, mfaChallengeDuration)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't create MFA challenge", err)
+			return
+		}
+		respondWithJSON(w, http.StatusOK, mfaResponse{
+			MFARequired: true,
+			MFAToken:    challenge,
+		})
+		return
+	}
+
+	cfg.recordLoginAttempt(r, attemptEmail, now, database.LoginResultSuccess)
+	cfg.startSession(w, r, user)
+}
+
+// handlerLoginMFA completes a two-factor login with a TOTP code or a
+// recovery code.
+func (cfg *apiConfig) handlerLoginMFA(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		MFAToken string `json:"mfa_token"`
+		Code     string `json:"code"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Incorrect email or password", err)
+		respondWithErrorCode(w, http.StatusBadRequest, codeMalformedBody, "Couldn't decode parameters", err)
 		return
 	}
 
-	match, err := auth.CheckPasswordHash(params.Password, user.Password)
+	challengeHash := auth.HashToken(params.MFAToken)
+	challenge, err := cfg.db.WithContext(r.Context()).GetUserToken(challengeHash, database.TokenPurposeMFAChallenge)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Incorrect email or password", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check MFA challenge", err)
 		return
 	}
-	if !match {
-		respondWithError(w, http.StatusUnauthorized, "Incorrect email or password", nil)
+	if challenge.TokenHash == "" {
+		respondWithErrorCode(w, http.StatusUnauthorized, codeInvalidToken, "Invalid or expired MFA challenge, log in again", nil)
 		return
 	}
 
-	accessToken, err := auth.MakeJWT(
-		user.ID,
-		cfg.jwtSecret,
-		time.Hour*24*30,
-	)
+	// Wrong codes count as failed logins, so guessing codes is throttled like
+	// guessing passwords.
+	now := time.Now().UTC()
+	if !cfg.allowLoginAttempt(w, r, challenge.Email, now) {
+		return
+	}
+
+	user, err := cfg.db.WithContext(r.Context()).GetUser(challenge.UserID)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't create access JWT", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+	if user == nil || user.DisabledAt != nil {
+		respondWithErrorCode(w, http.StatusForbidden, codeAccountDisabled, "Account is disabled", nil)
 		return
 	}
 
+	// The challenge and the code are spent together: a code can't be used
+	// up by a request whose challenge was already taken, and a wrong code
+	// leaves the challenge for another try.
+	factor, ok := secondFactor(*user, params.Code, now)
+	if ok {
+		var consumed database.UserToken
+		consumed, ok, err = cfg.db.WithContext(r.Context()).CompleteMFAChallenge(challengeHash, factor)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't check code", err)
+			return
+		}
+		if consumed.TokenHash == "" {
+			respondWithErrorCode(w, http.StatusUnauthorized, codeInvalidToken, "Invalid or expired MFA challenge, log in again", nil)
+			return
+		}
+	}
+	if !ok {
+		cfg.recordLoginAttempt(r, challenge.Email, now, database.LoginResultFailure)
+		respondWithErrorCode(w, http.StatusUnauthorized, codeInvalidCredentials, "Incorrect code", nil)
+		return
+	}
+
+	cfg.recordLoginAttempt(r, challenge.Email, now, database.LoginResultSuccess)
+	cfg.startSession(w, r, *user)
+}
+
+// allowLoginAttempt responds with 429 and returns false if the account or
+// client address has failed to log in too often.
+func (cfg *apiConfig) allowLoginAttempt(w http.ResponseWriter, r *http.Request, email string, now time.Time) bool {
+	retryAfter, err := cfg.loginRetryAfter(r.Context(), email, clientIP(r), now)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check login attempts", err)
+		return false
+	}
+	if retryAfter > 0 {
+		cfg.recordLoginAttempt(r, email, now, database.LoginResultBlocked)
+		respondTooManyRequests(w, retryAfter, "Too many failed login attempts, try again later")
+		return false
+	}
+	return true
+}
+
+// startSession issues an access JWT and a refresh token starting a new
+// session for user.
+func (cfg *apiConfig) startSession(w http.ResponseWriter, r *http.Request, user database.User) {
+	type response struct {
+		database.User
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+		SessionID    string `json:"session_id"`
+	}
+
 	refreshToken, err := auth.MakeRefreshToken()
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't create refresh token", err)
 		return
 	}
 
-	_, err = cfg.db.CreateRefreshToken(database.CreateRefreshTokenParams{
+	session, err := cfg.db.WithContext(r.Context()).CreateRefreshToken(database.CreateRefreshTokenParams{
 		UserID:    user.ID,
 		Token:     refreshToken,
-		ExpiresAt: time.Now().UTC().Add(time.Hour * 24 * 60),
+		FamilyID:  uuid.NewString(),
+		ExpiresAt: time.Now().UTC().Add(refreshTokenDuration),
+		UserAgent: r.UserAgent(),
+		IP:        clientIP(r),
 	})
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't save refresh token", err)
 		return
 	}
 
+	accessToken, err := auth.MakeJWT(
+		user.ID,
+		session.FamilyID,
+		cfg.jwtKeys,
+		cfg.accessTokenTTL,
+	)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create access JWT", err)
+		return
+	}
+
 	respondWithJSON(w, http.StatusOK, response{
 		User:         user,
 		Token:        accessToken,
 		RefreshToken: refreshToken,
+		SessionID:    session.FamilyID,
 	})
 }
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/oidc"
+	"github.com/google/uuid"
+)
+
+const (
+	// oidcLoginDuration is how long a user has to log in at the identity
+	// provider.
+	oidcLoginDuration = 10 * time.Minute
+	// oidcLoginCodeDuration is how long the web app has to trade the code
+	// from the callback redirect for a session.
+	oidcLoginCodeDuration = time.Minute
+	oidcStateCookie       = "tubely_oidc_state"
+)
+
+// handlerOIDCLogin sends the browser to the identity provider. The state is
+// kept in a cookie as well as the database so a callback only completes a
+// login started by the same browser.
+func (cfg *apiConfig) handlerOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if cfg.oidc == nil {
+		respondWithError(w, http.StatusNotFound, "Single sign-on isn't configured", nil)
+		return
+	}
+
+	var values [3]string
+	for i := range values {
+		value, err := oidc.RandomString()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't start login", err)
+			return
+		}
+		values[i] = value
+	}
+	state, nonce, verifier := values[0], values[1], values[2]
+
+	err := cfg.db.WithContext(r.Context()).CreateOIDCLogin(database.OIDCLogin{
+		StateHash:    auth.HashToken(state),
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+		ExpiresAt:    time.Now().UTC().Add(oidcLoginDuration),
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save login", err)
+		return
+	}
+
+	authURL, err := cfg.oidc.AuthCodeURL(r.Context(), state, nonce, oidc.PKCEChallenge(verifier))
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "Couldn't reach the identity provider", err)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/api/oidc",
+		MaxAge:   int(oidcLoginDuration.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// handlerOIDCCallback finishes the login at the identity provider, finds or
+// creates the user for the identity and hands the web app a short-lived code
+// to trade for a session at POST /api/login/oidc.
+func (cfg *apiConfig) handlerOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if cfg.oidc == nil {
+		respondWithError(w, http.StatusNotFound, "Single sign-on isn't configured", nil)
+		return
+	}
+
+	query := r.URL.Query()
+	if providerErr := query.Get("error"); providerErr != "" {
+		respondWithError(w, http.StatusUnauthorized, "The identity provider refused the login", errors.New(providerErr))
+		return
+	}
+
+	state := query.Get("state")
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		respondWithError(w, http.StatusBadRequest, "Invalid login state, start the login again", err)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:   oidcStateCookie,
+		Path:   "/api/oidc",
+		MaxAge: -1,
+	})
+
+	login, err := cfg.db.WithContext(r.Context()).ConsumeOIDCLogin(auth.HashToken(state))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get login", err)
+		return
+	}
+	if login.StateHash == "" {
+		respondWithErrorCode(w, http.StatusBadRequest, codeInvalidToken, "Invalid or expired login, start the login again", nil)
+		return
+	}
+
+	rawIDToken, err := cfg.oidc.Exchange(r.Context(), query.Get("code"), login.CodeVerifier)
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "Couldn't complete login with the identity provider", err)
+		return
+	}
+	claims, err := cfg.oidc.VerifyIDToken(r.Context(), rawIDToken, login.Nonce)
+	if errors.Is(err, oidc.ErrInvalidIDToken) {
+		respondWithError(w, http.StatusUnauthorized, "The identity provider's ID token is invalid", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "Couldn't verify the identity provider's ID token", err)
+		return
+	}
+
+	user, ok := cfg.oidcUser(r.Context(), w, claims)
+	if !ok {
+		return
+	}
+	if user.DisabledAt != nil {
+		respondWithErrorCode(w, http.StatusForbidden, codeAccountDisabled, "Account is disabled", nil)
+		return
+	}
+
+	code, err := cfg.issueUserToken(r.Context(), user, database.TokenPurposeOIDCLogin, oidcLoginCodeDuration)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create login code", err)
+		return
+	}
+	http.Redirect(w, r, cfg.appLink("login_code", code), http.StatusFound)
+}
+
+// oidcUser returns the user an identity is linked to. An identity seen for
+// the first time is linked to the user with the same email, or to a new
+// user, but only if both sides have verified the address: otherwise whoever
+// registered an address first could take over the other side's account.
+func (cfg *apiConfig) oidcUser(ctx context.Context, w http.ResponseWriter, claims oidc.Claims) (database.User, bool) {
+	issuer := cfg.oidc.Issuer()
+	identity, err := cfg.db.WithContext(ctx).GetUserIdentity(issuer, claims.Subject)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get identity", err)
+		return database.User{}, false
+	}
+	if identity.Subject != "" {
+		user, err := cfg.db.WithContext(ctx).GetUser(identity.UserID)
+		if err != nil || user == nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+			return database.User{}, false
+		}
+		return *user, true
+	}
+
+	if !claims.EmailVerified {
+		respondWithError(w, http.StatusForbidden, "The identity provider hasn't verified your email address", nil)
+		return database.User{}, false
+	}
+	email, err := auth.NormalizeEmail(claims.Email)
+	if err != nil {
+		respondWithError(w, http.StatusForbidden, "The identity provider didn't share a valid email address", err)
+		return database.User{}, false
+	}
+	identity = database.UserIdentity{
+		Issuer:  issuer,
+		Subject: claims.Subject,
+		Email:   email,
+	}
+
+	user, err := cfg.db.WithContext(ctx).GetUserByEmail(email)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return database.User{}, false
+	}
+	if user.ID != uuid.Nil {
+		if user.EmailVerifiedAt == nil {
+			respondWithErrorCode(w, http.StatusConflict, codeEmailTaken, "An account with this email already exists, verify its email address to log in with single sign-on", nil)
+			return database.User{}, false
+		}
+		identity.UserID = user.ID
+		err = cfg.db.WithContext(ctx).CreateUserIdentity(identity)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't link identity", err)
+			return database.User{}, false
+		}
+		cfg.audit(&user.ID, "user.identity_link", auditTargetUser, user.ID.String(), fmt.Sprintf("issuer=%s subject=%s", issuer, claims.Subject))
+		return user, true
+	}
+
+	created, err := cfg.db.WithContext(ctx).CreateOIDCUser(identity)
+	if errors.Is(err, database.ErrEmailTaken) {
+		respondWithErrorCode(w, http.StatusConflict, codeEmailTaken, "An account with this email already exists", err)
+		return database.User{}, false
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create user", err)
+		return database.User{}, false
+	}
+	cfg.audit(&created.ID, "user.create_oidc", auditTargetUser, created.ID.String(), fmt.Sprintf("issuer=%s subject=%s", issuer, claims.Subject))
+	return *created, true
+}
+
+// handlerLoginOIDC trades the code from the callback redirect for a session,
+// after the second factor if the user has one.
+func (cfg *apiConfig) handlerLoginOIDC(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Code string `json:"code"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, codeMalformedBody, "Couldn't decode parameters", err)
+		return
+	}
+
+	token, err := cfg.db.WithContext(r.Context()).ConsumeUserToken(auth.HashToken(params.Code), database.TokenPurposeOIDCLogin)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't use login code", err)
+		return
+	}
+	if token.TokenHash == "" {
+		respondWithErrorCode(w, http.StatusUnauthorized, codeInvalidToken, "Invalid or expired login code, log in again", nil)
+		return
+	}
+
+	user, err := cfg.db.WithContext(r.Context()).GetUser(token.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+	if user == nil || user.DisabledAt != nil {
+		respondWithErrorCode(w, http.StatusForbidden, codeAccountDisabled, "Account is disabled", nil)
+		return
+	}
+
+	cfg.completeLogin(w, r, *user, token.Email, time.Now().UTC())
+}
+
+func (cfg *apiConfig) handlerUserIdentitiesList(w http.ResponseWriter, r *http.Request) {
+	userID := principalFromContext(r.Context()).UserID
+	identities, err := cfg.db.WithContext(r.Context()).GetUserIdentities(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get identities", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, identities)
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	_ "embed"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// openAPISpec describes the API. The client package is generated from it, so
+// the two can't drift apart; handlers still can, so change it with them.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+var openAPIETag = fmt.Sprintf(`"%x"`, sha256.Sum256(openAPISpec))
+
+func (cfg *apiConfig) handlerOpenAPI(w http.ResponseWriter, r *http.Request) {
+	// The document only changes with a deploy.
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("ETag", openAPIETag)
+	http.ServeContent(w, r, "openapi.json", time.Time{}, bytes.NewReader(openAPISpec))
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// handlerPasswordResetRequest mails a reset link if the email belongs to an
+// account. The response is the same either way so it can't be used to find
+// out who has an account.
+func (cfg *apiConfig) handlerPasswordResetRequest(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Email string `json:"email"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, codeMalformedBody, "Couldn't decode parameters", err)
+		return
+	}
+	email, err := auth.NormalizeEmail(params.Email)
+	if err != nil {
+		respondWithFieldErrors(w, fieldErrors{{Field: "email", Code: "invalid", Message: "Invalid email address"}})
+		return
+	}
+
+	// Every request sends mail, so they are throttled whether or not the
+	// email has an account.
+	now := time.Now().UTC()
+	retryAfter, err := cfg.passwordResetRetryAfter(r.Context(), email, clientIP(r), now)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check password reset requests", err)
+		return
+	}
+	if retryAfter > 0 {
+		respondTooManyRequests(w, retryAfter, "Too many password reset requests, try again later")
+		return
+	}
+	cfg.recordLoginAttempt(r, email, now, database.LoginResultPasswordReset)
+
+	user, err := cfg.db.WithContext(r.Context()).GetUserByEmail(email)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+	if user.Email != "" && user.DisabledAt == nil {
+		err = cfg.sendPasswordResetEmail(r.Context(), user)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't create reset token", err)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handlerPasswordResetConfirm sets a new password, logs the user out
+// everywhere and revokes their API keys.
+func (cfg *apiConfig) handlerPasswordResetConfirm(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, codeMalformedBody, "Couldn't decode parameters", err)
+		return
+	}
+	tokenHash := auth.HashToken(params.Token)
+	pending, err := cfg.db.WithContext(r.Context()).GetUserToken(tokenHash, database.TokenPurposePasswordReset)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check token", err)
+		return
+	}
+	if pending.TokenHash == "" {
+		respondWithErrorCode(w, http.StatusBadRequest, codeInvalidToken, "Invalid or expired token", nil)
+		return
+	}
+	user, err := cfg.db.WithContext(r.Context()).GetUser(pending.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+	if user == nil {
+		respondWithErrorCode(w, http.StatusBadRequest, codeInvalidToken, "Invalid or expired token", nil)
+		return
+	}
+	// Checked before the token is spent so the user can pick another
+	// password with the same link.
+	err = cfg.passwordPolicy.Check(params.Password, user.Email)
+	if err != nil {
+		respondWithFieldErrors(w, fieldErrors{{Field: "password", Code: passwordErrorCode(err), Message: capitalize(err.Error())}})
+		return
+	}
+
+	token, err := cfg.db.WithContext(r.Context()).ConsumeUserToken(tokenHash, database.TokenPurposePasswordReset)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check token", err)
+		return
+	}
+	if token.TokenHash == "" {
+		respondWithErrorCode(w, http.StatusBadRequest, codeInvalidToken, "Invalid or expired token", nil)
+		return
+	}
+
+	hashedPassword, err := auth.HashPassword(params.Password)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't hash password", err)
+		return
+	}
+	err = cfg.db.WithContext(r.Context()).UpdateUserPassword(token.UserID, hashedPassword)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update password", err)
+		return
+	}
+	err = cfg.revokeAllSessions(r.Context(), token.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke sessions", err)
+		return
+	}
+	// Keys made by whoever knew the old password must stop working too.
+	err = cfg.db.WithContext(r.Context()).RevokeAllAPIKeys(token.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke API keys", err)
+		return
+	}
+	// Receiving the reset link proves the user owns the address too.
+	_, err = cfg.db.WithContext(r.Context()).MarkEmailVerified(token.UserID, token.Email)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't verify email", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
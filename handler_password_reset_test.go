@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/client"
+)
+
+func TestPasswordReset(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := context.Background()
+	anon := ts.client()
+	ts.signup(t, "carol@example.com")
+
+	err := anon.RequestPasswordReset(ctx, client.PasswordResetRequest{Email: "carol@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := ts.mailedToken(t, "carol@example.com")
+	ts.mail.mu.Lock()
+	body := ts.mail.sent[len(ts.mail.sent)-1].Body
+	ts.mail.mu.Unlock()
+	if !strings.Contains(body, ts.cfg.publicURL+"/app/?reset_token=") {
+		t.Errorf("Reset mail doesn't link to the public URL %s: %q", ts.cfg.publicURL, body)
+	}
+
+	// The new password is checked against the account's email, and the
+	// link still works after a refused password.
+	err = anon.ConfirmPasswordReset(ctx, client.PasswordResetConfirmRequest{Token: token, Password: "carol's new password"})
+	wantProblem(t, err, http.StatusUnprocessableEntity)
+	var problem *client.Problem
+	errors.As(err, &problem)
+	if len(problem.Errors) != 1 || problem.Errors[0].Code != "contains_email" {
+		t.Errorf("Password containing the email failed with %+v, want a contains_email field error", problem.Errors)
+	}
+	err = anon.ConfirmPasswordReset(ctx, client.PasswordResetConfirmRequest{Token: token, Password: testPassword + " again"})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPasswordResetThrottled(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := context.Background()
+	anon := ts.client()
+	ts.signup(t, "dan@example.com")
+
+	// Unknown emails are throttled the same, so the limit doesn't tell
+	// whether an account exists.
+	for _, email := range []string{"dan@example.com", "nobody@example.com"} {
+		for range accountResetPolicy.freeFailures {
+			err := anon.RequestPasswordReset(ctx, client.PasswordResetRequest{Email: email})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		req := mustRequest(t, http.MethodPost, ts.URL+"/api/password_reset", []byte(`{"email":"`+email+`"}`))
+		req.Header.Set("Content-Type", "application/json")
+		resp, body := ts.do(t, req)
+		if resp.StatusCode != http.StatusTooManyRequests {
+			t.Fatalf("Reset request %d for %s answered %d, want %d: %s", accountResetPolicy.freeFailures+1, email, resp.StatusCode, http.StatusTooManyRequests, body)
+		}
+		seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+		if err != nil || seconds < 59 || seconds > 60 {
+			t.Errorf("Retry-After is %q, want 60 seconds", resp.Header.Get("Retry-After"))
+		}
+	}
+
+	// Only the allowed requests sent mail.
+	ts.cfg.background.Wait()
+	ts.mail.mu.Lock()
+	defer ts.mail.mu.Unlock()
+	resets := 0
+	for _, msg := range ts.mail.sent {
+		if msg.To == "dan@example.com" && strings.Contains(msg.Body, "reset_token=") {
+			resets++
+		}
+	}
+	if resets != accountResetPolicy.freeFailures {
+		t.Errorf("Dan was mailed %d reset links, want %d", resets, accountResetPolicy.freeFailures)
+	}
+}
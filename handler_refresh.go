@@ -1,52 +1,145 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"log/slog"
 	"net/http"
 	"time"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 )
 
+const refreshTokenDuration = time.Hour * 24 * 60
+
 func (cfg *apiConfig) handlerRefresh(w http.ResponseWriter, r *http.Request) {
 	type response struct {
-		Token string `json:"token"`
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+		SessionID    string `json:"session_id"`
 	}
 
 	refreshToken, err := auth.GetBearerToken(r.Header)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Couldn't find token", err)
+		respondUnauthorized(w, codeUnauthorized, "Couldn't find token", err)
+		return
+	}
+
+	oldToken, err := cfg.db.WithContext(r.Context()).GetRefreshToken(refreshToken)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get refresh token", err)
+		return
+	}
+	if oldToken.Token == "" {
+		respondWithErrorCode(w, http.StatusUnauthorized, codeInvalidToken, "Invalid refresh token", nil)
+		return
+	}
+	if oldToken.RevokedAt != nil {
+		if oldToken.ReplacedBy != nil {
+			cfg.revokeReusedTokenFamily(r.Context(), oldToken)
+		}
+		respondWithErrorCode(w, http.StatusUnauthorized, codeInvalidToken, "Refresh token has been revoked", nil)
+		return
+	}
+	if time.Now().UTC().After(oldToken.ExpiresAt) {
+		respondWithErrorCode(w, http.StatusUnauthorized, codeInvalidToken, "Refresh token has expired", nil)
+		return
+	}
+
+	user, err := cfg.db.WithContext(r.Context()).GetUser(oldToken.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+	if user == nil || user.DisabledAt != nil {
+		respondWithErrorCode(w, http.StatusForbidden, codeAccountDisabled, "Account is disabled", nil)
+		return
+	}
+
+	newRefreshToken, err := auth.MakeRefreshToken()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create refresh token", err)
 		return
 	}
 
-	user, err := cfg.db.GetUserByRefreshToken(refreshToken)
+	_, err = cfg.db.WithContext(r.Context()).RotateRefreshToken(oldToken.Token, database.CreateRefreshTokenParams{
+		Token:     newRefreshToken,
+		UserID:    oldToken.UserID,
+		FamilyID:  oldToken.FamilyID,
+		ExpiresAt: time.Now().UTC().Add(refreshTokenDuration),
+		UserAgent: r.UserAgent(),
+		IP:        clientIP(r),
+	})
+	if errors.Is(err, database.ErrRefreshTokenReused) {
+		// Another request rotated this token first.
+		cfg.revokeReusedTokenFamily(r.Context(), oldToken)
+		respondWithErrorCode(w, http.StatusUnauthorized, codeInvalidToken, "Refresh token has been revoked", err)
+		return
+	}
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't get user for refresh token", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't rotate refresh token", err)
 		return
 	}
 
 	accessToken, err := auth.MakeJWT(
-		user.ID,
-		cfg.jwtSecret,
-		time.Hour,
+		oldToken.UserID,
+		oldToken.FamilyID,
+		cfg.jwtKeys,
+		cfg.accessTokenTTL,
 	)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate token", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create access token", err)
 		return
 	}
 
 	respondWithJSON(w, http.StatusOK, response{
-		Token: accessToken,
+		Token:        accessToken,
+		RefreshToken: newRefreshToken,
+		SessionID:    oldToken.FamilyID,
 	})
 }
 
+// revokeReusedTokenFamily handles a refresh token that was presented after it
+// had been rotated. Either it was stolen or the legitimate client is replaying
+// it; we can't tell which, so every token of that login is revoked and the
+// user has to log in again.
+func (cfg *apiConfig) revokeReusedTokenFamily(ctx context.Context, token database.RefreshToken) {
+	logger := requestLogger(ctx).With(slog.String("user_id", token.UserID.String()), slog.String("session_id", token.FamilyID))
+	logger.Warn("Refresh token reuse detected, revoking token family")
+	err := cfg.db.WithContext(ctx).RevokeRefreshTokenFamily(token.FamilyID)
+	if err != nil {
+		logger.Error("Couldn't revoke token family", slog.Any("err", err))
+	}
+	err = cfg.revokeSessionAccessTokens(token.FamilyID)
+	if err != nil {
+		logger.Error("Couldn't revoke access tokens of token family", slog.Any("err", err))
+	}
+}
+
 func (cfg *apiConfig) handlerRevoke(w http.ResponseWriter, r *http.Request) {
 	refreshToken, err := auth.GetBearerToken(r.Header)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Couldn't find token", err)
+		respondUnauthorized(w, codeUnauthorized, "Couldn't find token", err)
 		return
 	}
 
-	err = cfg.db.RevokeRefreshToken(refreshToken)
+	token, err := cfg.db.WithContext(r.Context()).GetRefreshToken(refreshToken)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get refresh token", err)
+		return
+	}
+	if token.Token == "" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	err = cfg.db.WithContext(r.Context()).RevokeRefreshTokenFamily(token.FamilyID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke session", err)
+		return
+	}
+	err = cfg.revokeSessionAccessTokens(token.FamilyID)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke session", err)
 		return
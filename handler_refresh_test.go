@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/client"
+)
+
+// TestRefreshTokenReuse replays a rotated refresh token, as a thief would,
+// and checks that the whole session ends but the user's other sessions don't.
+func TestRefreshTokenReuse(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := context.Background()
+	anon := ts.client()
+	_, session := ts.signup(t, "heidi@example.com")
+	other, err := anon.Login(ctx, client.LoginRequest{Email: "heidi@example.com", Password: testPassword})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, err := anon.RefreshSession(ctx, session.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = anon.RefreshSession(ctx, session.RefreshToken)
+	wantProblem(t, err, http.StatusUnauthorized)
+
+	// The replacement is revoked along with the replayed token.
+	_, err = anon.RefreshSession(ctx, rotated.RefreshToken)
+	wantProblem(t, err, http.StatusUnauthorized)
+	for _, token := range []string{session.Token, rotated.Token} {
+		_, err = ts.client(client.WithToken(token)).GetCurrentUser(ctx)
+		wantProblem(t, err, http.StatusUnauthorized)
+	}
+
+	_, err = ts.client(client.WithToken(other.Token)).GetCurrentUser(ctx)
+	if err != nil {
+		t.Errorf("Another session was ended too: %v", err)
+	}
+	_, err = anon.RefreshSession(ctx, other.RefreshToken)
+	if err != nil {
+		t.Errorf("Another session's refresh token was revoked too: %v", err)
+	}
+}
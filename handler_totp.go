@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const (
+	totpIssuer        = "Tubely"
+	recoveryCodeCount = 10
+)
+
+// handlerTOTPEnroll starts two-factor enrollment with a new secret. The
+// client shows the otpauth URI as a QR code for the user's authenticator app.
+func (cfg *apiConfig) handlerTOTPEnroll(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+	}
+
+	user, ok := cfg.currentUser(w, r)
+	if !ok {
+		return
+	}
+	if user.TOTPEnabledAt != nil {
+		respondWithError(w, http.StatusConflict, "Two-factor authentication is already enabled", nil)
+		return
+	}
+
+	secret, err := auth.MakeTOTPSecret()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create TOTP secret", err)
+		return
+	}
+	err = cfg.db.WithContext(r.Context()).SetPendingTOTPSecret(user.ID, secret)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save TOTP secret", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		Secret: secret,
+		URI:    auth.TOTPURI(totpIssuer, user.Email, secret),
+	})
+}
+
+// handlerTOTPConfirm turns on two-factor login once the user proves their
+// app produces valid codes, and hands out the recovery codes.
+func (cfg *apiConfig) handlerTOTPConfirm(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Code string `json:"code"`
+	}
+	type response struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+
+	user, ok := cfg.currentUser(w, r)
+	if !ok {
+		return
+	}
+	if user.TOTPEnabledAt != nil {
+		respondWithError(w, http.StatusConflict, "Two-factor authentication is already enabled", nil)
+		return
+	}
+	if user.TOTPSecret == nil {
+		respondWithError(w, http.StatusConflict, "Start enrollment first", nil)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, codeMalformedBody, "Couldn't decode parameters", err)
+		return
+	}
+
+	step, ok := auth.ValidateTOTP(*user.TOTPSecret, params.Code, time.Now(), 0)
+	if !ok {
+		respondWithErrorCode(w, http.StatusBadRequest, codeInvalidCredentials, "Incorrect code", nil)
+		return
+	}
+
+	codes, hashes, err := makeRecoveryCodes()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create recovery codes", err)
+		return
+	}
+	err = cfg.db.WithContext(r.Context()).ConfirmTOTP(user.ID, step, hashes)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't enable two-factor authentication", err)
+		return
+	}
+
+	// Recovery codes are only ever shown in this response.
+	respondWithJSON(w, http.StatusOK, response{
+		RecoveryCodes: codes,
+	})
+}
+
+// handlerTOTPDisable turns off two-factor login. Once it is enabled that
+// takes a second factor as well as the password, so a stolen password and
+// session aren't enough.
+func (cfg *apiConfig) handlerTOTPDisable(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+
+	user, ok := cfg.currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, codeMalformedBody, "Couldn't decode parameters", err)
+		return
+	}
+	if !cfg.checkCurrentPassword(w, user, params.Password) {
+		return
+	}
+	if user.TOTPEnabledAt != nil {
+		// Wrong codes count as failed logins, as they do when logging in.
+		now := time.Now().UTC()
+		attemptEmail := loginAttemptEmail(user.Email)
+		if !cfg.allowLoginAttempt(w, r, attemptEmail, now) {
+			return
+		}
+		factor, ok := secondFactor(user, params.Code, now)
+		if ok {
+			ok, err = cfg.db.WithContext(r.Context()).UseSecondFactor(user.ID, factor)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, "Couldn't check code", err)
+				return
+			}
+		}
+		if !ok {
+			cfg.recordLoginAttempt(r, attemptEmail, now, database.LoginResultFailure)
+			respondWithErrorCode(w, http.StatusForbidden, codeInvalidCredentials, "Incorrect code", nil)
+			return
+		}
+	}
+
+	err = cfg.db.WithContext(r.Context()).DisableTOTP(user.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't disable two-factor authentication", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerRecoveryCodesRegenerate replaces the user's recovery codes, e.g.
+// after they have used most of them.
+func (cfg *apiConfig) handlerRecoveryCodesRegenerate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Password string `json:"password"`
+	}
+	type response struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+
+	user, ok := cfg.currentUser(w, r)
+	if !ok {
+		return
+	}
+	if user.TOTPEnabledAt == nil {
+		respondWithError(w, http.StatusConflict, "Two-factor authentication isn't enabled", nil)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, codeMalformedBody, "Couldn't decode parameters", err)
+		return
+	}
+	if !cfg.checkCurrentPassword(w, user, params.Password) {
+		return
+	}
+
+	codes, hashes, err := makeRecoveryCodes()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create recovery codes", err)
+		return
+	}
+	err = cfg.db.WithContext(r.Context()).ReplaceRecoveryCodes(user.ID, hashes)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save recovery codes", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		RecoveryCodes: codes,
+	})
+}
+
+// secondFactor is what code would spend: the time step of a current TOTP
+// code, or else a recovery code. Whether it was used before is up to the
+// database. It reports false if the user has no second factor.
+func secondFactor(user database.User, code string, now time.Time) (database.SecondFactor, bool) {
+	if user.TOTPSecret == nil {
+		return database.SecondFactor{}, false
+	}
+
+	step, ok := auth.ValidateTOTP(*user.TOTPSecret, code, now, user.TOTPLastStep)
+	if ok {
+		return database.SecondFactor{TOTPStep: step}, true
+	}
+	return database.SecondFactor{RecoveryCodeHash: auth.HashToken(auth.NormalizeRecoveryCode(code))}, true
+}
+
+// makeRecoveryCodes returns new recovery codes and the hashes to store.
+func makeRecoveryCodes() ([]string, []string, error) {
+	codes, err := auth.MakeRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		return nil, nil, err
+	}
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = auth.HashToken(code)
+	}
+	return codes, hashes, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/client"
+)
+
+// enableTOTP turns on two-factor login for c with a code of the time step of
+// now, and returns the secret and recovery codes.
+func enableTOTP(t *testing.T, c *client.Client, now time.Time) (string, []string) {
+	t.Helper()
+	ctx := context.Background()
+	enrollment, err := c.EnrollTOTP(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes, err := c.ConfirmTOTP(ctx, client.CodeRequest{Code: testTOTPCode(t, enrollment.Secret, now)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return enrollment.Secret, codes.RecoveryCodes
+}
+
+// mfaChallenge logs in with the password and returns the MFA token.
+func mfaChallenge(t *testing.T, ts *testServer, email string) string {
+	t.Helper()
+	login, err := ts.client().Login(context.Background(), client.LoginRequest{Email: email, Password: testPassword})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if login.MFAChallenge == nil {
+		t.Fatalf("Login of %s didn't ask for a second factor", email)
+	}
+	return login.MFAToken
+}
+
+func TestTOTPCodesSingleUse(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := context.Background()
+	anon := ts.client()
+	c, _ := ts.signup(t, "erin@example.com")
+	now := time.Now()
+	secret, recoveryCodes := enableTOTP(t, c, now)
+
+	// The code confirming enrollment is spent; the next step's is good once.
+	_, err := anon.LoginMFA(ctx, client.LoginMFARequest{MFAToken: mfaChallenge(t, ts, "erin@example.com"), Code: testTOTPCode(t, secret, now)})
+	wantProblem(t, err, http.StatusUnauthorized)
+	next := testTOTPCode(t, secret, now.Add(30*time.Second))
+	_, err = anon.LoginMFA(ctx, client.LoginMFARequest{MFAToken: mfaChallenge(t, ts, "erin@example.com"), Code: next})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = anon.LoginMFA(ctx, client.LoginMFARequest{MFAToken: mfaChallenge(t, ts, "erin@example.com"), Code: next})
+	wantProblem(t, err, http.StatusUnauthorized)
+
+	_, err = anon.LoginMFA(ctx, client.LoginMFARequest{MFAToken: mfaChallenge(t, ts, "erin@example.com"), Code: recoveryCodes[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = anon.LoginMFA(ctx, client.LoginMFARequest{MFAToken: mfaChallenge(t, ts, "erin@example.com"), Code: recoveryCodes[0]})
+	wantProblem(t, err, http.StatusUnauthorized)
+}
+
+func TestLoginMFAChallengeSingleUse(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := context.Background()
+	anon := ts.client()
+	c, _ := ts.signup(t, "frank@example.com")
+	_, recoveryCodes := enableTOTP(t, c, time.Now())
+
+	// A wrong code leaves the challenge for another try.
+	challenge := mfaChallenge(t, ts, "frank@example.com")
+	_, err := anon.LoginMFA(ctx, client.LoginMFARequest{MFAToken: challenge, Code: "not a code"})
+	wantProblem(t, err, http.StatusUnauthorized)
+	_, err = anon.LoginMFA(ctx, client.LoginMFARequest{MFAToken: challenge, Code: recoveryCodes[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A spent challenge doesn't use up the code sent with it.
+	_, err = anon.LoginMFA(ctx, client.LoginMFARequest{MFAToken: challenge, Code: recoveryCodes[1]})
+	wantProblem(t, err, http.StatusUnauthorized)
+	_, err = anon.LoginMFA(ctx, client.LoginMFARequest{MFAToken: mfaChallenge(t, ts, "frank@example.com"), Code: recoveryCodes[1]})
+	if err != nil {
+		t.Fatalf("Recovery code sent with a spent challenge was used up: %v", err)
+	}
+}
+
+func TestTOTPDisableNeedsSecondFactor(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := context.Background()
+	c, _ := ts.signup(t, "grace@example.com")
+	now := time.Now()
+	secret, _ := enableTOTP(t, c, now)
+
+	wrong := "000000"
+	spent := testTOTPCode(t, secret, now)
+	for _, code := range []*string{nil, &wrong, &spent} {
+		err := c.DisableTOTP(ctx, client.DisableTOTPRequest{Password: testPassword, Code: code})
+		wantProblem(t, err, http.StatusForbidden)
+	}
+	user, err := c.GetCurrentUser(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.TOTPEnabledAt == nil {
+		t.Fatal("Two-factor login was turned off without a second factor")
+	}
+
+	next := testTOTPCode(t, secret, now.Add(30*time.Second))
+	err = c.DisableTOTP(ctx, client.DisableTOTPRequest{Password: testPassword, Code: &next})
+	if err != nil {
+		t.Fatal(err)
+	}
+	login, err := ts.client().Login(ctx, client.LoginRequest{Email: "grace@example.com", Password: testPassword})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if login.MFAChallenge != nil {
+		t.Error("Login still asks for a second factor")
+	}
+}
@@ -3,15 +3,17 @@ package main
 import (
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
 
-	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 	"github.com/google/uuid"
 )
 
@@ -19,66 +21,78 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 	videoIDString := r.PathValue("videoID")
 	videoID, err := uuid.Parse(videoIDString)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		respondWithErrorCode(w, http.StatusBadRequest, codeInvalidID, "Invalid ID", err)
 		return
 	}
 
-	token, err := auth.GetBearerToken(r.Header)
+	userID := principalFromContext(r.Context()).UserID
+
+	requestLogger(r.Context()).Info("Uploading thumbnail")
+
+	// Get the video's metadata from the SQLite database. The apiConfig's db has a GetVideo method you can use
+	// If the authenticated user is not the video owner, return a http.StatusUnauthorized response
+	video, err := cfg.db.WithContext(r.Context()).GetVideo(videoID)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't find video", nil)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "Not authorized to update this video", nil)
 		return
 	}
+	cfg.allowLongTransfer(w, r)
 
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	// Thumbnails count against the storage quota too; the one being replaced
+	// is freed.
+	q, err := cfg.userQuota(r.Context(), userID)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get storage quota", err)
 		return
 	}
+	uploadLimit := min(q.Limits.MaxThumbnailBytes, q.remainingBytes()+video.ThumbnailSize)
+	if r.ContentLength > uploadLimit+multipartOverhead {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Thumbnail exceeds your storage quota", nil)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, uploadLimit+multipartOverhead)
 
-	fmt.Println("uploading thumbnail for video", videoID, "by user", userID)
-
-	// TODO: implement the upload here
 	const maxMemory = 10 << 20
-	r.ParseMultipartForm(maxMemory)
+	err = r.ParseMultipartForm(maxMemory)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Thumbnail exceeds your storage quota", err)
+		return
+	}
 
 	// Get the image data from the form
 	// Use r.FormFile to get the file data and file headers. The key the web browser is using is called "thumbnail"
 	// Get the media type from the form file's Content-Type header
 	file, header, err := r.FormFile("thumbnail")
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Unable to parse form file", err)
+		respondWithErrorCode(w, http.StatusBadRequest, codeMalformedBody, "Unable to parse form file", err)
 		return
 	}
 	defer file.Close()
+	if header.Size > uploadLimit {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Thumbnail exceeds your storage quota", nil)
+		return
+	}
 	contentType := header.Header.Get("Content-Type")
 	mediatype, _, err := mime.ParseMediaType(contentType)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Unable to parse media type", err)
+		respondWithError(w, http.StatusUnsupportedMediaType, "Unable to parse media type", err)
 		return
 	}
 	if mediatype != "image/jpeg" && mediatype != "image/png" {
-		respondWithError(w, http.StatusBadRequest, "Only jpeg or png can uploaded as thumbnails", err)
+		respondWithError(w, http.StatusUnsupportedMediaType, "Only jpeg or png can uploaded as thumbnails", err)
 		return
 	}
 	fileExtension := strings.Split(contentType, "/")[1]
 
-	// Get the video's metadata from the SQLite database. The apiConfig's db has a GetVideo method you can use
-	// If the authenticated user is not the video owner, return a http.StatusUnauthorized response
-	video, err := cfg.db.GetVideo(videoID)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't find video", err)
-	}
-	if video.UserID != userID {
-		respondWithError(w, http.StatusUnauthorized, "Not authorized to update this video", nil)
-		return
-	}
-
-	// Update the video metadata so that it has a new thumbnail URL, then update the record in the database by using the cfg.db.UpdateVideo function.
-	// The thumbnail URL should have this format:
-	// http://localhost:<port>/api/thumbnails/{videoID}
-	url := fmt.Sprintf("http://localhost:%v/api/thumbnails/%v", cfg.port, videoID)
-	video.ThumbnailURL = &url
-
 	// Instead of encoding to base64, update the handler to save the bytes to a file at the path /assets/<videoID>.<file_extension>.
 	// 	Use the Content-Type header to determine the file extension.
 	// 	Use the videoID to create a unique file path. filepath.Join and cfg.assetsRoot will be helpful here.
@@ -97,23 +111,40 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 		return
 	}
 	defer thumbnailFile.Close()
-	_, err = io.Copy(thumbnailFile, file)
+	thumbnailSize, err := io.Copy(thumbnailFile, file)
+	cfg.metrics.uploadBytes.WithLabelValues("thumbnail").Add(float64(thumbnailSize))
 	if err != nil {
+		os.Remove(thumbnailPath)
 		respondWithError(w, http.StatusInternalServerError, "Couldn't copy to a thumbnail file", err)
 		return
 	}
 
-	thumbnailUrl := fmt.Sprintf("http://localhost:%v/%v", cfg.port, thumbnailPath)
+	previous := video
+	thumbnailUrl := fmt.Sprintf("%v/assets/%v", cfg.publicURL, thumbnailNameWithExtension)
 	video.ThumbnailURL = &thumbnailUrl
-
-	err = cfg.db.UpdateVideo(video)
+	video.ThumbnailKey = &thumbnailNameWithExtension
+	video.ThumbnailSize = thumbnailSize
+
+	err = cfg.db.WithContext(r.Context()).UpdateVideo(video, q.Limits.MaxStorageBytes)
+	if errors.Is(err, database.ErrQuotaExceeded) {
+		// Concurrent uploads used up the space checked above.
+		os.Remove(thumbnailPath)
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Thumbnail exceeds your storage quota", err)
+		return
+	}
 	if err != nil {
+		os.Remove(thumbnailPath)
 		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
 		return
 	}
 
+	err = cfg.removeThumbnail(previous)
+	if err != nil {
+		requestLogger(r.Context()).Warn("Couldn't remove previous thumbnail of video", slog.Any("err", err))
+	}
+
 	// Respond with updated JSON of the video's metadata. Use the provided respondWithJSON function and pass it the updated database.Video
 	// struct to marshal.
 
-	respondWithJSON(w, http.StatusOK, video)
+	cfg.respondWithVideo(w, r, http.StatusOK, video)
 }
@@ -1,58 +1,69 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"mime"
 	"net/http"
 	"os"
 	"os/exec"
 	"strings"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
 	"github.com/google/uuid"
 )
 
 func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request) {
-	// Set an upload limit of 1 GB (1 << 30 bytes) using http.MaxBytesReader.
-	r.Body = http.MaxBytesReader(w, r.Body, 1<<30)
-
 	// Extract the videoID from the URL path parameters and parse it as a UUID
 	videoIDString := r.PathValue("videoID")
 	videoID, err := uuid.Parse(videoIDString)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		respondWithErrorCode(w, http.StatusBadRequest, codeInvalidID, "Invalid ID", err)
 		return
 	}
 
 	// Authenticate the user to get a userID
-	token, err := auth.GetBearerToken(r.Header)
+	userID := principalFromContext(r.Context()).UserID
+
+	requestLogger(r.Context()).Info("Uploading video")
+
+	// Get the video metadata from the database, if the user is not the video owner, return a http.StatusUnauthorized response
+	video, err := cfg.db.WithContext(r.Context()).GetVideo(videoID)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
 		return
 	}
-
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't find video", nil)
 		return
 	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "Not authorized to upload this video", nil)
+		return
+	}
+	cfg.allowLongTransfer(w, r)
 
-	fmt.Println("uploading video", videoID, "by user", userID)
-
-	// Get the video metadata from the database, if the user is not the video owner, return a http.StatusUnauthorized response
-	video, err := cfg.db.GetVideo(videoID)
+	// Limit the upload to what the user's plan still allows. The file being
+	// replaced no longer counts against the quota.
+	q, err := cfg.userQuota(r.Context(), userID)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't find video", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get storage quota", err)
+		return
 	}
-	if video.UserID != userID {
-		respondWithError(w, http.StatusUnauthorized, "Not authorized to upload this video", nil)
+	uploadLimit := min(q.Limits.MaxVideoBytes, q.remainingBytes()+video.VideoSize)
+	if r.ContentLength > uploadLimit+multipartOverhead {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Video exceeds your storage quota", nil)
 		return
 	}
+	r.Body = http.MaxBytesReader(w, r.Body, uploadLimit+multipartOverhead)
 
 	// Parse the uploaded video file from the form data
 	// Use (http.Request).FormFile with the key "video" to get a multipart.File in memory
@@ -60,22 +71,31 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 	// const maxMemory = 1 << 30
 	// r.ParseMultipartForm(maxMemory)
 	file, header, err := r.FormFile("video")
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Video exceeds your storage quota", err)
+		return
+	}
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Unable to parse form file", err)
+		respondWithErrorCode(w, http.StatusBadRequest, codeMalformedBody, "Unable to parse form file", err)
 		return
 	}
 	defer file.Close()
+	if header.Size > uploadLimit {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Video exceeds your storage quota", nil)
+		return
+	}
 
 	// Validate the uploaded file to ensure it's an MP4 video
 	// Use mime.ParseMediaType and "video/mp4" as the MIME type
 	contentType := header.Header.Get("Content-Type")
 	mediatype, _, err := mime.ParseMediaType(contentType)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Unable to parse media type", err)
+		respondWithError(w, http.StatusUnsupportedMediaType, "Unable to parse media type", err)
 		return
 	}
 	if mediatype != "video/mp4" {
-		respondWithError(w, http.StatusBadRequest, "Only mp4 video can be uploaded", err)
+		respondWithError(w, http.StatusUnsupportedMediaType, "Only mp4 video can be uploaded", err)
 		return
 	}
 	videoExtension := strings.Split(contentType, "/")[1]
@@ -85,74 +105,184 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 	// defer remove the temp file with os.Remove
 	// defer close the temp file (defer is LIFO, so it will close before the remove)
 	// io.Copy the contents over from the wire to the temp file
-	tempFile, err := os.CreateTemp("", "tubely-upload.mp4")
+	tempFile, err := os.CreateTemp("", uploadTempPattern)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Could not create temporary file", err)
 		return
 	}
 	defer os.Remove(tempFile.Name())
 	defer tempFile.Close()
-	_, err = io.Copy(tempFile, file)
+	// Hash the upload while writing it to disk so identical files can share
+	// a single stored object.
+	hasher := sha256.New()
+	uploaded, err := io.Copy(io.MultiWriter(tempFile, hasher), file)
+	cfg.metrics.uploadBytes.WithLabelValues("video").Add(float64(uploaded))
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't copy to a temporary file", err)
 		return
 	}
+	contentHash := hex.EncodeToString(hasher.Sum(nil))
 
-	processedFilePath, err := processVideoForFastStart(tempFile.Name())
+	contentRef, found, err := cfg.db.WithContext(r.Context()).AcquireContentHash(contentHash)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't process video for fast start", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't look up video content", err)
 		return
 	}
-
-	tempFileProcessed, err := os.Open(processedFilePath)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't open processed video file", err)
+	if found && contentRef.Size > uploadLimit {
+		cfg.db.WithContext(r.Context()).ReleaseContentHash(contentHash)
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Video exceeds your storage quota", nil)
 		return
 	}
-	defer os.Remove(tempFileProcessed.Name())
-	defer tempFileProcessed.Close()
-
-	aspectRatio, err := getVideoAspectRatio(tempFileProcessed.Name())
-
-	// Reset the tempFile's file pointer to the beginning with .Seek(0, io.SeekStart) - this will allow us to read the file again from the beginning
-	// _, err = tempFile.Seek(0, io.SeekStart)
-	// if err != nil {
-	// 	respondWithError(w, http.StatusInternalServerError, "Could not reset the tempFile's file pointer to the beginning", err)
-	// 	return
-	// }
-
-	// Put the object into S3 using PutObject. You'll need to provide:
-	// The bucket name
-	// The file key. Use the same <random-32-byte-hex>.ext format as the key. e.g. 1a2b3c4d5e6f7890abcd1234ef567890.mp4
-	// The file contents (body). The temp file is an os.File which implements io.Reader
-	// Content type, which is the MIME type of the file.
-	key := make([]byte, 32)
-	rand.Read(key)
-	s3VideoName := base64.RawURLEncoding.EncodeToString(key)
-	s3VideoNameWithExtension := fmt.Sprintf("%v/%v.%v", aspectRatio, s3VideoName, videoExtension)
-
-	_, err = cfg.s3Client.PutObject(r.Context(), &s3.PutObjectInput{
-		Bucket:      aws.String(cfg.s3Bucket),
-		Key:         aws.String(s3VideoNameWithExtension),
-		Body:        tempFileProcessed,
-		ContentType: aws.String(mediatype),
-	})
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Could not put video to the S3", err)
-		return
+	if !found {
+		defer cfg.metrics.startJob(jobVideoProcessing)()
+
+		// ffmpeg may leave a partial output behind when it fails.
+		processedFilePath := tempFile.Name() + ".processing"
+		defer os.Remove(processedFilePath)
+		stageDone := cfg.metrics.timeStage(stageFastStart)
+		err = processVideoForFastStart(r.Context(), tempFile.Name(), processedFilePath)
+		stageDone(err)
+		if invalidMedia(err) {
+			respondWithErrorCode(w, http.StatusUnprocessableEntity, codeInvalidMedia, "The video file couldn't be processed", err)
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't process video for fast start", err)
+			return
+		}
+
+		tempFileProcessed, err := os.Open(processedFilePath)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't open processed video file", err)
+			return
+		}
+		defer tempFileProcessed.Close()
+
+		processedInfo, err := tempFileProcessed.Stat()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't stat processed video file", err)
+			return
+		}
+		if processedInfo.Size() > uploadLimit {
+			respondWithError(w, http.StatusRequestEntityTooLarge, "Video exceeds your storage quota", nil)
+			return
+		}
+
+		stageDone = cfg.metrics.timeStage(stageAspectRatio)
+		aspectRatio, err := getVideoAspectRatio(r.Context(), tempFileProcessed.Name())
+		stageDone(err)
+		if invalidMedia(err) {
+			respondWithErrorCode(w, http.StatusUnprocessableEntity, codeInvalidMedia, "The video file has no video stream", err)
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't determine video aspect ratio", err)
+			return
+		}
+
+		// Put the object into S3 using PutObject. You'll need to provide:
+		// The bucket name
+		// The file key. Use the same <random-32-byte-hex>.ext format as the key. e.g. 1a2b3c4d5e6f7890abcd1234ef567890.mp4
+		// The file contents (body). The temp file is an os.File which implements io.Reader
+		// Content type, which is the MIME type of the file.
+		key := make([]byte, 32)
+		rand.Read(key)
+		s3VideoName := base64.RawURLEncoding.EncodeToString(key)
+		s3VideoNameWithExtension := fmt.Sprintf("%v/%v.%v", aspectRatio, s3VideoName, videoExtension)
+
+		// Checksums of the processed file let the store reject corrupted
+		// uploads and `tubely verify` detect later bit rot.
+		checksums, err := storage.ComputeChecksums(tempFileProcessed)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't checksum processed video file", err)
+			return
+		}
+		_, err = tempFileProcessed.Seek(0, io.SeekStart)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't rewind processed video file", err)
+			return
+		}
+
+		stageDone = cfg.metrics.timeStage(stageStoragePut)
+		err = cfg.store.Put(r.Context(), s3VideoNameWithExtension, tempFileProcessed, storage.PutOptions{
+			ContentType: mediatype,
+			Checksums:   checksums,
+		})
+		stageDone(err)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Could not put video to the S3", err)
+			return
+		}
+
+		contentRef, err = cfg.db.WithContext(r.Context()).CreateContentHash(database.CreateContentHashParams{
+			Hash:           contentHash,
+			VideoKey:       s3VideoNameWithExtension,
+			ChecksumSHA256: &checksums.SHA256,
+			Size:           processedInfo.Size(),
+		})
+		if err != nil {
+			cfg.store.Delete(r.Context(), s3VideoNameWithExtension)
+			respondWithError(w, http.StatusInternalServerError, "Couldn't save video content", err)
+			return
+		}
+		if contentRef.VideoKey != s3VideoNameWithExtension {
+			// A concurrent upload of the same file was stored first; use
+			// that object and drop ours.
+			err = cfg.store.Delete(r.Context(), s3VideoNameWithExtension)
+			if err != nil {
+				requestLogger(r.Context()).Warn("Couldn't delete duplicate video", slog.String("key", s3VideoNameWithExtension), slog.Any("err", err))
+			}
+		}
 	}
 
 	// Update the VideoURL of the video record in the database with the S3 bucket and key. S3 URLs are in the format https://<bucket-name>.s3.<region>.amazonaws.com/<key>. Make sure you use the correct region and bucket name!
-	s3VideoUrl := fmt.Sprintf("%v/%v", cfg.s3CfDistribution, s3VideoNameWithExtension)
-	video.VideoURL = &s3VideoUrl
+	// The file is swapped only if the video still has the one read above, so
+	// of concurrent uploads each previous file is released exactly once. A
+	// failed swap means another upload succeeded, so this loop ends.
+	uploadedFile := database.Video{ContentHash: &contentHash}
+	videoURL := cfg.videoURL(videoID, contentRef.VideoKey)
+	for {
+		previous := video
+		video.VideoURL = &videoURL
+		video.VideoKey = &contentRef.VideoKey
+		video.ContentHash = &contentHash
+		video.ChecksumSHA256 = contentRef.ChecksumSHA256
+		video.VideoSize = contentRef.Size
 
-	err = cfg.db.UpdateVideo(video)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
-		return
+		updated, err := cfg.db.WithContext(r.Context()).UpdateVideoFile(video, previous, q.Limits.MaxStorageBytes)
+		if errors.Is(err, database.ErrQuotaExceeded) {
+			// Concurrent uploads used up the space checked above.
+			cfg.releaseVideoObject(r.Context(), uploadedFile)
+			respondWithError(w, http.StatusRequestEntityTooLarge, "Video exceeds your storage quota", err)
+			return
+		}
+		if err != nil {
+			cfg.releaseVideoObject(r.Context(), uploadedFile)
+			respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+			return
+		}
+		if updated {
+			err = cfg.releaseVideoObject(r.Context(), previous)
+			if err != nil {
+				requestLogger(r.Context()).Warn("Couldn't release previous file of video", slog.Any("err", err))
+			}
+			break
+		}
+
+		video, err = cfg.db.WithContext(r.Context()).GetVideo(videoID)
+		if err != nil {
+			cfg.releaseVideoObject(r.Context(), uploadedFile)
+			respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+			return
+		}
+		if video.ID == uuid.Nil {
+			cfg.releaseVideoObject(r.Context(), uploadedFile)
+			respondWithError(w, http.StatusNotFound, "Couldn't find video", nil)
+			return
+		}
 	}
 
-	respondWithJSON(w, http.StatusOK, video)
+	cfg.respondWithVideo(w, r, http.StatusOK, video)
 
 	// Restart your server and test the handler by uploading the boots-video-vertical.mp4 file. Make sure that:
 	// The video is correctly uploaded to your S3 bucket.
@@ -160,20 +290,17 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 
 }
 
-func processVideoForFastStart(filePath string) (string, error) {
-	// Create a new string for the output file path. I just appended .processing to the input file (which should be the path to the temp file on disk)
+// invalidMedia reports whether err means ffmpeg or ffprobe rejected the
+// uploaded file, rather than couldn't be run.
+func invalidMedia(err error) bool {
+	var exitErr *exec.ExitError
+	return errors.As(err, &exitErr) || errors.Is(err, errNoVideoStream)
+}
+
+func processVideoForFastStart(ctx context.Context, filePath, outputFilePath string) error {
 	// Create a new exec.Cmd using exec.Command
 	// The command is ffmpeg and the arguments are -i, the input file path, -c, copy, -movflags, faststart, -f, mp4 and the output file path.
 	// Run the command
-	// Return the output file path
-	outputFilePath := fmt.Sprintf("%v.processing", filePath)
-
-	cmd := exec.Command("ffmpeg", "-i", filePath, "-c", "copy", "-movflags", "faststart", "-f", "mp4", outputFilePath)
-
-	err := cmd.Run()
-	if err != nil {
-		return "", err
-	}
-
-	return outputFilePath, nil
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-i", filePath, "-c", "copy", "-movflags", "faststart", "-f", "mp4", outputFilePath)
+	return runTraced(ctx, cmd)
 }
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/client"
+	"github.com/google/uuid"
+)
+
+func TestUploadVideoConcurrentReplace(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := context.Background()
+	c, _ := ts.signup(t, "race@example.com")
+
+	// Both videos share the stored object of the same content.
+	shared, err := c.CreateVideo(ctx, client.CreateVideoRequest{Title: "Shared"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	replaced, err := c.CreateVideo(ctx, client.CreateVideoRequest{Title: "Replaced"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, video := range []*client.Video{shared, replaced} {
+		_, err = c.UploadVideo(ctx, video.ID, testVideo("shared video"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Hold both replacements up in ffmpeg, after they have read the file
+	// they replace, then let them race to swap it.
+	gate := filepath.Join(t.TempDir(), "gate")
+	err = os.WriteFile(gate, nil, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TUBELY_TEST_FFMPEG_GATE", gate)
+	contents := []string{"first replacement", "second replacement"}
+	uploaded := make(chan error, len(contents))
+	for _, content := range contents {
+		go func() {
+			_, err := c.UploadVideo(ctx, replaced.ID, testVideo(content))
+			uploaded <- err
+		}()
+	}
+	waitForGauge(t, ts.cfg.metrics.jobsInProgress.WithLabelValues(jobVideoProcessing), float64(len(contents)))
+	err = os.Remove(gate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range contents {
+		err = <-uploaded
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := streamVideo(t, ts, shared.ID); got != "shared video" {
+		t.Errorf("Shared video streams %q, want %q", got, "shared video")
+	}
+	if got := streamVideo(t, ts, replaced.ID); got != contents[0] && got != contents[1] {
+		t.Errorf("Replaced video streams %q, want one of %q", got, contents)
+	}
+	// The shared object and the winning replacement are left.
+	if got := countFiles(t, ts.storageDir); got != 2 {
+		t.Errorf("Storage has %d objects, want 2", got)
+	}
+}
+
+func TestUploadVideoConcurrentQuota(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := context.Background()
+	c, _ := ts.signup(t, "quota@example.com")
+	contents := []string{strings.Repeat("a", 100), strings.Repeat("b", 100)}
+	free := ts.cfg.plans["free"]
+	free.MaxStorageBytes = 150
+	ts.cfg.plans["free"] = free
+
+	// Each upload fits on its own; hold both up in ffmpeg, after their quota
+	// check, so neither sees the other's usage.
+	gate := filepath.Join(t.TempDir(), "gate")
+	err := os.WriteFile(gate, nil, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TUBELY_TEST_FFMPEG_GATE", gate)
+	uploaded := make(chan error, len(contents))
+	for _, content := range contents {
+		video, err := c.CreateVideo(ctx, client.CreateVideoRequest{Title: "Quota"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			_, err := c.UploadVideo(ctx, video.ID, testVideo(content))
+			uploaded <- err
+		}()
+	}
+	waitForGauge(t, ts.cfg.metrics.jobsInProgress.WithLabelValues(jobVideoProcessing), float64(len(contents)))
+	err = os.Remove(gate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var failed []error
+	for range contents {
+		err := <-uploaded
+		if err != nil {
+			failed = append(failed, err)
+		}
+	}
+	if len(failed) != 1 {
+		t.Fatalf("%d uploads failed, want 1: %v", len(failed), failed)
+	}
+	wantProblem(t, failed[0], http.StatusRequestEntityTooLarge)
+	usage, err := c.GetUsage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.UsedBytes != 100 {
+		t.Errorf("Usage is %d bytes, want 100", usage.UsedBytes)
+	}
+	// Only the stored upload's object is left.
+	if got := countFiles(t, ts.storageDir); got != 1 {
+		t.Errorf("Storage has %d objects, want 1", got)
+	}
+}
+
+func TestUploadVideoRemovesProcessingFile(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := context.Background()
+	c, _ := ts.signup(t, "invalid@example.com")
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+
+	video, err := c.CreateVideo(ctx, client.CreateVideoRequest{Title: "Invalid"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The fake ffmpeg fails after its output exists, like a real one can.
+	_, err = c.UploadVideo(ctx, video.ID, testVideo("notavideo"))
+	wantProblem(t, err, http.StatusUnprocessableEntity)
+	if got := countFiles(t, tmp); got != 0 {
+		t.Errorf("Failed upload left %d files in the temp directory", got)
+	}
+}
+
+func streamVideo(t *testing.T, ts *testServer, videoID uuid.UUID) string {
+	t.Helper()
+	stream, err := ts.client().StreamVideo(context.Background(), videoID, client.StreamVideoParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	content, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+// countFiles counts the regular files under dir.
+func countFiles(t *testing.T, dir string) int {
+	t.Helper()
+	n := 0
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			n++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
@@ -2,12 +2,20 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"strings"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/mailer"
 )
 
+// maxPasswordLength bounds the argon2id work a single request can cause.
+const maxPasswordLength = 128
+
 func (cfg *apiConfig) handlerUsersCreate(w http.ResponseWriter, r *http.Request) {
 	type parameters struct {
 		Password string `json:"password"`
@@ -18,12 +26,24 @@ func (cfg *apiConfig) handlerUsersCreate(w http.ResponseWriter, r *http.Request)
 	params := parameters{}
 	err := decoder.Decode(&params)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters", err)
+		respondWithErrorCode(w, http.StatusBadRequest, codeMalformedBody, "Couldn't decode parameters", err)
 		return
 	}
 
-	if params.Password == "" || params.Email == "" {
-		respondWithError(w, http.StatusBadRequest, "Email and password are required", nil)
+	var errs fieldErrors
+	email, err := auth.NormalizeEmail(params.Email)
+	if params.Email == "" {
+		errs.add("email", "required", "Email is required")
+	} else if err != nil {
+		errs.add("email", "invalid", "Invalid email address")
+	}
+	if params.Password == "" {
+		errs.add("password", "required", "Password is required")
+	} else if err := cfg.passwordPolicy.Check(params.Password, email); err != nil {
+		errs.add("password", passwordErrorCode(err), capitalize(err.Error()))
+	}
+	if len(errs) > 0 {
+		respondWithFieldErrors(w, errs)
 		return
 	}
 
@@ -33,14 +53,252 @@ func (cfg *apiConfig) handlerUsersCreate(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	user, err := cfg.db.CreateUser(database.CreateUserParams{
-		Email:    params.Email,
+	user, err := cfg.db.WithContext(r.Context()).CreateUser(database.CreateUserParams{
+		Email:    email,
 		Password: hashedPassword,
 	})
+	if errors.Is(err, database.ErrEmailTaken) {
+		respondWithErrorCode(w, http.StatusConflict, codeEmailTaken, "An account with this email already exists", err)
+		return
+	}
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't create user", err)
 		return
 	}
 
+	err = cfg.sendVerificationEmail(r.Context(), *user)
+	if err != nil {
+		requestLogger(r.Context()).Warn("Couldn't send verification email", slog.Any("err", err))
+	}
+
 	respondWithJSON(w, http.StatusCreated, user)
 }
+
+func (cfg *apiConfig) handlerUserGet(w http.ResponseWriter, r *http.Request) {
+	user, ok := cfg.currentUser(w, r)
+	if !ok {
+		return
+	}
+	respondWithJSON(w, http.StatusOK, user)
+}
+
+// handlerUserEmailUpdate changes the user's email. The new address has to be
+// verified again and the old one is told about the change.
+func (cfg *apiConfig) handlerUserEmailUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+
+	user, ok := cfg.currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, codeMalformedBody, "Couldn't decode parameters", err)
+		return
+	}
+	if !cfg.checkCurrentPassword(w, user, params.Password) {
+		return
+	}
+
+	email, err := auth.NormalizeEmail(params.Email)
+	if err != nil {
+		respondWithFieldErrors(w, fieldErrors{{Field: "email", Code: "invalid", Message: "Invalid email address"}})
+		return
+	}
+	if email == user.Email {
+		respondWithJSON(w, http.StatusOK, user)
+		return
+	}
+
+	err = cfg.db.WithContext(r.Context()).UpdateUserEmail(user.ID, email)
+	if errors.Is(err, database.ErrEmailTaken) {
+		respondWithErrorCode(w, http.StatusConflict, codeEmailTaken, "An account with this email already exists", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update email", err)
+		return
+	}
+
+	cfg.sendMail(mailer.Message{
+		To:      user.Email,
+		Subject: "Your Tubely email address was changed",
+		Body: fmt.Sprintf(`The email address of your Tubely account was changed to %s.
+
+If you didn't do this, reset your password right away and contact support.
+`, email),
+	})
+
+	updated, err := cfg.db.WithContext(r.Context()).GetUser(user.ID)
+	if err != nil || updated == nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+	err = cfg.sendVerificationEmail(r.Context(), *updated)
+	if err != nil {
+		requestLogger(r.Context()).Warn("Couldn't send verification email", slog.Any("err", err))
+	}
+
+	respondWithJSON(w, http.StatusOK, updated)
+}
+
+// handlerUserPasswordUpdate changes the user's password, logs them out
+// everywhere, including the session making the request, and revokes their
+// API keys.
+func (cfg *apiConfig) handlerUserPasswordUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+
+	user, ok := cfg.currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, codeMalformedBody, "Couldn't decode parameters", err)
+		return
+	}
+	if !cfg.checkCurrentPassword(w, user, params.CurrentPassword) {
+		return
+	}
+	err = cfg.passwordPolicy.Check(params.NewPassword, user.Email)
+	if err != nil {
+		respondWithFieldErrors(w, fieldErrors{{Field: "new_password", Code: passwordErrorCode(err), Message: capitalize(err.Error())}})
+		return
+	}
+
+	hashedPassword, err := auth.HashPassword(params.NewPassword)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't hash password", err)
+		return
+	}
+	err = cfg.db.WithContext(r.Context()).UpdateUserPassword(user.ID, hashedPassword)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update password", err)
+		return
+	}
+	err = cfg.revokeAllSessions(r.Context(), user.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke sessions", err)
+		return
+	}
+	// Keys made by whoever knew the old password must stop working too.
+	err = cfg.db.WithContext(r.Context()).RevokeAllAPIKeys(user.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke API keys", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerUserDelete deletes the account with all of its videos and their
+// files.
+func (cfg *apiConfig) handlerUserDelete(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Password string `json:"password"`
+	}
+
+	user, ok := cfg.currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, codeMalformedBody, "Couldn't decode parameters", err)
+		return
+	}
+	if !cfg.checkCurrentPassword(w, user, params.Password) {
+		return
+	}
+
+	videos, err := cfg.db.WithContext(r.Context()).GetVideos(user.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
+		return
+	}
+
+	err = cfg.db.WithContext(r.Context()).DeleteUser(user.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete user", err)
+		return
+	}
+	cfg.audit(&user.ID, "user.delete", auditTargetUser, user.ID.String(), fmt.Sprintf("videos=%d", len(videos)))
+
+	for _, video := range videos {
+		err = cfg.releaseVideoObject(r.Context(), video)
+		if err != nil {
+			requestLogger(r.Context()).Warn("Couldn't release file of video", slog.String("video_id", video.ID.String()), slog.Any("err", err))
+		}
+		err = cfg.removeThumbnail(video)
+		if err != nil {
+			requestLogger(r.Context()).Warn("Couldn't remove thumbnail of video", slog.String("video_id", video.ID.String()), slog.Any("err", err))
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// currentUser loads the authenticated user, responding with an error if that
+// fails.
+func (cfg *apiConfig) currentUser(w http.ResponseWriter, r *http.Request) (database.User, bool) {
+	userID := principalFromContext(r.Context()).UserID
+	user, err := cfg.db.WithContext(r.Context()).GetUser(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return database.User{}, false
+	}
+	if user == nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't find user", nil)
+		return database.User{}, false
+	}
+	return *user, true
+}
+
+// checkCurrentPassword makes sensitive account changes require the password,
+// not just a possibly stolen access token.
+func (cfg *apiConfig) checkCurrentPassword(w http.ResponseWriter, user database.User, password string) bool {
+	match, err := auth.CheckPasswordHash(password, user.Password)
+	if err != nil || !match {
+		respondWithErrorCode(w, http.StatusForbidden, codeInvalidCredentials, "Incorrect password", err)
+		return false
+	}
+	return true
+}
+
+// passwordErrorCode is the field error code of a password the policy
+// rejected.
+func passwordErrorCode(err error) string {
+	switch {
+	case errors.Is(err, auth.ErrPasswordTooShort):
+		return "too_short"
+	case errors.Is(err, auth.ErrPasswordTooLong):
+		return "too_long"
+	case errors.Is(err, auth.ErrPasswordBreached):
+		return "breached"
+	case errors.Is(err, auth.ErrPasswordIsEmail):
+		return "contains_email"
+	}
+	return "invalid"
+}
+
+func capitalize(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
@@ -3,8 +3,8 @@ package main
 import (
 	"encoding/json"
 	"net/http"
+	"strings"
 
-	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 	"github.com/google/uuid"
 )
@@ -14,27 +14,42 @@ func (cfg *apiConfig) handlerVideoMetaCreate(w http.ResponseWriter, r *http.Requ
 		database.CreateVideoParams
 	}
 
-	token, err := auth.GetBearerToken(r.Header)
+	userID := principalFromContext(r.Context()).UserID
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		respondWithErrorCode(w, http.StatusBadRequest, codeMalformedBody, "Couldn't decode parameters", err)
 		return
 	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+	params.UserID = userID
+
+	var errs fieldErrors
+	if strings.TrimSpace(params.Title) == "" {
+		errs.add("title", "required", "Title is required")
+	}
+	switch params.Visibility {
+	case "", database.VisibilityPublic, database.VisibilityPrivate:
+	default:
+		errs.add("visibility", "invalid_choice", "Visibility must be public or private")
+	}
+	if len(errs) > 0 {
+		respondWithFieldErrors(w, errs)
 		return
 	}
 
-	decoder := json.NewDecoder(r.Body)
-	params := parameters{}
-	err = decoder.Decode(&params)
+	q, err := cfg.userQuota(r.Context(), userID)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get storage quota", err)
+		return
+	}
+	if q.VideoCount >= q.Limits.MaxVideos {
+		respondWithErrorCode(w, http.StatusForbidden, codeQuotaExceeded, "Video quota exceeded", nil)
 		return
 	}
-	params.UserID = userID
 
-	video, err := cfg.db.CreateVideo(params.CreateVideoParams)
+	video, err := cfg.db.WithContext(r.Context()).CreateVideo(params.CreateVideoParams)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't create video", err)
 		return
@@ -47,32 +62,27 @@ func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Requ
 	videoIDString := r.PathValue("videoID")
 	videoID, err := uuid.Parse(videoIDString)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		respondWithErrorCode(w, http.StatusBadRequest, codeInvalidID, "Invalid ID", err)
 		return
 	}
 
-	token, err := auth.GetBearerToken(r.Header)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
-		return
-	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	userID := principalFromContext(r.Context()).UserID
+
+	video, err := cfg.db.WithContext(r.Context()).GetVideo(videoID)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
 		return
 	}
-
-	video, err := cfg.db.GetVideo(videoID)
-	if err != nil {
-		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't find video", nil)
 		return
 	}
 	if video.UserID != userID {
-		respondWithError(w, http.StatusForbidden, "You can't delete this video", err)
+		respondWithError(w, http.StatusForbidden, "You can't delete this video", nil)
 		return
 	}
 
-	err = cfg.db.DeleteVideo(videoID)
+	err = cfg.deleteVideo(r.Context(), video.ID)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't delete video", err)
 		return
@@ -85,36 +95,37 @@ func (cfg *apiConfig) handlerVideoGet(w http.ResponseWriter, r *http.Request) {
 	videoIDString := r.PathValue("videoID")
 	videoID, err := uuid.Parse(videoIDString)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		respondWithErrorCode(w, http.StatusBadRequest, codeInvalidID, "Invalid video ID", err)
 		return
 	}
 
-	video, err := cfg.db.GetVideo(videoID)
+	video, err := cfg.db.WithContext(r.Context()).GetVideo(videoID)
 	if err != nil {
-		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	// Outsiders can't tell a private video from one that doesn't exist.
+	if video.ID == uuid.Nil || !principalFromContext(r.Context()).canView(video) {
+		respondWithError(w, http.StatusNotFound, "Couldn't find video", nil)
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, video)
+	cfg.respondWithVideo(w, r, http.StatusOK, video)
 }
 
 func (cfg *apiConfig) handlerVideosRetrieve(w http.ResponseWriter, r *http.Request) {
-	token, err := auth.GetBearerToken(r.Header)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
-		return
-	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	userID := principalFromContext(r.Context()).UserID
+
+	videos, err := cfg.db.WithContext(r.Context()).GetVideos(userID)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
 		return
 	}
 
-	videos, err := cfg.db.GetVideos(userID)
+	videos, err = cfg.playbackVideos(r.Context(), videos)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video URLs", err)
 		return
 	}
-
 	respondWithJSON(w, http.StatusOK, videos)
 }
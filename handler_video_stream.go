@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+	"github.com/google/uuid"
+)
+
+// videoURL is the URL clients use to play a video. S3 objects are served by
+// CloudFront; everything else goes through the stream endpoint.
+func (cfg *apiConfig) videoURL(videoID uuid.UUID, key string) string {
+	if cfg.storageBackend == "s3" {
+		return fmt.Sprintf("%v/%v", cfg.s3CfDistribution, key)
+	}
+	return fmt.Sprintf("%v/api/videos/%v/stream", cfg.publicURL, videoID)
+}
+
+// videoObjectKey returns the object key of a video's file. Videos uploaded
+// before keys were stored only have the CloudFront URL to go on.
+func (cfg *apiConfig) videoObjectKey(video database.Video) (string, bool) {
+	if video.VideoKey != nil {
+		return *video.VideoKey, true
+	}
+	if video.VideoURL != nil && strings.HasPrefix(*video.VideoURL, cfg.s3CfDistribution+"/") {
+		return strings.TrimPrefix(*video.VideoURL, cfg.s3CfDistribution+"/"), true
+	}
+	return "", false
+}
+
+func (cfg *apiConfig) handlerVideoStream(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, codeInvalidID, "Invalid video ID", err)
+		return
+	}
+
+	video, err := cfg.db.WithContext(r.Context()).GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't find video", nil)
+		return
+	}
+
+	// A signed URL from playbackVideo stands in for credentials, which
+	// a <video src> can't send.
+	query := r.URL.Query()
+	signed := cfg.validPlaybackSignature(video.ID, query.Get("expires"), query.Get("signature"), time.Now())
+	if video.Visibility != database.VisibilityPublic && !signed {
+		p := principalFromContext(r.Context())
+		if !p.authenticated() {
+			respondUnauthorized(w, codeUnauthorized, "Authentication required", nil)
+			return
+		}
+		if video.UserID != p.UserID {
+			if !p.can(permViewAnyVideo) {
+				respondWithError(w, http.StatusForbidden, "You can't view this video", nil)
+				return
+			}
+			// Players fetch a video in many ranges; audit the first one.
+			if rng := r.Header.Get("Range"); rng == "" || strings.HasPrefix(rng, "bytes=0-") {
+				cfg.audit(&p.UserID, "video.stream", auditTargetVideo, video.ID.String(), "")
+			}
+		}
+	}
+
+	key, ok := cfg.videoObjectKey(video)
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "Video has no uploaded file", nil)
+		return
+	}
+
+	obj, err := cfg.store.Open(r.Context(), key)
+	if errors.Is(err, storage.ErrNotFound) {
+		respondWithError(w, http.StatusNotFound, "Couldn't find video file", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't open video file", err)
+		return
+	}
+	defer obj.Close()
+
+	// http.ServeContent takes care of Range, If-Range, If-None-Match and
+	// If-Modified-Since, including multipart/byteranges responses.
+	if obj.ETag != "" {
+		w.Header().Set("ETag", obj.ETag)
+	}
+	if obj.ContentType != "" {
+		w.Header().Set("Content-Type", obj.ContentType)
+	}
+	if video.Visibility == database.VisibilityPublic {
+		w.Header().Set("Cache-Control", "public, max-age=0, must-revalidate")
+	} else {
+		w.Header().Set("Cache-Control", "private, max-age=0, must-revalidate")
+	}
+	cfg.allowLongTransfer(w, r)
+	http.ServeContent(w, r, "", obj.ModTime, obj)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/client"
+)
+
+// TestMediaURLs checks that the video and thumbnail URLs in responses are
+// built from the public URL and serve the uploaded files.
+func TestMediaURLs(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := context.Background()
+	c, _ := ts.signup(t, "media@example.com")
+
+	video, err := c.CreateVideo(ctx, client.CreateVideoRequest{Title: "Media"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.UploadVideo(ctx, video.ID, testVideo("video content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	thumbnail := client.File{Name: "thumbnail.png", ContentType: "image/png", Content: strings.NewReader("png content")}
+	_, err = c.UploadThumbnail(ctx, video.ID, thumbnail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	video, err = c.GetVideo(ctx, video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, media := range []struct {
+		name string
+		url  *string
+		want string
+	}{
+		{"video", video.VideoURL, "video content"},
+		{"thumbnail", video.ThumbnailURL, "png content"},
+	} {
+		if media.url == nil || !strings.HasPrefix(*media.url, ts.cfg.publicURL+"/") {
+			t.Errorf("The %s URL is %v, want one under %s", media.name, media.url, ts.cfg.publicURL)
+			continue
+		}
+		resp, body := ts.do(t, mustRequest(t, http.MethodGet, *media.url, nil))
+		if resp.StatusCode != http.StatusOK || body != media.want {
+			t.Errorf("GET %s answered %d %q, want 200 %q", *media.url, resp.StatusCode, body, media.want)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+const apiKeyPrefix = "tubely"
+
+const (
+	ScopeVideosRead  = "videos:read"
+	ScopeVideosWrite = "videos:write"
+)
+
+// Scopes lists every scope an API key may be granted.
+var Scopes = []string{ScopeVideosRead, ScopeVideosWrite}
+
+var ErrMalformedAPIKey = errors.New("malformed API key")
+
+// MakeAPIKey returns a new key of the form tubely_<id>_<secret> along with its
+// id part. The id is stored in plain text so the key can be looked up and
+// recognized in listings; only a hash of the whole key is stored. Ids are
+// unique in the database, so they're long enough to never collide.
+func MakeAPIKey() (key, id string, err error) {
+	idBytes := make([]byte, 16)
+	_, err = rand.Read(idBytes)
+	if err != nil {
+		return "", "", err
+	}
+	secret := make([]byte, 32)
+	_, err = rand.Read(secret)
+	if err != nil {
+		return "", "", err
+	}
+	id = hex.EncodeToString(idBytes)
+	return apiKeyPrefix + "_" + id + "_" + hex.EncodeToString(secret), id, nil
+}
+
+// ParseAPIKeyID extracts the id part of a key made by MakeAPIKey.
+func ParseAPIKeyID(key string) (string, error) {
+	parts := strings.Split(key, "_")
+	if len(parts) != 3 || parts[0] != apiKeyPrefix || parts[1] == "" || parts[2] == "" {
+		return "", ErrMalformedAPIKey
+	}
+	return parts[1], nil
+}
+
+// HashAPIKey hashes a key for storage. Keys carry 256 bits of randomness, so
+// a fast hash is enough; a password hash would only slow down every request.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func ValidScope(scope string) bool {
+	for _, s := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
@@ -2,6 +2,7 @@ package auth
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -38,50 +39,99 @@ func CheckPasswordHash(password, hash string) (bool, error) {
 	return match, nil
 }
 
+// AccessToken is what a valid access JWT says about its holder.
+type AccessToken struct {
+	ID        string
+	UserID    uuid.UUID
+	SessionID string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+}
+
+// Denylist reports access tokens that were revoked before they expired.
+type Denylist interface {
+	IsRevoked(token AccessToken) (bool, error)
+}
+
+var (
+	ErrTokenRevoked = errors.New("token has been revoked")
+	// ErrRevocationCheckFailed means the token may be fine but the denylist
+	// couldn't be read.
+	ErrRevocationCheckFailed = errors.New("couldn't check whether token was revoked")
+)
+
+type accessClaims struct {
+	jwt.RegisteredClaims
+	// SessionID is the refresh token family the token was issued for, so
+	// ending the session revokes its access tokens too.
+	SessionID string `json:"sid"`
+}
+
 func MakeJWT(
 	userID uuid.UUID,
-	tokenSecret string,
+	sessionID string,
+	keys *KeySet,
 	expiresIn time.Duration,
 ) (string, error) {
-	signingKey := []byte(tokenSecret)
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-		Issuer:    string(TokenTypeAccess),
-		IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
-		ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(expiresIn)),
-		Subject:   userID.String(),
+	now := time.Now().UTC()
+	return keys.sign(accessClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.NewString(),
+			Issuer:    string(TokenTypeAccess),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(expiresIn)),
+			Subject:   userID.String(),
+		},
+		SessionID: sessionID,
 	})
-	return token.SignedString(signingKey)
 }
 
-func ValidateJWT(tokenString, tokenSecret string) (uuid.UUID, error) {
-	claimsStruct := jwt.RegisteredClaims{}
-	token, err := jwt.ParseWithClaims(
+// ValidateJWT checks an access token's signature and claims, then asks
+// denylist, if not nil, whether it has been revoked.
+func ValidateJWT(tokenString string, keys *KeySet, denylist Denylist) (AccessToken, error) {
+	claims := accessClaims{}
+	_, err := jwt.ParseWithClaims(
 		tokenString,
-		&claimsStruct,
-		func(token *jwt.Token) (interface{}, error) { return []byte(tokenSecret), nil },
+		&claims,
+		keys.verificationKey,
+		jwt.WithValidMethods([]string{
+			jwt.SigningMethodHS256.Alg(),
+			jwt.SigningMethodRS256.Alg(),
+			jwt.SigningMethodEdDSA.Alg(),
+		}),
+		jwt.WithIssuer(string(TokenTypeAccess)),
 	)
 	if err != nil {
-		return uuid.Nil, err
+		return AccessToken{}, err
 	}
-
-	userIDString, err := token.Claims.GetSubject()
-	if err != nil {
-		return uuid.Nil, err
+	// Tokens without an ID or expiry can't be revoked, so they aren't
+	// accepted.
+	if claims.ID == "" || claims.ExpiresAt == nil || claims.IssuedAt == nil {
+		return AccessToken{}, errors.New("token is missing required claims")
 	}
 
-	issuer, err := token.Claims.GetIssuer()
+	id, err := uuid.Parse(claims.Subject)
 	if err != nil {
-		return uuid.Nil, err
+		return AccessToken{}, fmt.Errorf("invalid user ID: %w", err)
 	}
-	if issuer != string(TokenTypeAccess) {
-		return uuid.Nil, errors.New("invalid issuer")
+	token := AccessToken{
+		ID:        claims.ID,
+		UserID:    id,
+		SessionID: claims.SessionID,
+		IssuedAt:  claims.IssuedAt.Time,
+		ExpiresAt: claims.ExpiresAt.Time,
 	}
 
-	id, err := uuid.Parse(userIDString)
-	if err != nil {
-		return uuid.Nil, fmt.Errorf("invalid user ID: %w", err)
+	if denylist != nil {
+		revoked, err := denylist.IsRevoked(token)
+		if err != nil {
+			return AccessToken{}, fmt.Errorf("%w: %v", ErrRevocationCheckFailed, err)
+		}
+		if revoked {
+			return AccessToken{}, ErrTokenRevoked
+		}
 	}
-	return id, nil
+	return token, nil
 }
 
 func GetBearerToken(headers http.Header) (string, error) {
@@ -106,6 +156,12 @@ func MakeRefreshToken() (string, error) {
 	return hex.EncodeToString(token), nil
 }
 
+// HashToken hashes a random token such as one mailed to a user for storage.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
 func GetAPIKey(headers http.Header) (string, error) {
 	authHeader := headers.Get("Authorization")
 	if authHeader == "" {
@@ -0,0 +1,30 @@
+package auth
+
+import (
+	"errors"
+	"net/mail"
+	"strings"
+)
+
+const maxEmailLength = 254
+
+var ErrInvalidEmail = errors.New("invalid email address")
+
+// NormalizeEmail validates a bare email address and returns it trimmed and
+// lowercased, the form it is stored and looked up in.
+func NormalizeEmail(email string) (string, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if email == "" || len(email) > maxEmailLength {
+		return "", ErrInvalidEmail
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Name != "" || addr.Address != email {
+		return "", ErrInvalidEmail
+	}
+	at := strings.LastIndex(email, "@")
+	domain := email[at+1:]
+	if !strings.Contains(domain, ".") || strings.HasPrefix(domain, ".") || strings.HasSuffix(domain, ".") {
+		return "", ErrInvalidEmail
+	}
+	return email, nil
+}
@@ -0,0 +1,233 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// legacyKeyID names the JWT_SECRET key. Tokens issued before keys had IDs
+// carry no kid header and are checked against it too.
+const legacyKeyID = "hs256"
+
+// minRSAKeyBits is the smallest RSA key accepted for signing or verifying.
+const minRSAKeyBits = 2048
+
+// JWTKey is a key that verifies access tokens and, if its private half is
+// known, signs them.
+type JWTKey struct {
+	ID        string
+	Algorithm string
+	secret    []byte
+	private   crypto.Signer
+	public    crypto.PublicKey
+}
+
+// KeySet holds the key new access tokens are signed with and every key that
+// tokens are still accepted from. Retiring a key means removing it from the
+// set once the tokens it signed have expired.
+type KeySet struct {
+	signing *JWTKey
+	keys    map[string]*JWTKey
+}
+
+// NewHMACKeySet signs and verifies tokens with HS256 and a shared secret.
+func NewHMACKeySet(secret string) *KeySet {
+	key := &JWTKey{ID: legacyKeyID, Algorithm: jwt.SigningMethodHS256.Alg(), secret: []byte(secret)}
+	return &KeySet{
+		signing: key,
+		keys:    map[string]*JWTKey{key.ID: key},
+	}
+}
+
+// LoadKeySet reads the PEM files in dir, each named after its key ID:
+// <kid>.pem. A private key (RSA or Ed25519, PKCS #8 or PKCS #1) can sign,
+// a public key only verifies. Tokens are signed with signingID, which may
+// be empty if dir holds exactly one private key. A non-empty legacySecret
+// keeps HS256 tokens signed with JWT_SECRET valid until it is removed.
+func LoadKeySet(dir, signingID, legacySecret string) (*KeySet, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	set := &KeySet{keys: map[string]*JWTKey{}}
+	if legacySecret != "" {
+		set.keys[legacyKeyID] = &JWTKey{ID: legacyKeyID, Algorithm: jwt.SigningMethodHS256.Alg(), secret: []byte(legacySecret)}
+	}
+
+	var private []string
+	for _, path := range paths {
+		id := strings.TrimSuffix(filepath.Base(path), ".pem")
+		if id == legacyKeyID {
+			return nil, fmt.Errorf("key ID %q is reserved for JWT_SECRET", id)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		key, err := parseJWTKey(id, data)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", path, err)
+		}
+		set.keys[id] = key
+		if key.private != nil {
+			private = append(private, id)
+		}
+	}
+
+	if signingID == "" {
+		if len(private) != 1 {
+			return nil, fmt.Errorf("found %d private keys in %s, choose the signing key by its ID", len(private), dir)
+		}
+		signingID = private[0]
+	}
+	key, ok := set.keys[signingID]
+	if !ok || key.private == nil {
+		return nil, fmt.Errorf("no private key %q in %s", signingID, dir)
+	}
+	set.signing = key
+	return set, nil
+}
+
+func parseJWTKey(id string, data []byte) (*JWTKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	var parsed any
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key := &JWTKey{ID: id}
+	if signer, ok := parsed.(crypto.Signer); ok {
+		key.private = signer
+		parsed = signer.Public()
+	}
+	switch public := parsed.(type) {
+	case *rsa.PublicKey:
+		if public.N.BitLen() < minRSAKeyBits {
+			return nil, fmt.Errorf("RSA key has %d bits, at least %d are required", public.N.BitLen(), minRSAKeyBits)
+		}
+		key.Algorithm = jwt.SigningMethodRS256.Alg()
+	case ed25519.PublicKey:
+		key.Algorithm = jwt.SigningMethodEdDSA.Alg()
+	case *ecdsa.PublicKey:
+		return nil, errors.New("ECDSA keys aren't supported, use RSA or Ed25519")
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", parsed)
+	}
+	key.public = parsed
+	return key, nil
+}
+
+func (s *KeySet) sign(claims jwt.Claims) (string, error) {
+	key := s.signing
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(key.Algorithm), claims)
+	token.Header["kid"] = key.ID
+	if key.secret != nil {
+		return token.SignedString(key.secret)
+	}
+	return token.SignedString(key.private)
+}
+
+// verificationKey is the jwt.Keyfunc for tokens signed by the set. The
+// algorithm must be the key's own, so a public key can't be used as an HMAC
+// secret.
+func (s *KeySet) verificationKey(token *jwt.Token) (any, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		kid = legacyKeyID
+	}
+	key, ok := s.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key ID %q", kid)
+	}
+	if token.Method.Alg() != key.Algorithm {
+		return nil, fmt.Errorf("key %q doesn't sign with %s", kid, token.Method.Alg())
+	}
+	if key.secret != nil {
+		return key.secret, nil
+	}
+	return key.public, nil
+}
+
+// JWK is a public key in JSON Web Key form (RFC 7517).
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// JWKS returns the set's public keys, for other services to verify access
+// tokens with. HMAC secrets are never published.
+func (s *KeySet) JWKS() []JWK {
+	ids := make([]string, 0, len(s.keys))
+	for id := range s.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	jwks := []JWK{}
+	for _, id := range ids {
+		key := s.keys[id]
+		switch public := key.public.(type) {
+		case *rsa.PublicKey:
+			jwks = append(jwks, JWK{
+				Kty: "RSA",
+				Kid: key.ID,
+				Use: "sig",
+				Alg: key.Algorithm,
+				N:   base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+			})
+		case ed25519.PublicKey:
+			jwks = append(jwks, JWK{
+				Kty: "OKP",
+				Kid: key.ID,
+				Use: "sig",
+				Alg: key.Algorithm,
+				Crv: "Ed25519",
+				X:   base64.RawURLEncoding.EncodeToString(public),
+			})
+		}
+	}
+	return jwks
+}
+
+// SigningKeyID is the ID of the key new tokens are signed with.
+func (s *KeySet) SigningKeyID() string {
+	return s.signing.ID
+}
@@ -0,0 +1,268 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// writeKey saves key to dir as <id>.pem, PKCS #8 if it is private.
+func writeKey(t *testing.T, dir, id string, key any) {
+	t.Helper()
+	var block *pem.Block
+	if _, ok := key.(crypto.Signer); ok {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	} else {
+		der, err := x509.MarshalPKIXPublicKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block = &pem.Block{Type: "PUBLIC KEY", Bytes: der}
+	}
+	err := os.WriteFile(filepath.Join(dir, id+".pem"), pem.EncodeToMemory(block), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newEd25519Key(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func mustMakeJWT(t *testing.T, keys *KeySet) string {
+	t.Helper()
+	token, err := MakeJWT(uuid.New(), "session", keys, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func mustLoadKeySet(t *testing.T, dir, signingID, legacySecret string) *KeySet {
+	t.Helper()
+	keys, err := LoadKeySet(dir, signingID, legacySecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func wantValid(t *testing.T, token string, keys *KeySet, valid bool) {
+	t.Helper()
+	_, err := ValidateJWT(token, keys, nil)
+	if valid && err != nil {
+		t.Errorf("Token was refused: %v", err)
+	}
+	if !valid && err == nil {
+		t.Error("Token was accepted")
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	oldKey := newEd25519Key(t)
+	writeKey(t, dir, "old", oldKey)
+	keys := mustLoadKeySet(t, dir, "", "legacy secret")
+	if id := keys.SigningKeyID(); id != "old" {
+		t.Fatalf("Signing with %q, want the only private key", id)
+	}
+	oldToken := mustMakeJWT(t, keys)
+	legacyToken := mustMakeJWT(t, NewHMACKeySet("legacy secret"))
+
+	// Publish a new key and sign with it; both keys still verify.
+	writeKey(t, dir, "new", newEd25519Key(t))
+	_, err := LoadKeySet(dir, "", "")
+	if err == nil {
+		t.Error("Two private keys loaded without choosing one")
+	}
+	keys = mustLoadKeySet(t, dir, "new", "legacy secret")
+	newToken := mustMakeJWT(t, keys)
+	wantValid(t, oldToken, keys, true)
+	wantValid(t, newToken, keys, true)
+	wantValid(t, legacyToken, keys, true)
+
+	// The old key's public half keeps verifying but can't sign.
+	writeKey(t, dir, "old", oldKey.Public())
+	_, err = LoadKeySet(dir, "old", "")
+	if err == nil {
+		t.Error("A public key was chosen to sign with")
+	}
+	keys = mustLoadKeySet(t, dir, "", "")
+	if id := keys.SigningKeyID(); id != "new" {
+		t.Errorf("Signing with %q, want new", id)
+	}
+	wantValid(t, oldToken, keys, true)
+	wantValid(t, newToken, keys, true)
+	// Without JWT_SECRET its tokens are retired.
+	wantValid(t, legacyToken, keys, false)
+
+	err = os.Remove(filepath.Join(dir, "old.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys = mustLoadKeySet(t, dir, "", "")
+	wantValid(t, oldToken, keys, false)
+	wantValid(t, newToken, keys, true)
+
+	jwks := keys.JWKS()
+	if len(jwks) != 1 || jwks[0].Kid != "new" || jwks[0].Kty != "OKP" {
+		t.Errorf("JWKS is %+v, want only the new key", jwks)
+	}
+}
+
+func TestKeyIDLookup(t *testing.T) {
+	dir := t.TempDir()
+	writeKey(t, dir, "a", newEd25519Key(t))
+	writeKey(t, dir, "b", newEd25519Key(t))
+	keysA := mustLoadKeySet(t, dir, "a", "")
+	keysB := mustLoadKeySet(t, dir, "b", "")
+	token := mustMakeJWT(t, keysA)
+	wantValid(t, token, keysB, true)
+
+	// A token that claims the other key's ID fails its signature check.
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, &accessClaims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+	parsed.Header["kid"] = "b"
+	forged, err := parsed.SigningString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantValid(t, forged+"."+parts[2], keysB, false)
+
+	parsed.Header["kid"] = "unknown"
+	unknown, err := parsed.SignedString(keysA.signing.private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantValid(t, unknown, keysB, false)
+}
+
+// TestAlgorithmConfusion forges tokens that use a published public key as
+// an HMAC secret, or no signature at all.
+func TestAlgorithmConfusion(t *testing.T) {
+	dir := t.TempDir()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, minRSAKeyBits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeKey(t, dir, "rsa", rsaKey)
+	edKey := newEd25519Key(t)
+	writeKey(t, dir, "ed", edKey.Public())
+	keys := mustLoadKeySet(t, dir, "rsa", "legacy secret")
+	wantValid(t, mustMakeJWT(t, keys), keys, true)
+
+	rsaPEM, err := os.ReadFile(filepath.Join(dir, "rsa.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER})
+
+	forge := func(method jwt.SigningMethod, kid string, key any) string {
+		t.Helper()
+		now := time.Now()
+		token := jwt.NewWithClaims(method, accessClaims{
+			RegisteredClaims: jwt.RegisteredClaims{
+				ID:        uuid.NewString(),
+				Issuer:    string(TokenTypeAccess),
+				IssuedAt:  jwt.NewNumericDate(now),
+				ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+				Subject:   uuid.NewString(),
+			},
+		})
+		if kid != "" {
+			token.Header["kid"] = kid
+		}
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+
+	for name, token := range map[string]string{
+		"HS256 with RSA public key":     forge(jwt.SigningMethodHS256, "rsa", publicPEM),
+		"HS256 with RSA key file":       forge(jwt.SigningMethodHS256, "rsa", rsaPEM),
+		"HS256 with Ed25519 public key": forge(jwt.SigningMethodHS256, "ed", []byte(edKey.Public().(ed25519.PublicKey))),
+		"RS256 for Ed25519 key":         forge(jwt.SigningMethodRS256, "ed", rsaKey),
+		"RS256 for legacy secret":       forge(jwt.SigningMethodRS256, legacyKeyID, rsaKey),
+		"RS256 without kid":             forge(jwt.SigningMethodRS256, "", rsaKey),
+		"none":                          forge(jwt.SigningMethodNone, "rsa", jwt.UnsafeAllowNoneSignatureType),
+	} {
+		t.Run(name, func(t *testing.T) {
+			wantValid(t, token, keys, false)
+		})
+	}
+
+	// jwt checks key types too, but the key function mustn't rely on it.
+	for kid, method := range map[string]jwt.SigningMethod{
+		"rsa":       jwt.SigningMethodHS256,
+		"ed":        jwt.SigningMethodRS256,
+		legacyKeyID: jwt.SigningMethodEdDSA,
+	} {
+		_, err := keys.verificationKey(&jwt.Token{Method: method, Header: map[string]any{"kid": kid}})
+		if err == nil {
+			t.Errorf("Key %s was offered for %s", kid, method.Alg())
+		}
+	}
+}
+
+func TestLoadKeySetRefusesKeys(t *testing.T) {
+	weakRSA, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, write := range map[string]func(dir string){
+		"reserved ID": func(dir string) { writeKey(t, dir, legacyKeyID, newEd25519Key(t)) },
+		"weak RSA":    func(dir string) { writeKey(t, dir, "weak", weakRSA) },
+		"ECDSA":       func(dir string) { writeKey(t, dir, "ec", ecKey) },
+		"not PEM": func(dir string) {
+			err := os.WriteFile(filepath.Join(dir, "junk.pem"), []byte("junk"), 0o600)
+			if err != nil {
+				t.Fatal(err)
+			}
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeKey(t, dir, "good", newEd25519Key(t))
+			write(dir)
+			_, err := LoadKeySet(dir, "good", "")
+			if err == nil {
+				t.Error("Key set loaded")
+			}
+		})
+	}
+}
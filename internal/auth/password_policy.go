@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	ErrPasswordTooShort = errors.New("password is too short")
+	ErrPasswordTooLong  = errors.New("password is too long")
+	ErrPasswordBreached = errors.New("password appears in a list of breached passwords")
+	ErrPasswordIsEmail  = errors.New("password must not contain the email address")
+)
+
+// commonPasswords are refused even without a breached password list.
+var commonPasswords = []string{
+	"password", "password1", "password123", "123456", "12345678", "123456789",
+	"1234567890", "qwerty", "qwerty123", "qwertyuiop", "abc123", "111111",
+	"iloveyou", "letmein", "welcome", "admin", "monkey", "dragon", "football",
+	"baseball", "sunshine", "princess", "trustno1", "000000", "tubely",
+}
+
+// PasswordPolicy decides which passwords users may choose.
+type PasswordPolicy struct {
+	MinLength int
+	// MaxLength bounds the work a single login can cause.
+	MaxLength int
+	// breached holds upper case hex SHA-1 hashes of refused passwords.
+	breached map[string]struct{}
+}
+
+// NewPasswordPolicy returns a policy refusing common passwords and, if
+// breachedListPath isn't empty, every password in that file. The file has one
+// entry per line, either the password itself or its SHA-1 hash in hex,
+// optionally followed by ":count" as in the Have I Been Pwned downloads.
+func NewPasswordPolicy(minLength, maxLength int, breachedListPath string) (PasswordPolicy, error) {
+	p := PasswordPolicy{
+		MinLength: minLength,
+		MaxLength: maxLength,
+		breached:  map[string]struct{}{},
+	}
+	for _, password := range commonPasswords {
+		p.breached[sha1Hex(password)] = struct{}{}
+	}
+	if breachedListPath == "" {
+		return p, nil
+	}
+
+	f, err := os.Open(breachedListPath)
+	if err != nil {
+		return PasswordPolicy{}, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if sha1Line.MatchString(line) {
+			p.breached[strings.ToUpper(line[:40])] = struct{}{}
+			continue
+		}
+		p.breached[sha1Hex(line)] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return PasswordPolicy{}, fmt.Errorf("couldn't read %s: %w", breachedListPath, err)
+	}
+	return p, nil
+}
+
+var sha1Line = regexp.MustCompile(`^[0-9A-Fa-f]{40}(:\d+)?$`)
+
+func sha1Hex(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// Check returns an error describing why password isn't acceptable for the
+// user with the given email, or nil.
+func (p PasswordPolicy) Check(password, email string) error {
+	length := utf8.RuneCountInString(password)
+	if length < p.MinLength {
+		return fmt.Errorf("%w: use at least %d characters", ErrPasswordTooShort, p.MinLength)
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		return fmt.Errorf("%w: use at most %d characters", ErrPasswordTooLong, p.MaxLength)
+	}
+	if local, _, ok := strings.Cut(email, "@"); ok && len(local) >= 3 && strings.Contains(strings.ToLower(password), local) {
+		return ErrPasswordIsEmail
+	}
+	if _, ok := p.breached[sha1Hex(password)]; ok {
+		return ErrPasswordBreached
+	}
+	if _, ok := p.breached[sha1Hex(strings.ToLower(password))]; ok {
+		return ErrPasswordBreached
+	}
+	return nil
+}
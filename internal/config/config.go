@@ -0,0 +1,276 @@
+// Package config loads the server's settings from a YAML file, environment
+// variables and command line flags, in increasing order of precedence.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/mail"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is the server's configuration. Each setting has a path in the
+// config file, e.g. server.port, which is also the name of its flag, and
+// most have an environment variable.
+type Config struct {
+	Server   Server   `yaml:"server"`
+	Log      Log      `yaml:"log"`
+	Tracing  Tracing  `yaml:"tracing"`
+	Database Database `yaml:"database"`
+	Auth     Auth     `yaml:"auth"`
+	Storage  Storage  `yaml:"storage"`
+	S3       S3       `yaml:"s3"`
+	Plans    Plans    `yaml:"plans"`
+	Mail     Mail     `yaml:"mail"`
+	OIDC     OIDC     `yaml:"oidc"`
+}
+
+type Server struct {
+	Port string `yaml:"port" env:"PORT" help:"port to listen on"`
+	// PublicURL is where clients reach the server, e.g. behind a reverse
+	// proxy. Links in responses and emails are built from it.
+	PublicURL string `yaml:"public_url" env:"PUBLIC_URL" help:"URL clients reach the server at; defaults to http://localhost:<port>"`
+	// Platform is dev on development machines, which allows resetting the
+	// database.
+	Platform        string        `yaml:"platform" env:"PLATFORM" help:"dev allows POST /admin/reset"`
+	FilepathRoot    string        `yaml:"filepath_root" env:"FILEPATH_ROOT" help:"directory of the web app"`
+	AssetsRoot      string        `yaml:"assets_root" env:"ASSETS_ROOT" help:"directory thumbnails are stored in"`
+	RequestTimeout  time.Duration `yaml:"request_timeout" env:"REQUEST_TIMEOUT" help:"how long reading a request or writing its response may take"`
+	TransferTimeout time.Duration `yaml:"transfer_timeout" env:"TRANSFER_TIMEOUT" help:"request_timeout of uploads and video streams"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT" help:"how long to drain requests on SIGTERM"`
+	// StaleUploadAge must be longer than any upload takes, since servers
+	// sharing a temp directory can't tell each other's files apart.
+	StaleUploadAge time.Duration `yaml:"stale_upload_age" env:"STALE_UPLOAD_AGE" help:"age at which upload temp files left by a killed server are removed on start"`
+	// TrustedProxies are the addresses of reverse proxies in front of the
+	// server, whose X-Forwarded-For and Forwarded headers are believed.
+	TrustedProxies string `yaml:"trusted_proxies" env:"TRUSTED_PROXIES" help:"comma-separated IPs or CIDRs of proxies whose forwarded client address is trusted"`
+	// MetricsAddr is a separate listener for Prometheus, so that metrics
+	// aren't served to the clients of the API.
+	MetricsAddr string `yaml:"metrics_addr" env:"METRICS_ADDR" help:"host:port to serve /metrics on; empty turns metrics off"`
+}
+
+type Log struct {
+	Format string `yaml:"format" env:"LOG_FORMAT" help:"json or text"`
+	Level  string `yaml:"level" env:"LOG_LEVEL" help:"debug, info, warn or error"`
+}
+
+type Tracing struct {
+	// Exporter uses the variable from the OpenTelemetry spec; the OTLP
+	// exporter itself is configured by the spec's other variables.
+	Exporter string `yaml:"exporter" env:"OTEL_TRACES_EXPORTER" help:"none, stdout or otlp"`
+}
+
+type Database struct {
+	Path string `yaml:"path" env:"DB_PATH" help:"SQLite database file"`
+}
+
+type Auth struct {
+	// JWTSecret signs access tokens unless JWTKeysDir is set.
+	JWTSecret             string        `yaml:"jwt_secret" env:"JWT_SECRET" secret:"true" help:"HS256 access token secret"`
+	JWTKeysDir            string        `yaml:"jwt_keys_dir" env:"JWT_KEYS_DIR" help:"directory of access token signing keys"`
+	JWTSigningKey         string        `yaml:"jwt_signing_key" env:"JWT_SIGNING_KEY" help:"kid of the key to sign with"`
+	AccessTokenTTL        time.Duration `yaml:"access_token_ttl" env:"ACCESS_TOKEN_TTL" help:"access token lifetime"`
+	PasswordMinLength     int           `yaml:"password_min_length" env:"PASSWORD_MIN_LENGTH" help:"shortest password accepted"`
+	BreachedPasswordsFile string        `yaml:"breached_passwords_file" env:"BREACHED_PASSWORDS_FILE" help:"file of breached passwords to refuse"`
+}
+
+type Storage struct {
+	Backend string `yaml:"backend" env:"STORAGE_BACKEND" help:"s3 or filesystem"`
+	Root    string `yaml:"root" env:"STORAGE_ROOT" help:"directory of the filesystem backend"`
+	// URLSecret signs the stream URLs of private videos on the filesystem
+	// backend. Servers sharing a storage root need the same one.
+	URLSecret string `yaml:"url_secret" env:"STORAGE_URL_SECRET" secret:"true" help:"signs private video stream URLs; random per process if unset"`
+}
+
+// S3 is only used by the s3 storage backend.
+type S3 struct {
+	Bucket         string `yaml:"bucket" env:"S3_BUCKET" help:"bucket videos are stored in"`
+	Region         string `yaml:"region" env:"S3_REGION" help:"region of the bucket"`
+	CFDistribution string `yaml:"cf_distribution" env:"S3_CF_DISTRO" help:"CloudFront URL videos are served from"`
+}
+
+type Plans struct {
+	File string `yaml:"file" env:"PLANS_FILE" help:"JSON file overriding the quota plans"`
+}
+
+type Mail struct {
+	Mailer       string `yaml:"mailer" env:"MAILER" help:"log, file or smtp; only smtp outside dev"`
+	From         string `yaml:"from" env:"MAIL_FROM" help:"sender address"`
+	Dir          string `yaml:"dir" env:"MAIL_DIR" help:"directory the file mailer writes to"`
+	SMTPAddr     string `yaml:"smtp_addr" env:"SMTP_ADDR" help:"host:port of the SMTP server"`
+	SMTPUsername string `yaml:"smtp_username" env:"SMTP_USERNAME" help:"SMTP user"`
+	SMTPPassword string `yaml:"smtp_password" env:"SMTP_PASSWORD" secret:"true" help:"SMTP password"`
+}
+
+// OIDC enables single sign-on when Issuer is set.
+type OIDC struct {
+	Issuer       string `yaml:"issuer" env:"OIDC_ISSUER" help:"OpenID Connect issuer URL"`
+	ClientID     string `yaml:"client_id" env:"OIDC_CLIENT_ID" help:"OpenID Connect client ID"`
+	ClientSecret string `yaml:"client_secret" env:"OIDC_CLIENT_SECRET" secret:"true" help:"OpenID Connect client secret"`
+	RedirectURL  string `yaml:"redirect_url" env:"OIDC_REDIRECT_URL" help:"defaults to <public_url>/api/oidc/callback"`
+}
+
+// Default returns the settings used when nothing overrides them.
+func Default() Config {
+	return Config{
+		Server: Server{
+			RequestTimeout:  time.Minute,
+			TransferTimeout: 30 * time.Minute,
+			ShutdownTimeout: 2 * time.Minute,
+			StaleUploadAge:  24 * time.Hour,
+			MetricsAddr:     "127.0.0.1:9091",
+		},
+		Log: Log{
+			Format: "json",
+			Level:  "info",
+		},
+		Tracing: Tracing{
+			Exporter: "none",
+		},
+		Auth: Auth{
+			AccessTokenTTL:    15 * time.Minute,
+			PasswordMinLength: 8,
+		},
+		Storage: Storage{
+			Backend: "s3",
+		},
+		Mail: Mail{
+			Mailer: "log",
+			From:   "Tubely <no-reply@localhost>",
+		},
+	}
+}
+
+// Validate checks every setting and reports all problems at once.
+func (c Config) Validate() error {
+	var errs []error
+	check := func(ok bool, path, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: %s", describe(path), fmt.Sprintf(format, args...)))
+		}
+	}
+	required := func(value, path string) {
+		check(value != "", path, "must be set")
+	}
+	oneOf := func(value, path string, allowed ...string) {
+		for _, a := range allowed {
+			if value == a {
+				return
+			}
+		}
+		check(false, path, "must be one of %v, got %q", allowed, value)
+	}
+
+	port, err := strconv.Atoi(c.Server.Port)
+	check(err == nil && port > 0 && port < 65536, "server.port", "must be a port number, got %q", c.Server.Port)
+	if c.Server.PublicURL != "" {
+		u, err := url.Parse(c.Server.PublicURL)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" && u.RawQuery == "" && u.Fragment == "",
+			"server.public_url", "must be an http or https URL, got %q", c.Server.PublicURL)
+	}
+	required(c.Server.Platform, "server.platform")
+	required(c.Server.FilepathRoot, "server.filepath_root")
+	required(c.Server.AssetsRoot, "server.assets_root")
+	check(c.Server.RequestTimeout > 0, "server.request_timeout", "must be positive")
+	check(c.Server.TransferTimeout >= c.Server.RequestTimeout, "server.transfer_timeout", "must be at least server.request_timeout")
+	check(c.Server.ShutdownTimeout > 0, "server.shutdown_timeout", "must be positive")
+	check(c.Server.StaleUploadAge > c.Server.TransferTimeout, "server.stale_upload_age", "must be longer than server.transfer_timeout")
+	_, err = c.TrustedProxyPrefixes()
+	check(err == nil, "server.trusted_proxies", "%v", err)
+	if c.Server.MetricsAddr != "" {
+		_, metricsPort, err := net.SplitHostPort(c.Server.MetricsAddr)
+		check(err == nil && metricsPort != "", "server.metrics_addr", "must be host:port, got %q", c.Server.MetricsAddr)
+		check(metricsPort != c.Server.Port, "server.metrics_addr", "must not use server.port")
+	}
+
+	oneOf(c.Log.Format, "log.format", "json", "text")
+	var level slog.Level
+	check(level.UnmarshalText([]byte(c.Log.Level)) == nil, "log.level", "must be debug, info, warn or error, got %q", c.Log.Level)
+	oneOf(c.Tracing.Exporter, "tracing.exporter", "none", "stdout", "otlp")
+
+	required(c.Database.Path, "database.path")
+
+	if c.Auth.JWTKeysDir == "" {
+		check(c.Auth.JWTSecret != "", "auth.jwt_secret", "must be set unless auth.jwt_keys_dir is")
+	}
+	check(c.Auth.AccessTokenTTL > 0, "auth.access_token_ttl", "must be positive")
+	check(c.Auth.PasswordMinLength > 0, "auth.password_min_length", "must be positive")
+
+	oneOf(c.Storage.Backend, "storage.backend", "s3", "filesystem")
+	switch c.Storage.Backend {
+	case "s3":
+		required(c.S3.Bucket, "s3.bucket")
+		required(c.S3.Region, "s3.region")
+		required(c.S3.CFDistribution, "s3.cf_distribution")
+	case "filesystem":
+		required(c.Storage.Root, "storage.root")
+	}
+
+	oneOf(c.Mail.Mailer, "mail.mailer", "log", "file", "smtp")
+	_, err = mail.ParseAddress(c.Mail.From)
+	check(err == nil, "mail.from", "must be an email address, got %q", c.Mail.From)
+	switch c.Mail.Mailer {
+	case "file":
+		required(c.Mail.Dir, "mail.dir")
+	case "smtp":
+		required(c.Mail.SMTPAddr, "mail.smtp_addr")
+	}
+	// The log and file mailers keep whole messages, reset and verification
+	// links included, where anyone reading logs or disks can use them.
+	if c.Mail.Mailer == "log" || c.Mail.Mailer == "file" {
+		check(c.Server.Platform == "dev", "mail.mailer", "must be smtp unless server.platform is dev, got %q", c.Mail.Mailer)
+	}
+
+	if c.OIDC.Issuer != "" {
+		u, err := url.Parse(c.OIDC.Issuer)
+		check(err == nil && u.Scheme != "" && u.Host != "", "oidc.issuer", "must be a URL, got %q", c.OIDC.Issuer)
+		required(c.OIDC.ClientID, "oidc.client_id")
+	}
+
+	return errors.Join(errs...)
+}
+
+// TrustedProxyPrefixes parses server.trusted_proxies. Single addresses are
+// prefixes of their full length.
+func (c Config) TrustedProxyPrefixes() ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range strings.Split(c.Server.TrustedProxies, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if addr, err := netip.ParseAddr(s); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("must be IP addresses or CIDRs, got %q", s)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// PublicBaseURL is server.public_url without a trailing slash, or the
+// server on localhost if it isn't set.
+func (c Config) PublicBaseURL() string {
+	if c.Server.PublicURL != "" {
+		return strings.TrimRight(c.Server.PublicURL, "/")
+	}
+	return "http://localhost:" + c.Server.Port
+}
+
+// OIDCRedirectURL is where the identity provider sends users back to.
+func (c Config) OIDCRedirectURL() string {
+	if c.OIDC.RedirectURL != "" {
+		return c.OIDC.RedirectURL
+	}
+	return c.PublicBaseURL() + "/api/oidc/callback"
+}
@@ -0,0 +1,181 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const redacted = "REDACTED"
+
+// Load builds the configuration from the defaults, the YAML file named by
+// -config or CONFIG_FILE, environment variables and flags, each overriding
+// the ones before, and validates it. It returns the arguments left after
+// the flags. Empty environment variables count as unset.
+func Load(args []string, getenv func(string) string) (Config, []string, error) {
+	conf := Default()
+
+	fs := flag.NewFlagSet("tubely", flag.ContinueOnError)
+	configFile := fs.String("config", getenv("CONFIG_FILE"), "YAML config file (CONFIG_FILE)")
+	flagValues := map[string]string{}
+	for _, s := range conf.settings() {
+		usage := s.help
+		if s.env != "" {
+			usage += " (" + s.env + ")"
+		}
+		fs.Func(s.path, usage, func(value string) error {
+			flagValues[s.path] = value
+			return nil
+		})
+	}
+	err := fs.Parse(args)
+	if err != nil {
+		return Config{}, nil, err
+	}
+
+	if *configFile != "" {
+		err := conf.readFile(*configFile)
+		if err != nil {
+			return Config{}, nil, fmt.Errorf("couldn't read config file %s: %w", *configFile, err)
+		}
+	}
+
+	var errs []error
+	for _, s := range conf.settings() {
+		if s.env == "" {
+			continue
+		}
+		if value := getenv(s.env); value != "" {
+			errs = append(errs, s.set(value))
+		}
+	}
+	for _, s := range conf.settings() {
+		if value, ok := flagValues[s.path]; ok {
+			errs = append(errs, s.set(value))
+		}
+	}
+	errs = append(errs, conf.Validate())
+
+	return conf, fs.Args(), errors.Join(errs...)
+}
+
+func (c *Config) readFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	err = dec.Decode(c)
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+// Redacted returns a copy of c with secrets replaced, fit for printing.
+func (c Config) Redacted() Config {
+	for _, s := range c.settings() {
+		if s.secret && s.value.String() != "" {
+			s.value.SetString(redacted)
+		}
+	}
+	return c
+}
+
+// Write prints c as a YAML config file, with secrets redacted.
+func (c Config) Write(w io.Writer) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	err := enc.Encode(c.Redacted())
+	if err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// setting is a single configurable value of a Config.
+type setting struct {
+	// path is the setting's location in the config file, e.g. server.port.
+	path   string
+	env    string
+	help   string
+	secret bool
+	value  reflect.Value
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// settings lists the settings of c, which must be addressable for set to
+// change it.
+func (c *Config) settings() []setting {
+	var settings []setting
+	sections := reflect.ValueOf(c).Elem()
+	for i := range sections.NumField() {
+		section := sections.Field(i)
+		sectionName := sections.Type().Field(i).Tag.Get("yaml")
+		for j := range section.NumField() {
+			field := section.Type().Field(j)
+			settings = append(settings, setting{
+				path:   sectionName + "." + field.Tag.Get("yaml"),
+				env:    field.Tag.Get("env"),
+				help:   field.Tag.Get("help"),
+				secret: field.Tag.Get("secret") == "true",
+				value:  section.Field(j),
+			})
+		}
+	}
+	return settings
+}
+
+func (s setting) set(value string) error {
+	if s.value.Type() == durationType {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%s: must be a duration such as 15m, got %q", s.describe(), value)
+		}
+		s.value.SetInt(int64(d))
+		return nil
+	}
+	switch s.value.Kind() {
+	case reflect.String:
+		s.value.SetString(value)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%s: must be an integer, got %q", s.describe(), value)
+		}
+		s.value.SetInt(int64(n))
+	default:
+		panic("config: unsupported setting type " + s.value.Type().String())
+	}
+	return nil
+}
+
+func (s setting) describe() string {
+	if s.env == "" {
+		return s.path
+	}
+	return s.path + " (" + s.env + ")"
+}
+
+// describe names the setting at path for error messages, with its
+// environment variable since that is how most deployments set it.
+func describe(path string) string {
+	var c Config
+	for _, s := range c.settings() {
+		if s.path == path {
+			return s.describe()
+		}
+	}
+	return path
+}
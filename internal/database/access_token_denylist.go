@@ -0,0 +1,45 @@
+package database
+
+import (
+	"time"
+)
+
+// DenyAccessTokens revokes the access tokens with ID id, which is either a
+// token's jti or a session ID, until expiresAt, when they would have expired
+// anyway.
+func (c Client) DenyAccessTokens(id string, expiresAt time.Time) error {
+	_, err := c.db.Exec(`
+	INSERT INTO access_token_denylist (id, created_at, expires_at)
+	VALUES (?, CURRENT_TIMESTAMP, ?)
+	ON CONFLICT(id) DO UPDATE SET expires_at = MAX(expires_at, excluded.expires_at)
+	`, id, expiresAt)
+	return err
+}
+
+// GetDeniedAccessTokens deletes expired denylist entries and returns the
+// rest, mapping each ID to when it expires.
+func (c Client) GetDeniedAccessTokens() (map[string]time.Time, error) {
+	now := time.Now().UTC()
+	_, err := c.db.Exec("DELETE FROM access_token_denylist WHERE expires_at <= ?", now)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := c.db.Query("SELECT id, expires_at FROM access_token_denylist")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	denied := map[string]time.Time{}
+	for rows.Next() {
+		var id string
+		var expiresAt time.Time
+		err := rows.Scan(&id, &expiresAt)
+		if err != nil {
+			return nil, err
+		}
+		denied[id] = expiresAt
+	}
+	return denied, rows.Err()
+}
@@ -0,0 +1,183 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type APIKey struct {
+	ID         uuid.UUID  `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	CreateAPIKeyParams
+}
+
+// CreateAPIKeyParams describes a key. Prefix is the public id part of the
+// key; KeyHash is never sent to clients.
+type CreateAPIKeyParams struct {
+	UserID    uuid.UUID  `json:"user_id"`
+	Name      string     `json:"name"`
+	Prefix    string     `json:"prefix"`
+	KeyHash   string     `json:"-"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+func (k APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (c Client) CreateAPIKey(params CreateAPIKeyParams) (APIKey, error) {
+	id := uuid.New()
+	query := `
+	INSERT INTO api_keys (
+		id,
+		created_at,
+		updated_at,
+		user_id,
+		name,
+		prefix,
+		key_hash,
+		scopes,
+		expires_at
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(
+		query,
+		id.String(),
+		params.UserID.String(),
+		params.Name,
+		params.Prefix,
+		params.KeyHash,
+		strings.Join(params.Scopes, " "),
+		params.ExpiresAt,
+	)
+	if err != nil {
+		return APIKey{}, err
+	}
+
+	return c.GetAPIKeyByPrefix(params.Prefix)
+}
+
+func (c Client) GetAPIKeyByPrefix(prefix string) (APIKey, error) {
+	query := `
+	SELECT id, created_at, updated_at, last_used_at, revoked_at, user_id, name, prefix, key_hash, scopes, expires_at
+	FROM api_keys
+	WHERE prefix = ?
+	`
+	key, err := scanAPIKey(c.db.QueryRow(query, prefix))
+	if errors.Is(err, sql.ErrNoRows) {
+		return APIKey{}, nil
+	}
+	return key, err
+}
+
+func (c Client) GetAPIKeys(userID uuid.UUID) ([]APIKey, error) {
+	query := `
+	SELECT id, created_at, updated_at, last_used_at, revoked_at, user_id, name, prefix, key_hash, scopes, expires_at
+	FROM api_keys
+	WHERE user_id = ?
+	ORDER BY created_at DESC
+	`
+	rows, err := c.db.Query(query, userID.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// RevokeAPIKey revokes one of the user's keys. It reports false if the user
+// has no active key with that ID.
+func (c Client) RevokeAPIKey(userID, keyID uuid.UUID) (bool, error) {
+	query := `
+	UPDATE api_keys
+	SET revoked_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND user_id = ? AND revoked_at IS NULL
+	`
+	res, err := c.db.Exec(query, keyID.String(), userID.String())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// RevokeAllAPIKeys revokes every active key of the user.
+func (c Client) RevokeAllAPIKeys(userID uuid.UUID) error {
+	query := `
+	UPDATE api_keys
+	SET revoked_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+	WHERE user_id = ? AND revoked_at IS NULL
+	`
+	_, err := c.db.Exec(query, userID.String())
+	return err
+}
+
+func (c Client) TouchAPIKey(keyID uuid.UUID) error {
+	query := `
+	UPDATE api_keys
+	SET last_used_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, keyID.String())
+	return err
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanAPIKey(row rowScanner) (APIKey, error) {
+	var key APIKey
+	var id, userID, scopes string
+	err := row.Scan(
+		&id,
+		&key.CreatedAt,
+		&key.UpdatedAt,
+		&key.LastUsedAt,
+		&key.RevokedAt,
+		&userID,
+		&key.Name,
+		&key.Prefix,
+		&key.KeyHash,
+		&scopes,
+		&key.ExpiresAt,
+	)
+	if err != nil {
+		return APIKey{}, err
+	}
+	key.ID, err = uuid.Parse(id)
+	if err != nil {
+		return APIKey{}, err
+	}
+	key.UserID, err = uuid.Parse(userID)
+	if err != nil {
+		return APIKey{}, err
+	}
+	key.Scopes = strings.Fields(scopes)
+	return key, nil
+}
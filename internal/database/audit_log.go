@@ -0,0 +1,85 @@
+package database
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// AuditLogEntry records a privileged action. ActorID is nil for actions run
+// from the command line.
+type AuditLogEntry struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	CreateAuditLogEntryParams
+}
+
+type CreateAuditLogEntryParams struct {
+	ActorID    *uuid.UUID `json:"actor_id"`
+	Action     string     `json:"action"`
+	TargetType string     `json:"target_type"`
+	TargetID   string     `json:"target_id"`
+	Details    string     `json:"details"`
+}
+
+func (c Client) CreateAuditLogEntry(params CreateAuditLogEntryParams) error {
+	query := `
+	INSERT INTO audit_log (
+		created_at,
+		actor_id,
+		action,
+		target_type,
+		target_id,
+		details
+	) VALUES (CURRENT_TIMESTAMP, ?, ?, ?, ?, ?)
+	`
+	var actorID *string
+	if params.ActorID != nil {
+		id := params.ActorID.String()
+		actorID = &id
+	}
+	_, err := c.db.Exec(query, actorID, params.Action, params.TargetType, params.TargetID, params.Details)
+	return err
+}
+
+// GetAuditLog returns the most recent entries first.
+func (c Client) GetAuditLog(limit int) ([]AuditLogEntry, error) {
+	query := `
+	SELECT id, created_at, actor_id, action, target_type, target_id, details
+	FROM audit_log
+	ORDER BY id DESC
+	LIMIT ?
+	`
+	rows, err := c.db.Query(query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []AuditLogEntry{}
+	for rows.Next() {
+		var entry AuditLogEntry
+		var actorID *string
+		err := rows.Scan(
+			&entry.ID,
+			&entry.CreatedAt,
+			&actorID,
+			&entry.Action,
+			&entry.TargetType,
+			&entry.TargetID,
+			&entry.Details,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if actorID != nil {
+			id, err := uuid.Parse(*actorID)
+			if err != nil {
+				return nil, err
+			}
+			entry.ActorID = &id
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
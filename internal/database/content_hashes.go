@@ -0,0 +1,109 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ContentHash maps the SHA-256 of an uploaded file to the processed object
+// stored for it. RefCount is the number of videos pointing at the object.
+type ContentHash struct {
+	CreateContentHashParams
+	RefCount  int       `json:"ref_count"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// CreateContentHashParams describes a processed object. The checksums are
+// those of the stored object, not of the original upload.
+type CreateContentHashParams struct {
+	Hash           string  `json:"hash"`
+	VideoKey       string  `json:"video_key"`
+	ChecksumSHA256 *string `json:"checksum_sha256"`
+	Size           int64   `json:"size"`
+}
+
+// AcquireContentHash takes a reference on an existing object for hash. It
+// returns false if no object is stored for that content.
+func (c Client) AcquireContentHash(hash string) (ContentHash, bool, error) {
+	query := `
+	UPDATE content_hashes
+	SET ref_count = ref_count + 1, updated_at = CURRENT_TIMESTAMP
+	WHERE hash = ?
+	RETURNING hash, video_key, checksum_sha256, size, ref_count, created_at, updated_at
+	`
+	var ch ContentHash
+	err := c.db.QueryRow(query, hash).
+		Scan(&ch.Hash, &ch.VideoKey, &ch.ChecksumSHA256, &ch.Size, &ch.RefCount, &ch.CreatedAt, &ch.UpdatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ContentHash{}, false, nil
+		}
+		return ContentHash{}, false, err
+	}
+	return ch, true, nil
+}
+
+// CreateContentHash records a newly stored object for hash with one
+// reference. If another upload of the same content won the race, that
+// object is kept and referenced instead; callers must compare VideoKey with
+// the key they stored and delete their own object if it differs.
+func (c Client) CreateContentHash(params CreateContentHashParams) (ContentHash, error) {
+	query := `
+	INSERT INTO content_hashes (
+		hash,
+		video_key,
+		checksum_sha256,
+		size,
+		ref_count,
+		created_at,
+		updated_at
+	) VALUES (?, ?, ?, ?, 1, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
+	ON CONFLICT(hash) DO UPDATE SET
+		ref_count = ref_count + 1,
+		updated_at = CURRENT_TIMESTAMP
+	RETURNING hash, video_key, checksum_sha256, size, ref_count, created_at, updated_at
+	`
+	var ch ContentHash
+	err := c.db.QueryRow(query, params.Hash, params.VideoKey, params.ChecksumSHA256, params.Size).
+		Scan(&ch.Hash, &ch.VideoKey, &ch.ChecksumSHA256, &ch.Size, &ch.RefCount, &ch.CreatedAt, &ch.UpdatedAt)
+	if err != nil {
+		return ContentHash{}, err
+	}
+	return ch, nil
+}
+
+// ReleaseContentHash drops a reference on hash. When the last reference is
+// released the row is removed and the returned RefCount is zero, meaning the
+// caller should delete the object.
+func (c Client) ReleaseContentHash(hash string) (ContentHash, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return ContentHash{}, err
+	}
+	defer tx.Rollback()
+
+	query := `
+	UPDATE content_hashes
+	SET ref_count = ref_count - 1, updated_at = CURRENT_TIMESTAMP
+	WHERE hash = ?
+	RETURNING hash, video_key, checksum_sha256, size, ref_count, created_at, updated_at
+	`
+	var ch ContentHash
+	err = tx.QueryRow(query, hash).
+		Scan(&ch.Hash, &ch.VideoKey, &ch.ChecksumSHA256, &ch.Size, &ch.RefCount, &ch.CreatedAt, &ch.UpdatedAt)
+	if err != nil {
+		return ContentHash{}, err
+	}
+
+	if ch.RefCount <= 0 {
+		_, err = tx.Exec("DELETE FROM content_hashes WHERE hash = ?", hash)
+		if err != nil {
+			return ContentHash{}, err
+		}
+		ch.RefCount = 0
+	}
+
+	return ch, tx.Commit()
+}
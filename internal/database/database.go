@@ -1,14 +1,17 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"strings"
+	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 )
 
 type Client struct {
-	db *sql.DB
+	db *observedDB
 }
 
 func NewClient(pathToDB string) (Client, error) {
@@ -16,7 +19,7 @@ func NewClient(pathToDB string) (Client, error) {
 	if err != nil {
 		return Client{}, err
 	}
-	c := Client{db}
+	c := Client{&observedDB{DB: db}}
 	err = c.autoMigrate()
 	if err != nil {
 		return Client{}, err
@@ -32,13 +35,54 @@ func (c *Client) autoMigrate() error {
 		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 		password TEXT NOT NULL,
-		email TEXT UNIQUE NOT NULL
+		email TEXT UNIQUE NOT NULL,
+		plan TEXT NOT NULL DEFAULT 'free',
+		role TEXT NOT NULL DEFAULT 'user',
+		disabled_at TIMESTAMP,
+		email_verified_at TIMESTAMP,
+		totp_secret TEXT,
+		totp_enabled_at TIMESTAMP,
+		totp_last_step INTEGER NOT NULL DEFAULT 0
 	);
 	`
 	_, err := c.db.Exec(userTable)
 	if err != nil {
 		return err
 	}
+	err = c.addColumnIfMissing("users", "plan", "TEXT NOT NULL DEFAULT 'free'")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("users", "role", "TEXT NOT NULL DEFAULT 'user'")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("users", "disabled_at", "TIMESTAMP")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("users", "email_verified_at", "TIMESTAMP")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("users", "totp_secret", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("users", "totp_enabled_at", "TIMESTAMP")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("users", "totp_last_step", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+	// Emails are stored normalized; older rows that would collide with
+	// another account once lowercased are left alone.
+	_, err = c.db.Exec("UPDATE OR IGNORE users SET email = LOWER(TRIM(email)) WHERE email <> LOWER(TRIM(email))")
+	if err != nil {
+		return err
+	}
 	refreshTokenTable := `
 	CREATE TABLE IF NOT EXISTS refresh_tokens (
 		token TEXT PRIMARY KEY,
@@ -47,6 +91,11 @@ func (c *Client) autoMigrate() error {
 		revoked_at TIMESTAMP,
 		user_id TEXT NOT NULL,
 		expires_at TIMESTAMP NOT NULL,
+		family_id TEXT NOT NULL DEFAULT '',
+		replaced_by TEXT,
+		user_agent TEXT NOT NULL DEFAULT '',
+		ip TEXT NOT NULL DEFAULT '',
+		last_used_at TIMESTAMP,
 		FOREIGN KEY(user_id) REFERENCES users(id)
 	);
 	`
@@ -54,6 +103,31 @@ func (c *Client) autoMigrate() error {
 	if err != nil {
 		return err
 	}
+	err = c.addColumnIfMissing("refresh_tokens", "family_id", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("refresh_tokens", "replaced_by", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("refresh_tokens", "user_agent", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("refresh_tokens", "ip", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("refresh_tokens", "last_used_at", "TIMESTAMP")
+	if err != nil {
+		return err
+	}
+	// Tokens issued before rotation each form their own family.
+	_, err = c.db.Exec("UPDATE refresh_tokens SET family_id = token WHERE family_id = ''")
+	if err != nil {
+		return err
+	}
 
 	videoTable := `
 	CREATE TABLE IF NOT EXISTS videos (
@@ -63,7 +137,14 @@ func (c *Client) autoMigrate() error {
 		title TEXT NOT NULL,
 		description TEXT,
 		thumbnail_url TEXT,
+		thumbnail_key TEXT,
+		thumbnail_size INTEGER NOT NULL DEFAULT 0,
 		video_url TEXT TEXT,
+		video_key TEXT,
+		content_hash TEXT,
+		checksum_sha256 TEXT,
+		video_size INTEGER NOT NULL DEFAULT 0,
+		visibility TEXT NOT NULL DEFAULT 'public',
 		user_id INTEGER,
 		FOREIGN KEY(user_id) REFERENCES users(id)
 	);
@@ -72,18 +153,275 @@ func (c *Client) autoMigrate() error {
 	if err != nil {
 		return err
 	}
+	err = c.addColumnIfMissing("videos", "video_key", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("videos", "visibility", "TEXT NOT NULL DEFAULT 'public'")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("videos", "content_hash", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("videos", "checksum_sha256", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("videos", "thumbnail_key", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("videos", "thumbnail_size", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("videos", "video_size", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+
+	contentHashTable := `
+	CREATE TABLE IF NOT EXISTS content_hashes (
+		hash TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		video_key TEXT NOT NULL,
+		checksum_sha256 TEXT,
+		size INTEGER NOT NULL DEFAULT 0,
+		ref_count INTEGER NOT NULL
+	);
+	`
+	_, err = c.db.Exec(contentHashTable)
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("content_hashes", "checksum_sha256", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfMissing("content_hashes", "size", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+	apiKeyTable := `
+	CREATE TABLE IF NOT EXISTS api_keys (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		last_used_at TIMESTAMP,
+		revoked_at TIMESTAMP,
+		user_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		prefix TEXT UNIQUE NOT NULL,
+		key_hash TEXT NOT NULL,
+		scopes TEXT NOT NULL,
+		expires_at TIMESTAMP,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(apiKeyTable)
+	if err != nil {
+		return err
+	}
+
+	userTokenTable := `
+	CREATE TABLE IF NOT EXISTS user_tokens (
+		token_hash TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		user_id TEXT NOT NULL,
+		purpose TEXT NOT NULL,
+		email TEXT NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		used_at TIMESTAMP,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(userTokenTable)
+	if err != nil {
+		return err
+	}
+
+	recoveryCodeTable := `
+	CREATE TABLE IF NOT EXISTS recovery_codes (
+		user_id TEXT NOT NULL,
+		code_hash TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		used_at TIMESTAMP,
+		PRIMARY KEY(user_id, code_hash),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(recoveryCodeTable)
+	if err != nil {
+		return err
+	}
+
+	loginAttemptTable := `
+	CREATE TABLE IF NOT EXISTS login_attempts (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		created_at TIMESTAMP NOT NULL,
+		email TEXT NOT NULL,
+		ip TEXT NOT NULL,
+		user_agent TEXT NOT NULL DEFAULT '',
+		result TEXT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS login_attempts_email ON login_attempts(email, created_at);
+	CREATE INDEX IF NOT EXISTS login_attempts_ip ON login_attempts(ip, created_at);
+	`
+	_, err = c.db.Exec(loginAttemptTable)
+	if err != nil {
+		return err
+	}
+
+	auditLogTable := `
+	CREATE TABLE IF NOT EXISTS audit_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		actor_id TEXT,
+		action TEXT NOT NULL,
+		target_type TEXT NOT NULL,
+		target_id TEXT NOT NULL,
+		details TEXT NOT NULL DEFAULT ''
+	);
+	`
+	_, err = c.db.Exec(auditLogTable)
+	if err != nil {
+		return err
+	}
+
+	oidcLoginTable := `
+	CREATE TABLE IF NOT EXISTS oidc_logins (
+		state_hash TEXT PRIMARY KEY,
+		nonce TEXT NOT NULL,
+		code_verifier TEXT NOT NULL,
+		expires_at TIMESTAMP NOT NULL
+	);
+	`
+	_, err = c.db.Exec(oidcLoginTable)
+	if err != nil {
+		return err
+	}
+
+	userIdentityTable := `
+	CREATE TABLE IF NOT EXISTS user_identities (
+		issuer TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		email TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY(issuer, subject),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(userIdentityTable)
+	if err != nil {
+		return err
+	}
+
+	accessTokenDenylistTable := `
+	CREATE TABLE IF NOT EXISTS access_token_denylist (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		expires_at TIMESTAMP NOT NULL
+	);
+	`
+	_, err = c.db.Exec(accessTokenDenylistTable)
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
+// addColumnIfMissing upgrades databases created before a column was added to
+// its CREATE TABLE statement.
+func (c *Client) addColumnIfMissing(table, column, definition string) error {
+	rows, err := c.db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			columnType string
+			notNull    int
+			defaultVal sql.NullString
+			primaryKey int
+		)
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultVal, &primaryKey); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = c.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+// Ping checks that the database can still be reached.
+func (c Client) Ping(ctx context.Context) error {
+	return c.db.PingContext(ctx)
+}
+
 func (c Client) Reset() error {
 	if _, err := c.db.Exec("DELETE FROM refresh_tokens"); err != nil {
 		return fmt.Errorf("failed to reset table refresh_tokens: %w", err)
 	}
+	if _, err := c.db.Exec("DELETE FROM user_tokens"); err != nil {
+		return fmt.Errorf("failed to reset table user_tokens: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM recovery_codes"); err != nil {
+		return fmt.Errorf("failed to reset table recovery_codes: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM api_keys"); err != nil {
+		return fmt.Errorf("failed to reset table api_keys: %w", err)
+	}
 	if _, err := c.db.Exec("DELETE FROM users"); err != nil {
 		return fmt.Errorf("failed to reset table users: %w", err)
 	}
 	if _, err := c.db.Exec("DELETE FROM videos"); err != nil {
 		return fmt.Errorf("failed to reset table videos: %w", err)
 	}
+	if _, err := c.db.Exec("DELETE FROM content_hashes"); err != nil {
+		return fmt.Errorf("failed to reset table content_hashes: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM login_attempts"); err != nil {
+		return fmt.Errorf("failed to reset table login_attempts: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM audit_log"); err != nil {
+		return fmt.Errorf("failed to reset table audit_log: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM oidc_logins"); err != nil {
+		return fmt.Errorf("failed to reset table oidc_logins: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM user_identities"); err != nil {
+		return fmt.Errorf("failed to reset table user_identities: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM access_token_denylist"); err != nil {
+		return fmt.Errorf("failed to reset table access_token_denylist: %w", err)
+	}
 	return nil
 }
+
+// parseTimestamp parses a TIMESTAMP read through an expression, which the
+// driver returns as text because the column type is lost.
+func parseTimestamp(s string) (time.Time, error) {
+	s = strings.TrimSuffix(s, "Z")
+	for _, format := range sqlite3.SQLiteTimestampFormats {
+		t, err := time.ParseInLocation(format, s, time.UTC)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("couldn't parse timestamp %q", s)
+}
@@ -0,0 +1,134 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+type LoginResult string
+
+const (
+	LoginResultSuccess LoginResult = "success"
+	LoginResultFailure LoginResult = "failure"
+	// LoginResultBlocked is an attempt refused by rate limiting before the
+	// password was checked.
+	LoginResultBlocked LoginResult = "blocked"
+	// LoginResultDisabled is a correct password for a disabled account. It
+	// neither counts as a failure nor resets the failures before it.
+	LoginResultDisabled LoginResult = "disabled"
+	// LoginResultPasswordReset is a password reset request rather than a
+	// login. Reset requests are throttled separately.
+	LoginResultPasswordReset LoginResult = "password_reset"
+)
+
+type LoginAttempt struct {
+	ID        int64       `json:"id"`
+	CreatedAt time.Time   `json:"created_at"`
+	Email     string      `json:"email"`
+	IP        string      `json:"ip"`
+	UserAgent string      `json:"user_agent"`
+	Result    LoginResult `json:"result"`
+}
+
+// LoginFailures summarizes recent failed logins for an account or address.
+type LoginFailures struct {
+	Count  int
+	LastAt time.Time
+}
+
+func (c Client) CreateLoginAttempt(attempt LoginAttempt) error {
+	query := `
+	INSERT INTO login_attempts (created_at, email, ip, user_agent, result)
+	VALUES (?, ?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query, attempt.CreatedAt.UTC(), attempt.Email, attempt.IP, attempt.UserAgent, attempt.Result)
+	return err
+}
+
+// GetAccountLoginFailures counts failed logins to email since the later of
+// since and its last successful login.
+func (c Client) GetAccountLoginFailures(email string, since time.Time) (LoginFailures, error) {
+	query := `
+	SELECT COUNT(*), MAX(created_at)
+	FROM login_attempts
+	WHERE email = ? AND result = 'failure' AND created_at > ? AND created_at > COALESCE(
+		(SELECT MAX(created_at) FROM login_attempts WHERE email = ? AND result = 'success'),
+		''
+	)
+	`
+	return scanLoginFailures(c.db.QueryRow(query, email, since.UTC(), email))
+}
+
+// GetIPLoginFailures counts failed logins from ip since since. Successful
+// logins don't reset it, so an attacker can't clear their record by logging
+// in to an account of their own.
+func (c Client) GetIPLoginFailures(ip string, since time.Time) (LoginFailures, error) {
+	query := `
+	SELECT COUNT(*), MAX(created_at)
+	FROM login_attempts
+	WHERE ip = ? AND result = 'failure' AND created_at > ?
+	`
+	return scanLoginFailures(c.db.QueryRow(query, ip, since.UTC()))
+}
+
+// GetPasswordResetRequests counts password reset requests for email and from
+// ip since since. An empty email or ip matches any.
+func (c Client) GetPasswordResetRequests(email, ip string, since time.Time) (LoginFailures, error) {
+	query := `
+	SELECT COUNT(*), MAX(created_at)
+	FROM login_attempts
+	WHERE result = 'password_reset' AND (? = '' OR email = ?) AND (? = '' OR ip = ?) AND created_at > ?
+	`
+	return scanLoginFailures(c.db.QueryRow(query, email, email, ip, ip, since.UTC()))
+}
+
+func scanLoginFailures(row *sql.Row) (LoginFailures, error) {
+	var failures LoginFailures
+	var lastAt sql.NullString
+	err := row.Scan(&failures.Count, &lastAt)
+	if err != nil {
+		return LoginFailures{}, err
+	}
+	if lastAt.Valid {
+		failures.LastAt, err = parseTimestamp(lastAt.String)
+		if err != nil {
+			return LoginFailures{}, err
+		}
+	}
+	return failures, nil
+}
+
+// GetLoginAttempts returns the most recent attempts first, optionally only
+// those for email or from ip.
+func (c Client) GetLoginAttempts(email, ip string, limit int) ([]LoginAttempt, error) {
+	query := `
+	SELECT id, created_at, email, ip, user_agent, result
+	FROM login_attempts
+	WHERE (? = '' OR email = ?) AND (? = '' OR ip = ?)
+	ORDER BY id DESC
+	LIMIT ?
+	`
+	rows, err := c.db.Query(query, email, email, ip, ip, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attempts := []LoginAttempt{}
+	for rows.Next() {
+		var attempt LoginAttempt
+		err := rows.Scan(
+			&attempt.ID,
+			&attempt.CreatedAt,
+			&attempt.Email,
+			&attempt.IP,
+			&attempt.UserAgent,
+			&attempt.Result,
+		)
+		if err != nil {
+			return nil, err
+		}
+		attempts = append(attempts, attempt)
+	}
+	return attempts, nil
+}
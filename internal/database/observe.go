@@ -0,0 +1,163 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"runtime"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database")
+
+// QueryObserver is told how long each database call took. operation is the
+// name of the Client method that made the call; transactions are timed as a
+// whole, from Begin to Commit.
+type QueryObserver func(operation string, duration time.Duration)
+
+// ObserveQueries reports the duration of every later database call to
+// observer. It must be called before the client is shared.
+func (c Client) ObserveQueries(observer QueryObserver) {
+	c.db.observer = observer
+}
+
+// WithContext returns a client whose calls run with ctx, so they are
+// canceled with it and traced as part of the request or job it carries.
+// Calls through a client without a context aren't traced.
+func (c Client) WithContext(ctx context.Context) Client {
+	db := *c.db
+	db.ctx = ctx
+	return Client{db: &db}
+}
+
+type observedDB struct {
+	*sql.DB
+	observer QueryObserver
+	ctx      context.Context
+}
+
+func (db *observedDB) Exec(query string, args ...any) (sql.Result, error) {
+	ctx, done := db.start(query)
+	res, err := db.DB.ExecContext(ctx, query, args...)
+	done(err)
+	return res, err
+}
+
+// Query is timed until the first rows are ready, not until they have all
+// been read.
+func (db *observedDB) Query(query string, args ...any) (*sql.Rows, error) {
+	ctx, done := db.start(query)
+	rows, err := db.DB.QueryContext(ctx, query, args...)
+	done(err)
+	return rows, err
+}
+
+func (db *observedDB) QueryRow(query string, args ...any) *sql.Row {
+	ctx, done := db.start(query)
+	row := db.DB.QueryRowContext(ctx, query, args...)
+	done(row.Err())
+	return row
+}
+
+func (db *observedDB) Begin() (*observedTx, error) {
+	ctx, done := db.start("BEGIN")
+	tx, err := db.DB.BeginTx(ctx, nil)
+	if err != nil {
+		done(err)
+		return nil, err
+	}
+	return &observedTx{Tx: tx, done: done}, nil
+}
+
+// start begins timing and tracing a call made by the Client method three
+// frames up. The returned function ends it.
+func (db *observedDB) start(query string) (context.Context, func(err error)) {
+	ctx := db.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if db.observer == nil && db.ctx == nil {
+		return ctx, func(error) {}
+	}
+
+	operation := callerOperation(3)
+	begin := time.Now()
+	var span trace.Span
+	if db.ctx != nil {
+		ctx, span = tracer.Start(ctx, "db."+operation,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				attribute.String("db.system", "sqlite"),
+				attribute.String("db.operation.name", operation),
+				attribute.String("db.query.text", strings.TrimSpace(query)),
+			),
+		)
+	}
+	return ctx, func(err error) {
+		if db.observer != nil {
+			db.observer(operation, time.Since(begin))
+		}
+		if span != nil {
+			if err != nil && err != sql.ErrNoRows {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+			}
+			span.End()
+		}
+	}
+}
+
+// observedTx ends the timing and span started by Begin when the transaction
+// commits or rolls back.
+type observedTx struct {
+	*sql.Tx
+	done  func(err error)
+	ended bool
+}
+
+func (tx *observedTx) Commit() error {
+	err := tx.Tx.Commit()
+	tx.end(err)
+	return err
+}
+
+func (tx *observedTx) Rollback() error {
+	err := tx.Tx.Rollback()
+	if err != sql.ErrTxDone {
+		tx.end(err)
+	}
+	return err
+}
+
+func (tx *observedTx) end(err error) {
+	if tx.ended {
+		return
+	}
+	tx.ended = true
+	tx.done(err)
+}
+
+// callerOperation names the function skip frames up the stack, e.g.
+// "GetUser" for Client.GetUser.
+func callerOperation(skip int) string {
+	pc, _, _, ok := runtime.Caller(skip)
+	if !ok {
+		return "unknown"
+	}
+	fn := runtime.FuncForPC(pc)
+	if fn == nil {
+		return "unknown"
+	}
+	name := fn.Name()
+	name = name[strings.LastIndex(name, "/")+1:]
+	name = strings.TrimPrefix(name, "database.")
+	name = strings.TrimPrefix(name, "Client.")
+	name = strings.TrimPrefix(name, "(*Client).")
+	name, _, _ = strings.Cut(name, ".")
+	return name
+}
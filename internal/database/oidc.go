@@ -0,0 +1,165 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// OIDCLogin is an OpenID Connect login in progress, from the redirect to
+// the provider until its callback. Only the state's hash is stored.
+type OIDCLogin struct {
+	StateHash    string
+	Nonce        string
+	CodeVerifier string
+	ExpiresAt    time.Time
+}
+
+// UserIdentity links an account at an external identity provider to a user.
+type UserIdentity struct {
+	Issuer    string    `json:"issuer"`
+	Subject   string    `json:"subject"`
+	UserID    uuid.UUID `json:"-"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (c Client) CreateOIDCLogin(login OIDCLogin) error {
+	// Abandoned logins would otherwise pile up.
+	_, err := c.db.Exec("DELETE FROM oidc_logins WHERE expires_at <= ?", time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec(`
+	INSERT INTO oidc_logins (state_hash, nonce, code_verifier, expires_at)
+	VALUES (?, ?, ?, ?)
+	`, login.StateHash, login.Nonce, login.CodeVerifier, login.ExpiresAt)
+	return err
+}
+
+// ConsumeOIDCLogin deletes an unexpired login and returns it, so each state
+// can only be used once. It returns a zero OIDCLogin if there is none.
+func (c Client) ConsumeOIDCLogin(stateHash string) (OIDCLogin, error) {
+	query := `
+	DELETE FROM oidc_logins
+	WHERE state_hash = ? AND expires_at > ?
+	RETURNING state_hash, nonce, code_verifier, expires_at
+	`
+	var login OIDCLogin
+	err := c.db.QueryRow(query, stateHash, time.Now().UTC()).Scan(
+		&login.StateHash,
+		&login.Nonce,
+		&login.CodeVerifier,
+		&login.ExpiresAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return OIDCLogin{}, nil
+	}
+	if err != nil {
+		return OIDCLogin{}, err
+	}
+	return login, nil
+}
+
+// GetUserIdentity returns the identity for issuer and subject, or a zero
+// UserIdentity if it isn't linked to a user.
+func (c Client) GetUserIdentity(issuer, subject string) (UserIdentity, error) {
+	query := `
+	SELECT issuer, subject, user_id, email, created_at
+	FROM user_identities
+	WHERE issuer = ? AND subject = ?
+	`
+	identity, err := scanUserIdentity(c.db.QueryRow(query, issuer, subject))
+	if errors.Is(err, sql.ErrNoRows) {
+		return UserIdentity{}, nil
+	}
+	return identity, err
+}
+
+func (c Client) GetUserIdentities(userID uuid.UUID) ([]UserIdentity, error) {
+	query := `
+	SELECT issuer, subject, user_id, email, created_at
+	FROM user_identities
+	WHERE user_id = ?
+	ORDER BY created_at
+	`
+	rows, err := c.db.Query(query, userID.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	identities := []UserIdentity{}
+	for rows.Next() {
+		identity, err := scanUserIdentity(rows)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, identity)
+	}
+	return identities, rows.Err()
+}
+
+func (c Client) CreateUserIdentity(identity UserIdentity) error {
+	_, err := c.db.Exec(`
+	INSERT INTO user_identities (issuer, subject, user_id, email, created_at)
+	VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)
+	`, identity.Issuer, identity.Subject, identity.UserID.String(), identity.Email)
+	return err
+}
+
+// CreateOIDCUser creates a user without a password for a new identity and
+// links the identity to it. The identity provider has to have verified the
+// identity's email.
+func (c Client) CreateOIDCUser(identity UserIdentity) (*User, error) {
+	id := uuid.New()
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+	INSERT INTO users (id, created_at, updated_at, email, password, email_verified_at)
+	VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, '', CURRENT_TIMESTAMP)
+	`, id.String(), identity.Email)
+	if err != nil {
+		return nil, emailError(err)
+	}
+	_, err = tx.Exec(`
+	INSERT INTO user_identities (issuer, subject, user_id, email, created_at)
+	VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)
+	`, identity.Issuer, identity.Subject, id.String(), identity.Email)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return c.GetUser(id)
+}
+
+func scanUserIdentity(row rowScanner) (UserIdentity, error) {
+	var identity UserIdentity
+	var userID string
+	err := row.Scan(
+		&identity.Issuer,
+		&identity.Subject,
+		&userID,
+		&identity.Email,
+		&identity.CreatedAt,
+	)
+	if err != nil {
+		return UserIdentity{}, err
+	}
+	identity.UserID, err = uuid.Parse(userID)
+	if err != nil {
+		return UserIdentity{}, err
+	}
+	return identity, nil
+}
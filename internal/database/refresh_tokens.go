@@ -2,22 +2,34 @@ package database
 
 import (
 	"database/sql"
+	"errors"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+// ErrRefreshTokenReused is returned when rotating a token that has already
+// been revoked or rotated.
+var ErrRefreshTokenReused = errors.New("refresh token already used")
+
 type RefreshToken struct {
 	CreateRefreshTokenParams
-	CreatedAt time.Time  `json:"created_at"`
-	UpdatedAt time.Time  `json:"updated_at"`
-	RevokedAt *time.Time `json:"revoked_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	ReplacedBy *string    `json:"replaced_by"`
 }
 
+// CreateRefreshTokenParams describes a refresh token. All tokens obtained by
+// rotating the one issued at login share its FamilyID.
 type CreateRefreshTokenParams struct {
 	Token     string    `json:"token"`
 	UserID    uuid.UUID `json:"user_id"`
+	FamilyID  string    `json:"family_id"`
 	ExpiresAt time.Time `json:"expires_at"`
+	UserAgent string    `json:"user_agent"`
+	IP        string    `json:"ip"`
 }
 
 func (c Client) CreateRefreshToken(params CreateRefreshTokenParams) (RefreshToken, error) {
@@ -26,38 +38,95 @@ func (c Client) CreateRefreshToken(params CreateRefreshTokenParams) (RefreshToke
 			token,
 			created_at,
 			updated_at,
+			last_used_at,
+			user_id,
+			family_id,
+			expires_at,
+			user_agent,
+			ip
+		) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query, params.Token, params.UserID.String(), params.FamilyID, params.ExpiresAt, params.UserAgent, params.IP)
+	if err != nil {
+		return RefreshToken{}, err
+	}
+
+	return c.GetRefreshToken(params.Token)
+}
+
+// RotateRefreshToken revokes oldToken and creates its replacement in one
+// transaction. It fails with ErrRefreshTokenReused if oldToken was already
+// revoked, so concurrent refreshes with the same token can't both succeed.
+func (c Client) RotateRefreshToken(oldToken string, params CreateRefreshTokenParams) (RefreshToken, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	defer tx.Rollback()
+
+	revokeQuery := `
+		UPDATE refresh_tokens
+		SET revoked_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP, replaced_by = ?
+		WHERE token = ? AND revoked_at IS NULL
+	`
+	res, err := tx.Exec(revokeQuery, params.Token, oldToken)
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	if n == 0 {
+		return RefreshToken{}, ErrRefreshTokenReused
+	}
+
+	insertQuery := `
+		INSERT INTO refresh_tokens (
+			token,
+			created_at,
+			updated_at,
+			last_used_at,
 			user_id,
-			expires_at
-		) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?)
+			family_id,
+			expires_at,
+			user_agent,
+			ip
+		) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?)
 	`
-	_, err := c.db.Exec(query, params.Token, params.UserID.String(), params.ExpiresAt)
+	_, err = tx.Exec(insertQuery, params.Token, params.UserID.String(), params.FamilyID, params.ExpiresAt, params.UserAgent, params.IP)
 	if err != nil {
 		return RefreshToken{}, err
 	}
 
+	err = tx.Commit()
+	if err != nil {
+		return RefreshToken{}, err
+	}
 	return c.GetRefreshToken(params.Token)
 }
 
-func (c Client) RevokeRefreshToken(token string) error {
+// RevokeRefreshTokenFamily revokes every token descended from the same login.
+func (c Client) RevokeRefreshTokenFamily(familyID string) error {
 	query := `
 		UPDATE refresh_tokens
-		SET revoked_at = CURRENT_TIMESTAMP
-		WHERE token = ?
+		SET revoked_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+		WHERE family_id = ? AND revoked_at IS NULL
 	`
-	_, err := c.db.Exec(query, token)
+	_, err := c.db.Exec(query, familyID)
 	return err
 }
 
 func (c Client) GetRefreshToken(token string) (RefreshToken, error) {
 	query := `
-		SELECT token, created_at, updated_at, user_id, expires_at, revoked_at
+		SELECT token, created_at, updated_at, last_used_at, user_id, family_id, expires_at, user_agent, ip, revoked_at, replaced_by
 		FROM refresh_tokens
 		WHERE token = ?
 	`
 	var rt RefreshToken
 	var userID string
 	err := c.db.QueryRow(query, token).
-		Scan(&rt.Token, &rt.CreatedAt, &rt.UpdatedAt, &userID, &rt.ExpiresAt, &rt.RevokedAt)
+		Scan(&rt.Token, &rt.CreatedAt, &rt.UpdatedAt, &rt.LastUsedAt, &userID, &rt.FamilyID, &rt.ExpiresAt, &rt.UserAgent, &rt.IP, &rt.RevokedAt, &rt.ReplacedBy)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return RefreshToken{}, nil
@@ -72,12 +141,3 @@ func (c Client) GetRefreshToken(token string) (RefreshToken, error) {
 
 	return rt, nil
 }
-
-func (c Client) DeleteRefreshToken(token string) error {
-	query := `
-		DELETE FROM refresh_tokens
-		WHERE token = ?
-	`
-	_, err := c.db.Exec(query, token)
-	return err
-}
@@ -0,0 +1,118 @@
+package database
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Session is a login as seen by the user: a refresh token family that still
+// has a usable token. Its ID is the family ID.
+type Session struct {
+	ID         string    `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+}
+
+func (c Client) GetSessions(userID uuid.UUID) ([]Session, error) {
+	query := `
+	SELECT
+		rt.family_id,
+		(SELECT MIN(f.created_at) FROM refresh_tokens f WHERE f.family_id = rt.family_id),
+		rt.created_at,
+		rt.last_used_at,
+		rt.expires_at,
+		rt.user_agent,
+		rt.ip
+	FROM refresh_tokens rt
+	WHERE rt.user_id = ? AND rt.revoked_at IS NULL AND rt.expires_at > ?
+	ORDER BY COALESCE(rt.last_used_at, rt.created_at) DESC
+	`
+
+	rows, err := c.db.Query(query, userID.String(), time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var session Session
+		var startedAt string
+		var lastUsedAt *time.Time
+		if err := rows.Scan(
+			&session.ID,
+			&startedAt,
+			&session.LastUsedAt,
+			&lastUsedAt,
+			&session.ExpiresAt,
+			&session.UserAgent,
+			&session.IP,
+		); err != nil {
+			return nil, err
+		}
+		session.CreatedAt, err = parseTimestamp(startedAt)
+		if err != nil {
+			return nil, err
+		}
+		if lastUsedAt != nil {
+			session.LastUsedAt = *lastUsedAt
+		}
+		sessions = append(sessions, session)
+	}
+
+	return sessions, nil
+}
+
+// RevokeSession revokes one of the user's sessions. It reports false if the
+// user has no session with that ID.
+func (c Client) RevokeSession(userID uuid.UUID, sessionID string) (bool, error) {
+	query := `
+	UPDATE refresh_tokens
+	SET revoked_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+	WHERE user_id = ? AND family_id = ? AND revoked_at IS NULL
+	`
+	res, err := c.db.Exec(query, userID.String(), sessionID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// RevokeAllSessions logs the user out everywhere and returns the IDs of the
+// sessions it ended.
+func (c Client) RevokeAllSessions(userID uuid.UUID) ([]string, error) {
+	query := `
+	UPDATE refresh_tokens
+	SET revoked_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+	WHERE user_id = ? AND revoked_at IS NULL
+	RETURNING family_id
+	`
+	rows, err := c.db.Query(query, userID.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	seen := map[string]bool{}
+	sessionIDs := []string{}
+	for rows.Next() {
+		var familyID string
+		err := rows.Scan(&familyID)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[familyID] {
+			seen[familyID] = true
+			sessionIDs = append(sessionIDs, familyID)
+		}
+	}
+	return sessionIDs, rows.Err()
+}
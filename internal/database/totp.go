@@ -0,0 +1,173 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// SetPendingTOTPSecret starts enrollment with a new secret. Two-factor login
+// stays off until ConfirmTOTP.
+func (c Client) SetPendingTOTPSecret(userID uuid.UUID, secret string) error {
+	query := `
+	UPDATE users
+	SET totp_secret = ?, totp_enabled_at = NULL, totp_last_step = 0, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, secret, userID.String())
+	return err
+}
+
+// ConfirmTOTP turns on two-factor login and replaces the user's recovery
+// codes with codeHashes.
+func (c Client) ConfirmTOTP(userID uuid.UUID, step int64, codeHashes []string) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+	UPDATE users
+	SET totp_enabled_at = CURRENT_TIMESTAMP, totp_last_step = ?, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`, step, userID.String())
+	if err != nil {
+		return err
+	}
+	err = replaceRecoveryCodes(tx, userID, codeHashes)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SecondFactor is what a two-factor code spends: the time step of a TOTP
+// code, or else the hash of a recovery code.
+type SecondFactor struct {
+	TOTPStep         int64
+	RecoveryCodeHash string
+}
+
+// UseSecondFactor spends factor for the user. It reports false if the TOTP
+// step or a later one was already used, i.e. the code is a replay, or if
+// there is no such unused recovery code.
+func (c Client) UseSecondFactor(userID uuid.UUID, factor SecondFactor) (bool, error) {
+	return useSecondFactor(c.db, userID, factor)
+}
+
+// CompleteMFAChallenge consumes a two-factor login challenge and spends the
+// user's factor together, so neither is used up without the other. It
+// returns a zero UserToken if the challenge is invalid, and reports false,
+// spending nothing, if the factor can't be used.
+func (c Client) CompleteMFAChallenge(challengeHash string, factor SecondFactor) (UserToken, bool, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return UserToken{}, false, err
+	}
+	defer tx.Rollback()
+
+	challenge, err := scanUserToken(tx.QueryRow(consumeUserTokenQuery, challengeHash, TokenPurposeMFAChallenge, time.Now().UTC()))
+	if err != nil || challenge.TokenHash == "" {
+		return UserToken{}, false, err
+	}
+	ok, err := useSecondFactor(tx, challenge.UserID, factor)
+	if err != nil || !ok {
+		return challenge, false, err
+	}
+	return challenge, true, tx.Commit()
+}
+
+func useSecondFactor(tx execer, userID uuid.UUID, factor SecondFactor) (bool, error) {
+	var res sql.Result
+	var err error
+	if factor.RecoveryCodeHash == "" {
+		res, err = tx.Exec(`
+		UPDATE users
+		SET totp_last_step = ?
+		WHERE id = ? AND totp_last_step < ?
+		`, factor.TOTPStep, userID.String(), factor.TOTPStep)
+	} else {
+		res, err = tx.Exec(`
+		UPDATE recovery_codes
+		SET used_at = CURRENT_TIMESTAMP
+		WHERE user_id = ? AND code_hash = ? AND used_at IS NULL
+		`, userID.String(), factor.RecoveryCodeHash)
+	}
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (c Client) DisableTOTP(userID uuid.UUID) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+	UPDATE users
+	SET totp_secret = NULL, totp_enabled_at = NULL, totp_last_step = 0, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`, userID.String())
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID.String())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (c Client) ReplaceRecoveryCodes(userID uuid.UUID, codeHashes []string) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = replaceRecoveryCodes(tx, userID, codeHashes)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+func replaceRecoveryCodes(tx execer, userID uuid.UUID, codeHashes []string) error {
+	_, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID.String())
+	if err != nil {
+		return err
+	}
+	for _, hash := range codeHashes {
+		_, err = tx.Exec(`
+		INSERT INTO recovery_codes (user_id, code_hash, created_at)
+		VALUES (?, ?, CURRENT_TIMESTAMP)
+		`, userID.String(), hash)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CountRecoveryCodes returns how many unused recovery codes the user has.
+func (c Client) CountRecoveryCodes(userID uuid.UUID) (int, error) {
+	var n int
+	err := c.db.QueryRow(`
+	SELECT COUNT(*) FROM recovery_codes
+	WHERE user_id = ? AND used_at IS NULL
+	`, userID.String()).Scan(&n)
+	return n, err
+}
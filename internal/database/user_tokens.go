@@ -0,0 +1,114 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type TokenPurpose string
+
+const (
+	TokenPurposeEmailVerification TokenPurpose = "email_verification"
+	TokenPurposePasswordReset     TokenPurpose = "password_reset"
+	// TokenPurposeMFAChallenge tokens are handed out by the password step of
+	// a two-factor login and traded for a session by the code step.
+	TokenPurposeMFAChallenge TokenPurpose = "mfa_challenge"
+	// TokenPurposeOIDCLogin tokens hand a finished OpenID Connect login from
+	// the callback redirect to the web app.
+	TokenPurposeOIDCLogin TokenPurpose = "oidc_login"
+)
+
+// UserToken is a single-use token mailed to a user. Only its hash is stored.
+type UserToken struct {
+	CreatedAt time.Time
+	UsedAt    *time.Time
+	CreateUserTokenParams
+}
+
+type CreateUserTokenParams struct {
+	TokenHash string
+	UserID    uuid.UUID
+	Purpose   TokenPurpose
+	// Email the token was sent to.
+	Email     string
+	ExpiresAt time.Time
+}
+
+// CreateUserToken stores a new token and invalidates the user's earlier
+// unused tokens for the same purpose, so only the latest mail works.
+func (c Client) CreateUserToken(params CreateUserTokenParams) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+	DELETE FROM user_tokens
+	WHERE user_id = ? AND purpose = ? AND used_at IS NULL
+	`, params.UserID.String(), params.Purpose)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+	INSERT INTO user_tokens (token_hash, created_at, user_id, purpose, email, expires_at)
+	VALUES (?, CURRENT_TIMESTAMP, ?, ?, ?, ?)
+	`, params.TokenHash, params.UserID.String(), params.Purpose, params.Email, params.ExpiresAt)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetUserToken returns an unused, unexpired token without using it up. It
+// returns a zero UserToken if there is no such token.
+func (c Client) GetUserToken(tokenHash string, purpose TokenPurpose) (UserToken, error) {
+	query := `
+	SELECT token_hash, created_at, used_at, user_id, purpose, email, expires_at
+	FROM user_tokens
+	WHERE token_hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?
+	`
+	return scanUserToken(c.db.QueryRow(query, tokenHash, purpose, time.Now().UTC()))
+}
+
+// ConsumeUserToken marks an unused, unexpired token as used and returns it.
+// It returns a zero UserToken if there is no such token.
+func (c Client) ConsumeUserToken(tokenHash string, purpose TokenPurpose) (UserToken, error) {
+	return scanUserToken(c.db.QueryRow(consumeUserTokenQuery, tokenHash, purpose, time.Now().UTC()))
+}
+
+const consumeUserTokenQuery = `
+	UPDATE user_tokens
+	SET used_at = CURRENT_TIMESTAMP
+	WHERE token_hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?
+	RETURNING token_hash, created_at, used_at, user_id, purpose, email, expires_at
+	`
+
+func scanUserToken(row rowScanner) (UserToken, error) {
+	var token UserToken
+	var userID string
+	err := row.Scan(
+		&token.TokenHash,
+		&token.CreatedAt,
+		&token.UsedAt,
+		&userID,
+		&token.Purpose,
+		&token.Email,
+		&token.ExpiresAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return UserToken{}, nil
+	}
+	if err != nil {
+		return UserToken{}, err
+	}
+	token.UserID, err = uuid.Parse(userID)
+	if err != nil {
+		return UserToken{}, err
+	}
+	return token, nil
+}
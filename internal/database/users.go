@@ -6,26 +6,57 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/mattn/go-sqlite3"
 )
 
+var ErrEmailTaken = errors.New("email is already in use")
+
+type Role string
+
+const (
+	RoleUser      Role = "user"
+	RoleModerator Role = "moderator"
+	RoleAdmin     Role = "admin"
+)
+
+func (r Role) Valid() bool {
+	switch r {
+	case RoleUser, RoleModerator, RoleAdmin:
+		return true
+	}
+	return false
+}
+
 type User struct {
-	ID        uuid.UUID `json:"id"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID         uuid.UUID  `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	Plan       string     `json:"plan"`
+	Role       Role       `json:"role"`
+	DisabledAt *time.Time `json:"disabled_at"`
+	// EmailVerifiedAt is when the user proved they own Email.
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
+	// TOTPSecret is set once enrollment starts; two-factor login is only
+	// required after TOTPEnabledAt is set by confirming a code.
+	TOTPSecret    *string    `json:"-"`
+	TOTPEnabledAt *time.Time `json:"totp_enabled_at"`
+	TOTPLastStep  int64      `json:"-"`
 	CreateUserParams
 }
 
+// CreateUserParams holds the password hash, which is never sent to clients.
 type CreateUserParams struct {
 	Email    string `json:"email"`
-	Password string `json:"password"`
+	Password string `json:"-"`
 }
 
+const userColumns = "id, created_at, updated_at, email, password, plan, role, disabled_at, email_verified_at, totp_secret, totp_enabled_at, totp_last_step"
+
 func (c Client) GetUsers() ([]User, error) {
 	query := `
-		SELECT
-			id,
-			email
+		SELECT ` + userColumns + `
 		FROM users
+		ORDER BY created_at
 	`
 
 	rows, err := c.db.Query(query)
@@ -36,12 +67,7 @@ func (c Client) GetUsers() ([]User, error) {
 
 	users := []User{}
 	for rows.Next() {
-		var user User
-		var id string
-		if err := rows.Scan(&id, &user.Email); err != nil {
-			return nil, err
-		}
-		user.ID, err = uuid.Parse(id)
+		user, err := scanUser(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -53,51 +79,20 @@ func (c Client) GetUsers() ([]User, error) {
 
 func (c Client) GetUserByEmail(email string) (User, error) {
 	query := `
-		SELECT id, created_at, updated_at, email, password
+		SELECT ` + userColumns + `
 		FROM users
 		WHERE email = ?
 	`
-	var user User
-	var id string
-	err := c.db.QueryRow(query, email).Scan(&id, &user.CreatedAt, &user.UpdatedAt, &user.Email, &user.Password)
+	user, err := scanUser(c.db.QueryRow(query, email))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return User{}, nil
 		}
 		return User{}, err
 	}
-	user.ID, err = uuid.Parse(id)
-	if err != nil {
-		return User{}, err
-	}
 	return user, nil
 }
 
-func (c Client) GetUserByRefreshToken(token string) (*User, error) {
-	query := `
-		SELECT u.id, u.email, u.created_at, u.updated_at, u.password
-		FROM users u
-		JOIN refresh_tokens rt ON u.id = rt.user_id
-		WHERE rt.token = ?
-	`
-
-	var user User
-	var id string
-	err := c.db.QueryRow(query, token).Scan(&id, &user.Email, &user.CreatedAt, &user.UpdatedAt, &user.Password)
-	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil, nil
-		}
-		return nil, err
-	}
-	user.ID, err = uuid.Parse(id)
-	if err != nil {
-		return nil, err
-	}
-
-	return &user, nil
-}
-
 func (c Client) CreateUser(params CreateUserParams) (*User, error) {
 	id := uuid.New()
 
@@ -109,7 +104,7 @@ func (c Client) CreateUser(params CreateUserParams) (*User, error) {
 	`
 	_, err := c.db.Exec(query, id.String(), params.Email, params.Password)
 	if err != nil {
-		return nil, err
+		return nil, emailError(err)
 	}
 
 	return c.GetUser(id)
@@ -117,31 +112,153 @@ func (c Client) CreateUser(params CreateUserParams) (*User, error) {
 
 func (c Client) GetUser(id uuid.UUID) (*User, error) {
 	query := `
-		SELECT id, created_at, updated_at, email, password
+		SELECT ` + userColumns + `
 		FROM users
 		WHERE id = ?
 	`
-	var user User
-	var idStr string
-	err := c.db.QueryRow(query, id.String()).Scan(&idStr, &user.CreatedAt, &user.UpdatedAt, &user.Email, &user.Password)
+	user, err := scanUser(c.db.QueryRow(query, id.String()))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
 		}
 		return nil, err
 	}
-	user.ID, err = uuid.Parse(idStr)
-	if err != nil {
-		return nil, err
-	}
 	return &user, nil
 }
 
-func (c Client) DeleteUser(id uuid.UUID) error {
+func (c Client) UpdateUserPlan(id uuid.UUID, plan string) error {
+	query := `
+		UPDATE users
+		SET plan = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`
+	_, err := c.db.Exec(query, plan, id.String())
+	return err
+}
+
+func (c Client) UpdateUserRole(id uuid.UUID, role Role) error {
 	query := `
-		DELETE FROM users
+		UPDATE users
+		SET role = ?, updated_at = CURRENT_TIMESTAMP
 		WHERE id = ?
 	`
-	_, err := c.db.Exec(query, id.String())
+	_, err := c.db.Exec(query, role, id.String())
 	return err
 }
+
+// SetUserDisabled disables or re-enables an account.
+func (c Client) SetUserDisabled(id uuid.UUID, disabled bool) error {
+	query := `
+		UPDATE users
+		SET disabled_at = CASE WHEN ? THEN COALESCE(disabled_at, CURRENT_TIMESTAMP) END,
+			updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`
+	_, err := c.db.Exec(query, disabled, id.String())
+	return err
+}
+
+func (c Client) UpdateUserPassword(id uuid.UUID, password string) error {
+	query := `
+		UPDATE users
+		SET password = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`
+	_, err := c.db.Exec(query, password, id.String())
+	return err
+}
+
+// UpdateUserEmail changes the user's email, which then needs to be verified
+// again.
+func (c Client) UpdateUserEmail(id uuid.UUID, email string) error {
+	query := `
+		UPDATE users
+		SET email = ?, email_verified_at = NULL, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`
+	_, err := c.db.Exec(query, email, id.String())
+	return emailError(err)
+}
+
+// emailError turns a violation of the unique email constraint into
+// ErrEmailTaken.
+func emailError(err error) error {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+		return ErrEmailTaken
+	}
+	return err
+}
+
+// MarkEmailVerified records that the user owns email, unless their address
+// has changed since the verification mail was sent.
+func (c Client) MarkEmailVerified(id uuid.UUID, email string) (bool, error) {
+	query := `
+		UPDATE users
+		SET email_verified_at = COALESCE(email_verified_at, CURRENT_TIMESTAMP), updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND email = ?
+	`
+	res, err := c.db.Exec(query, id.String(), email)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// DeleteUser deletes the user with their videos, sessions, API keys, mailed
+// tokens and linked identities. Releasing the videos' files is up to the
+// caller.
+func (c Client) DeleteUser(id uuid.UUID) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, query := range []string{
+		"DELETE FROM refresh_tokens WHERE user_id = ?",
+		"DELETE FROM api_keys WHERE user_id = ?",
+		"DELETE FROM user_tokens WHERE user_id = ?",
+		"DELETE FROM recovery_codes WHERE user_id = ?",
+		"DELETE FROM user_identities WHERE user_id = ?",
+		"DELETE FROM videos WHERE user_id = ?",
+		"DELETE FROM users WHERE id = ?",
+	} {
+		_, err = tx.Exec(query, id.String())
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func scanUser(row rowScanner) (User, error) {
+	var user User
+	var id string
+	err := row.Scan(
+		&id,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+		&user.Email,
+		&user.Password,
+		&user.Plan,
+		&user.Role,
+		&user.DisabledAt,
+		&user.EmailVerifiedAt,
+		&user.TOTPSecret,
+		&user.TOTPEnabledAt,
+		&user.TOTPLastStep,
+	)
+	if err != nil {
+		return User{}, err
+	}
+	user.ID, err = uuid.Parse(id)
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
@@ -8,19 +8,33 @@ import (
 	"github.com/google/uuid"
 )
 
+type Visibility string
+
+const (
+	VisibilityPublic  Visibility = "public"
+	VisibilityPrivate Visibility = "private"
+)
+
 type Video struct {
-	ID           uuid.UUID `json:"id"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
-	ThumbnailURL *string   `json:"thumbnail_url"`
-	VideoURL     *string   `json:"video_url"`
+	ID             uuid.UUID `json:"id"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+	ThumbnailURL   *string   `json:"thumbnail_url"`
+	ThumbnailKey   *string   `json:"-"`
+	ThumbnailSize  int64     `json:"thumbnail_size"`
+	VideoURL       *string   `json:"video_url"`
+	VideoKey       *string   `json:"-"`
+	VideoSize      int64     `json:"video_size"`
+	ContentHash    *string   `json:"-"`
+	ChecksumSHA256 *string   `json:"checksum_sha256"`
 	CreateVideoParams
 }
 
 type CreateVideoParams struct {
-	Title       string    `json:"title"`
-	Description string    `json:"description"`
-	UserID      uuid.UUID `json:"user_id"`
+	Title       string     `json:"title"`
+	Description string     `json:"description"`
+	Visibility  Visibility `json:"visibility"`
+	UserID      uuid.UUID  `json:"user_id"`
 }
 
 func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
@@ -32,7 +46,14 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 		title,
 		description,
 		thumbnail_url,
+		thumbnail_key,
+		thumbnail_size,
 		video_url,
+		video_key,
+		video_size,
+		content_hash,
+		checksum_sha256,
+		visibility,
 		user_id
 	FROM videos
 	WHERE user_id = ?
@@ -55,7 +76,71 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 			&video.Title,
 			&video.Description,
 			&video.ThumbnailURL,
+			&video.ThumbnailKey,
+			&video.ThumbnailSize,
 			&video.VideoURL,
+			&video.VideoKey,
+			&video.VideoSize,
+			&video.ContentHash,
+			&video.ChecksumSHA256,
+			&video.Visibility,
+			&video.UserID,
+		); err != nil {
+			return nil, err
+		}
+		videos = append(videos, video)
+	}
+
+	return videos, nil
+}
+
+// GetAllVideos returns every video of every user.
+func (c Client) GetAllVideos() ([]Video, error) {
+	query := `
+	SELECT
+		id,
+		created_at,
+		updated_at,
+		title,
+		description,
+		thumbnail_url,
+		thumbnail_key,
+		thumbnail_size,
+		video_url,
+		video_key,
+		video_size,
+		content_hash,
+		checksum_sha256,
+		visibility,
+		user_id
+	FROM videos
+	ORDER BY created_at
+	`
+
+	rows, err := c.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	videos := []Video{}
+	for rows.Next() {
+		var video Video
+		if err := rows.Scan(
+			&video.ID,
+			&video.CreatedAt,
+			&video.UpdatedAt,
+			&video.Title,
+			&video.Description,
+			&video.ThumbnailURL,
+			&video.ThumbnailKey,
+			&video.ThumbnailSize,
+			&video.VideoURL,
+			&video.VideoKey,
+			&video.VideoSize,
+			&video.ContentHash,
+			&video.ChecksumSHA256,
+			&video.Visibility,
 			&video.UserID,
 		); err != nil {
 			return nil, err
@@ -75,10 +160,14 @@ func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 		updated_at,
 		title,
 		description,
+		visibility,
 		user_id
-	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?)
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?)
 	`
-	_, err := c.db.Exec(query, id, params.Title, params.Description, params.UserID)
+	if params.Visibility == "" {
+		params.Visibility = VisibilityPublic
+	}
+	_, err := c.db.Exec(query, id, params.Title, params.Description, params.Visibility, params.UserID)
 	if err != nil {
 		return Video{}, err
 	}
@@ -95,7 +184,14 @@ func (c Client) GetVideo(id uuid.UUID) (Video, error) {
 		title,
 		description,
 		thumbnail_url,
+		thumbnail_key,
+		thumbnail_size,
 		video_url,
+		video_key,
+		video_size,
+		content_hash,
+		checksum_sha256,
+		visibility,
 		user_id
 	FROM videos
 	WHERE id = ?
@@ -109,7 +205,14 @@ func (c Client) GetVideo(id uuid.UUID) (Video, error) {
 		&video.Title,
 		&video.Description,
 		&video.ThumbnailURL,
+		&video.ThumbnailKey,
+		&video.ThumbnailSize,
 		&video.VideoURL,
+		&video.VideoKey,
+		&video.VideoSize,
+		&video.ContentHash,
+		&video.ChecksumSHA256,
+		&video.Visibility,
 		&video.UserID)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
@@ -121,35 +224,196 @@ func (c Client) GetVideo(id uuid.UUID) (Video, error) {
 	return video, nil
 }
 
-func (c Client) UpdateVideo(video Video) error {
+// ErrQuotaExceeded means a change would take a user's videos over the
+// storage limit of their plan.
+var ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+// UpdateVideo saves a video's metadata and thumbnail. The video's file is
+// changed with UpdateVideoFile only. It fails with ErrQuotaExceeded, and
+// changes nothing, if the owner's videos would then take more than
+// maxStorageBytes.
+func (c Client) UpdateVideo(video Video, maxStorageBytes int64) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
 	query := `
 	UPDATE videos
 	SET
+		updated_at = CURRENT_TIMESTAMP,
 		title = ?,
 		description = ?,
 		thumbnail_url = ?,
-		video_url = ?,
+		thumbnail_key = ?,
+		thumbnail_size = ?,
+		visibility = ?,
 		user_id = ?
 	WHERE id = ?
 	`
-
-	_, err := c.db.Exec(
+	_, err = tx.Exec(
 		query,
 		video.Title,
 		video.Description,
 		&video.ThumbnailURL,
-		&video.VideoURL,
+		&video.ThumbnailKey,
+		&video.ThumbnailSize,
+		video.Visibility,
 		video.UserID,
 		video.ID,
 	)
-	return err
+	if err != nil {
+		return err
+	}
+	err = checkStorageQuota(tx, video.UserID, maxStorageBytes)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UpdateVideoFile points a video at a new stored file, but only if it still
+// has the file of previous. It returns false if another upload or a delete
+// got there first, in which case the caller still owns its reference on the
+// new file and previous's file mustn't be released. Like UpdateVideo, it
+// fails with ErrQuotaExceeded if the owner would store more than
+// maxStorageBytes.
+func (c Client) UpdateVideoFile(video, previous Video, maxStorageBytes int64) (bool, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	query := `
+	UPDATE videos
+	SET
+		updated_at = CURRENT_TIMESTAMP,
+		video_url = ?,
+		video_key = ?,
+		video_size = ?,
+		content_hash = ?,
+		checksum_sha256 = ?
+	WHERE id = ? AND content_hash IS ? AND video_key IS ?
+	`
+	result, err := tx.Exec(
+		query,
+		video.VideoURL,
+		video.VideoKey,
+		video.VideoSize,
+		video.ContentHash,
+		video.ChecksumSHA256,
+		video.ID,
+		previous.ContentHash,
+		previous.VideoKey,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if n != 1 {
+		return false, nil
+	}
+	err = checkStorageQuota(tx, video.UserID, maxStorageBytes)
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
 }
 
-func (c Client) DeleteVideo(id uuid.UUID) error {
+// checkStorageQuota returns ErrQuotaExceeded if the user's videos take more
+// than maxBytes. Called after a write in the same transaction, it sees the
+// uploads of concurrent requests, which SQLite has serialized with it.
+func checkStorageQuota(tx *observedTx, userID uuid.UUID, maxBytes int64) error {
+	var used int64
+	err := tx.QueryRow(`
+	SELECT COALESCE(SUM(video_size + thumbnail_size), 0)
+	FROM videos
+	WHERE user_id = ?
+	`, userID).Scan(&used)
+	if err != nil {
+		return err
+	}
+	if used > maxBytes {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// DeleteVideo deletes a video and returns it as it was when deleted, so the
+// caller releases the files it had then. It returns a zero Video if there
+// was none, e.g. because a concurrent request deleted it first.
+func (c Client) DeleteVideo(id uuid.UUID) (Video, error) {
 	query := `
 	DELETE FROM videos
 	WHERE id = ?
+	RETURNING
+		id,
+		created_at,
+		updated_at,
+		title,
+		description,
+		thumbnail_url,
+		thumbnail_key,
+		thumbnail_size,
+		video_url,
+		video_key,
+		video_size,
+		content_hash,
+		checksum_sha256,
+		visibility,
+		user_id
 	`
-	_, err := c.db.Exec(query, id)
-	return err
+
+	var video Video
+	err := c.db.QueryRow(query, id).Scan(
+		&video.ID,
+		&video.CreatedAt,
+		&video.UpdatedAt,
+		&video.Title,
+		&video.Description,
+		&video.ThumbnailURL,
+		&video.ThumbnailKey,
+		&video.ThumbnailSize,
+		&video.VideoURL,
+		&video.VideoKey,
+		&video.VideoSize,
+		&video.ContentHash,
+		&video.ChecksumSHA256,
+		&video.Visibility,
+		&video.UserID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Video{}, nil
+		}
+		return Video{}, err
+	}
+	return video, nil
+}
+
+// Usage is what a user currently stores, counted per video even when
+// identical uploads share one object.
+type Usage struct {
+	Bytes  int64 `json:"bytes"`
+	Videos int   `json:"videos"`
+}
+
+func (c Client) GetUserUsage(userID uuid.UUID) (Usage, error) {
+	query := `
+	SELECT
+		COALESCE(SUM(video_size + thumbnail_size), 0),
+		COUNT(*)
+	FROM videos
+	WHERE user_id = ?
+	`
+	var usage Usage
+	err := c.db.QueryRow(query, userID).Scan(&usage.Bytes, &usage.Videos)
+	if err != nil {
+		return Usage{}, err
+	}
+	return usage, nil
 }
@@ -0,0 +1,566 @@
+// Command genclient generates the types and methods of the Go client package
+// from the OpenAPI document. It understands the subset of OpenAPI 3.1 the
+// document uses; anything else is an error rather than a silently wrong
+// client.
+//
+//	go run ./internal/genclient -spec openapi.json -out client/client_gen.go
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/format"
+	"log"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+type document struct {
+	Paths      map[string]map[string]*operation `json:"paths"`
+	Components struct {
+		Schemas    map[string]*schema    `json:"schemas"`
+		Parameters map[string]*parameter `json:"parameters"`
+		Responses  map[string]*response  `json:"responses"`
+	} `json:"components"`
+}
+
+type operation struct {
+	OperationID string                `json:"operationId"`
+	Summary     string                `json:"summary"`
+	Parameters  []*parameter          `json:"parameters"`
+	RequestBody *requestBody          `json:"requestBody"`
+	Responses   map[string]*response  `json:"responses"`
+	Security    []map[string][]string `json:"security"`
+}
+
+type parameter struct {
+	Ref         string  `json:"$ref"`
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description"`
+	Required    bool    `json:"required"`
+	Schema      *schema `json:"schema"`
+}
+
+type requestBody struct {
+	Content map[string]mediaType `json:"content"`
+}
+
+type response struct {
+	Ref     string               `json:"$ref"`
+	Content map[string]mediaType `json:"content"`
+}
+
+type mediaType struct {
+	Schema *schema `json:"schema"`
+}
+
+type schema struct {
+	Ref                  string     `json:"$ref"`
+	Description          string     `json:"description"`
+	Type                 schemaType `json:"type"`
+	Format               string     `json:"format"`
+	Enum                 []string   `json:"enum"`
+	Properties           properties `json:"properties"`
+	Required             []string   `json:"required"`
+	Items                *schema    `json:"items"`
+	AdditionalProperties *schema    `json:"additionalProperties"`
+	AllOf                []*schema  `json:"allOf"`
+	OneOf                []*schema  `json:"oneOf"`
+}
+
+// properties are the properties of an object schema, in the order the
+// document lists them so that struct fields come out in that order too.
+type properties []property
+
+type property struct {
+	name   string
+	schema *schema
+}
+
+func (ps *properties) UnmarshalJSON(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != json.Delim('{') {
+		return fmt.Errorf("properties must be an object, got %s", data)
+	}
+	*ps = properties{}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		p := property{name: tok.(string)}
+		err = dec.Decode(&p.schema)
+		if err != nil {
+			return err
+		}
+		*ps = append(*ps, p)
+	}
+	return nil
+}
+
+// schemaType is a schema's type, which OpenAPI 3.1 allows to be a list so
+// that ["string", "null"] can mark a nullable string.
+type schemaType struct {
+	Name     string
+	Nullable bool
+}
+
+func (t *schemaType) UnmarshalJSON(data []byte) error {
+	var names []string
+	if err := json.Unmarshal(data, &names); err != nil {
+		var name string
+		if err := json.Unmarshal(data, &name); err != nil {
+			return err
+		}
+		names = []string{name}
+	}
+	for _, name := range names {
+		if name == "null" {
+			t.Nullable = true
+			continue
+		}
+		if t.Name != "" {
+			return fmt.Errorf("unsupported type list %s", data)
+		}
+		t.Name = name
+	}
+	return nil
+}
+
+func main() {
+	specPath := flag.String("spec", "openapi.json", "OpenAPI document")
+	outPath := flag.String("out", "client_gen.go", "file to write")
+	pkg := flag.String("package", "client", "package name of the generated file")
+	flag.Parse()
+
+	data, err := os.ReadFile(*specPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var doc document
+	err = json.Unmarshal(data, &doc)
+	if err != nil {
+		log.Fatalf("couldn't parse %s: %v", *specPath, err)
+	}
+
+	g := generator{doc: &doc}
+	for _, name := range sortedKeys(doc.Components.Schemas) {
+		g.namedType(name, doc.Components.Schemas[name])
+	}
+	for _, path := range sortedKeys(doc.Paths) {
+		for _, method := range []string{"get", "put", "post", "delete", "patch"} {
+			if op := doc.Paths[path][method]; op != nil {
+				g.method(path, strings.ToUpper(method), op)
+			}
+		}
+	}
+	if g.err != nil {
+		log.Fatal(g.err)
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "// Code generated by genclient from %s. DO NOT EDIT.\n\n", *specPath)
+	fmt.Fprintf(&out, "package %s\n\n", *pkg)
+	out.WriteString("import (\n")
+	for _, imp := range imports {
+		if bytes.Contains(g.buf.Bytes(), []byte(imp.use)) {
+			if strings.Contains(imp.path, ".") {
+				out.WriteString("\n")
+			}
+			fmt.Fprintf(&out, "%q\n", imp.path)
+		}
+	}
+	out.WriteString(")\n\n")
+	out.Write(g.buf.Bytes())
+
+	src, err := format.Source(out.Bytes())
+	if err != nil {
+		log.Fatalf("couldn't format generated code: %v\n%s", err, out.Bytes())
+	}
+	err = os.WriteFile(*outPath, src, 0o644)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// imports are the packages generated code may use, with how to tell it does.
+var imports = []struct{ path, use string }{
+	{"context", "context."},
+	{"io", "io."},
+	{"net/url", "url."},
+	{"strconv", "strconv."},
+	{"time", "time."},
+	{"github.com/google/uuid", "uuid."},
+}
+
+type generator struct {
+	doc *document
+	buf bytes.Buffer
+	err error
+}
+
+func (g *generator) printf(format string, args ...any) {
+	fmt.Fprintf(&g.buf, format, args...)
+}
+
+func (g *generator) fail(format string, args ...any) {
+	if g.err == nil {
+		g.err = fmt.Errorf(format, args...)
+	}
+}
+
+// comment writes prefix+text as a comment wrapped like hand-written ones.
+func (g *generator) comment(prefix, text string) {
+	if text == "" {
+		return
+	}
+	line := "//"
+	for _, word := range strings.Fields(prefix + text) {
+		if len(line)+1+len(word) > 78 && line != "//" {
+			g.printf("%s\n", line)
+			line = "//"
+		}
+		line += " " + word
+	}
+	g.printf("%s\n", line)
+}
+
+// namedType declares the Go type of a component schema.
+func (g *generator) namedType(name string, s *schema) {
+	g.comment(name+" is ", lowerFirst(s.Description))
+	switch {
+	case s.Type.Name == "string" && len(s.Enum) > 0:
+		g.printf("type %s string\n\nconst (\n", name)
+		for _, value := range s.Enum {
+			g.printf("%s%s %s = %q\n", name, goName(value), name, value)
+		}
+		g.printf(")\n\n")
+	case len(s.OneOf) > 0:
+		// Exactly one of the embedded pointers is set after decoding,
+		// because the variants have no properties in common.
+		g.printf("type %s struct {\n", name)
+		for _, variant := range s.OneOf {
+			if variant.Ref == "" {
+				g.fail("%s: oneOf variants must be references", name)
+				continue
+			}
+			g.printf("*%s\n", refName(variant.Ref))
+		}
+		g.printf("}\n\n")
+	case len(s.AllOf) > 0:
+		g.printf("type %s struct {\n", name)
+		for _, part := range s.AllOf {
+			if part.Ref != "" {
+				g.printf("%s\n", refName(part.Ref))
+				continue
+			}
+			g.fields(name, part)
+		}
+		g.printf("}\n\n")
+	case s.Type.Name == "object" && s.Properties != nil:
+		g.printf("type %s struct {\n", name)
+		g.fields(name, s)
+		g.printf("}\n\n")
+	default:
+		g.fail("%s: unsupported schema", name)
+	}
+}
+
+func (g *generator) fields(typeName string, s *schema) {
+	for i, p := range s.Properties {
+		required := slices.Contains(s.Required, p.name)
+		tag := p.name
+		if !required {
+			tag += ",omitempty"
+		}
+		if p.schema.Description != "" {
+			if i > 0 {
+				g.printf("\n")
+			}
+			g.comment("", p.schema.Description)
+		}
+		g.printf("%s %s `json:%q`\n", goName(p.name), g.goType(typeName+"."+p.name, p.schema, !required), tag)
+	}
+}
+
+// goType returns the Go type of a schema. Nullable and optional values are
+// pointers, except for slices and maps, whose nil already means absent.
+func (g *generator) goType(where string, s *schema, optional bool) string {
+	if s.Ref != "" {
+		name := refName(s.Ref)
+		target := g.doc.Components.Schemas[name]
+		if target == nil {
+			g.fail("%s: unknown schema %s", where, s.Ref)
+			return "any"
+		}
+		if optional {
+			return "*" + name
+		}
+		return name
+	}
+
+	var t string
+	switch s.Type.Name {
+	case "string":
+		switch s.Format {
+		case "date-time":
+			t = "time.Time"
+		case "uuid":
+			t = "uuid.UUID"
+		default:
+			t = "string"
+		}
+	case "integer":
+		t = "int"
+		if s.Format == "int64" {
+			t = "int64"
+		}
+	case "number":
+		t = "float64"
+	case "boolean":
+		t = "bool"
+	case "array":
+		if s.Items == nil {
+			g.fail("%s: array without items", where)
+			return "any"
+		}
+		return "[]" + g.goType(where+"[]", s.Items, false)
+	case "object":
+		if s.AdditionalProperties != nil {
+			return "map[string]" + g.goType(where+"{}", s.AdditionalProperties, false)
+		}
+		if s.Properties == nil {
+			return "map[string]any"
+		}
+		g.fail("%s: inline objects must be component schemas", where)
+		return "any"
+	default:
+		g.fail("%s: unsupported type %q", where, s.Type.Name)
+		return "any"
+	}
+	if optional || s.Type.Nullable {
+		return "*" + t
+	}
+	return t
+}
+
+// method generates the Client method of an operation. Operations without a
+// successful response, like browser redirects, have none.
+func (g *generator) method(path, httpMethod string, op *operation) {
+	name := upperFirst(op.OperationID)
+	status, result := g.successResponse(op)
+	if status == "" {
+		return
+	}
+
+	var (
+		params     []string
+		pathExpr   = fmt.Sprintf("%q", path)
+		queryParam []*parameter
+		reqFields  []string
+	)
+	params = append(params, "ctx context.Context")
+	for _, p := range op.Parameters {
+		p = g.resolveParameter(p)
+		switch p.In {
+		case "path":
+			arg := lowerFirst(goName(p.Name))
+			t := g.goType(op.OperationID+"."+p.Name, p.Schema, false)
+			params = append(params, arg+" "+t)
+			value := arg
+			if t != "string" {
+				value += ".String()"
+			}
+			pathExpr = strings.Replace(pathExpr, "{"+p.Name+"}", `"+url.PathEscape(`+value+`)+"`, 1)
+		case "query":
+			queryParam = append(queryParam, p)
+		default:
+			g.fail("%s: unsupported %s parameter %s", op.OperationID, p.In, p.Name)
+		}
+	}
+	pathExpr = strings.TrimSuffix(pathExpr, `+""`)
+	reqFields = append(reqFields, fmt.Sprintf("method: %q", httpMethod), "path: "+pathExpr)
+
+	if len(queryParam) > 0 {
+		paramsType := name + "Params"
+		g.comment(paramsType+" ", fmt.Sprintf("are the optional query parameters of %s. Zero values are left out.", name))
+		g.printf("type %s struct {\n", paramsType)
+		for _, p := range queryParam {
+			g.comment("", p.Description)
+			g.printf("%s %s\n", goName(p.Name), g.goType(op.OperationID+"."+p.Name, p.Schema, false))
+		}
+		g.printf("}\n\n")
+		params = append(params, "params "+paramsType)
+	}
+
+	for _, sec := range op.Security {
+		if _, ok := sec["refreshToken"]; ok {
+			params = append(params, "refreshToken string")
+			reqFields = append(reqFields, `authorization: "Bearer " + refreshToken`)
+		}
+	}
+
+	if op.RequestBody != nil {
+		if mt, ok := op.RequestBody.Content["application/json"]; ok {
+			params = append(params, "body "+g.goType(op.OperationID+".body", mt.Schema, false))
+			reqFields = append(reqFields, "body: body")
+		} else if mt, ok := op.RequestBody.Content["multipart/form-data"]; ok {
+			if mt.Schema == nil || len(mt.Schema.Properties) != 1 {
+				g.fail("%s: multipart bodies must have exactly one file", op.OperationID)
+			}
+			for _, p := range mt.Schema.Properties {
+				params = append(params, "file File")
+				reqFields = append(reqFields, fmt.Sprintf("file: &file, fileField: %q", p.name))
+			}
+		} else {
+			g.fail("%s: unsupported request body", op.OperationID)
+		}
+	}
+
+	g.comment(name+" ", lowerFirst(op.Summary))
+	g.printf("func (c *Client) %s(%s) ", name, strings.Join(params, ", "))
+	req := "request{" + strings.Join(reqFields, ", ") + "}"
+	queryPrelude := func() {
+		if len(queryParam) == 0 {
+			return
+		}
+		g.printf("query := url.Values{}\n")
+		for _, p := range queryParam {
+			field := "params." + goName(p.Name)
+			switch g.goType("", p.Schema, false) {
+			case "int":
+				g.printf("if %s != 0 {\nquery.Set(%q, strconv.Itoa(%s))\n}\n", field, p.Name, field)
+			case "string":
+				g.printf("if %s != \"\" {\nquery.Set(%q, %s)\n}\n", field, p.Name, field)
+			default:
+				g.fail("%s: unsupported query parameter %s", op.OperationID, p.Name)
+			}
+		}
+		req = strings.TrimSuffix(req, "}") + ", query: query}"
+	}
+
+	switch {
+	case result == "":
+		g.printf("error {\n")
+		queryPrelude()
+		g.printf("return c.do(ctx, %s, nil)\n}\n\n", req)
+	case strings.HasPrefix(result, "[]") || strings.HasPrefix(result, "map[") || result == "string" || result == "io.ReadCloser":
+		g.printf("(%s, error) {\n", result)
+		queryPrelude()
+		g.printf("var out %s\nerr := c.do(ctx, %s, &out)\nreturn out, err\n}\n\n", result, req)
+	default:
+		g.printf("(*%s, error) {\n", result)
+		queryPrelude()
+		g.printf("var out %s\nerr := c.do(ctx, %s, &out)\nif err != nil {\nreturn nil, err\n}\nreturn &out, nil\n}\n\n", result, req)
+	}
+}
+
+// successResponse returns the first 2xx status of an operation and the Go
+// type of its body: empty for no body, string for text and io.ReadCloser for
+// other media the caller streams.
+func (g *generator) successResponse(op *operation) (string, string) {
+	for _, status := range sortedKeys(op.Responses) {
+		if !strings.HasPrefix(status, "2") {
+			continue
+		}
+		resp := op.Responses[status]
+		if resp.Ref != "" {
+			resp = g.doc.Components.Responses[refName(resp.Ref)]
+		}
+		if len(resp.Content) == 0 {
+			return status, ""
+		}
+		if mt, ok := resp.Content["application/json"]; ok {
+			return status, g.goType(op.OperationID+".response", mt.Schema, false)
+		}
+		if _, ok := resp.Content["text/plain"]; ok {
+			return status, "string"
+		}
+		return status, "io.ReadCloser"
+	}
+	return "", ""
+}
+
+func (g *generator) resolveParameter(p *parameter) *parameter {
+	if p.Ref == "" {
+		return p
+	}
+	resolved := g.doc.Components.Parameters[refName(p.Ref)]
+	if resolved == nil {
+		g.fail("unknown parameter %s", p.Ref)
+		return &parameter{Schema: &schema{}}
+	}
+	return resolved
+}
+
+func refName(ref string) string {
+	return ref[strings.LastIndex(ref, "/")+1:]
+}
+
+// initialisms are spelled in capitals in Go names.
+var initialisms = map[string]string{
+	"api":    "API",
+	"crc32c": "CRC32C",
+	"id":     "ID",
+	"ip":     "IP",
+	"jwk":    "JWK",
+	"jwks":   "JWKS",
+	"mfa":    "MFA",
+	"ms":     "MS",
+	"sha256": "SHA256",
+	"totp":   "TOTP",
+	"uri":    "URI",
+	"url":    "URL",
+}
+
+// goName turns a JSON name like checksum_sha256 or a camel case name like
+// videoID into an exported Go name.
+func goName(s string) string {
+	words := strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	var b strings.Builder
+	for _, word := range words {
+		if initialism, ok := initialisms[strings.ToLower(word)]; ok {
+			b.WriteString(initialism)
+			continue
+		}
+		b.WriteString(upperFirst(word))
+	}
+	return b.String()
+}
+
+func upperFirst(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+// lowerFirst lowercases the first letter of a sentence unless it starts an
+// acronym.
+func lowerFirst(s string) string {
+	if len(s) < 2 || unicode.IsUpper(rune(s[1])) {
+		return s
+	}
+	return strings.ToLower(s[:1]) + s[1:]
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
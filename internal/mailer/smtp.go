@@ -0,0 +1,111 @@
+package mailer
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"time"
+)
+
+// SMTPMailer sends mail through an SMTP relay, upgrading to TLS with
+// STARTTLS when the server offers it.
+type SMTPMailer struct {
+	addr string
+	host string
+	from string
+	// sender is the bare address of from, for the SMTP envelope.
+	sender string
+	auth   smtp.Auth
+}
+
+// NewSMTPMailer returns a mailer for the server at addr (host:port). The
+// username and password are optional.
+func NewSMTPMailer(addr, username, password, from string) (*SMTPMailer, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	sender, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil, err
+	}
+	m := &SMTPMailer{addr: addr, host: host, from: from, sender: sender.Address}
+	if username != "" {
+		m.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return m, nil
+}
+
+// Send delivers msg the way smtp.SendMail does, but gives up when ctx is
+// done instead of waiting on a slow relay.
+func (m *SMTPMailer) Send(ctx context.Context, msg Message) error {
+	dat, err := format(m.from, msg)
+	if err != nil {
+		return err
+	}
+
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", m.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	// Cancelling ctx unblocks whatever read or write is in progress.
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	err = m.deliver(conn, msg.To, dat)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func (m *SMTPMailer) deliver(conn net.Conn, to string, dat []byte) error {
+	c, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		err = c.StartTLS(&tls.Config{ServerName: m.host})
+		if err != nil {
+			return err
+		}
+	}
+	if m.auth != nil {
+		if ok, _ := c.Extension("AUTH"); ok {
+			err = c.Auth(m.auth)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = c.Mail(m.sender)
+	if err != nil {
+		return err
+	}
+	err = c.Rcpt(to)
+	if err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(dat)
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	return c.Quit()
+}
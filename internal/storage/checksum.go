@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// Checksums are base64 encoded, the same representation S3 uses in its
+// x-amz-checksum-* headers.
+type Checksums struct {
+	SHA256 string
+}
+
+// ComputeChecksums reads r to the end and returns its checksums.
+func ComputeChecksums(r io.Reader) (Checksums, error) {
+	sha := sha256.New()
+	_, err := io.Copy(sha, r)
+	if err != nil {
+		return Checksums{}, err
+	}
+	return Checksums{
+		SHA256: base64.StdEncoding.EncodeToString(sha.Sum(nil)),
+	}, nil
+}
+
+// Verify compares the checksums computed for an object with the expected
+// ones. Empty expected values are not checked.
+func (c Checksums) Verify(expected Checksums) error {
+	if expected.SHA256 != "" && c.SHA256 != expected.SHA256 {
+		return fmt.Errorf("%w: sha256 is %s, expected %s", ErrChecksumMismatch, c.SHA256, expected.SHA256)
+	}
+	return nil
+}
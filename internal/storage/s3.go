@@ -0,0 +1,182 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+type S3Store struct {
+	client *s3.Client
+	bucket string
+}
+
+func NewS3Store(client *s3.Client, bucket string) *S3Store {
+	return &S3Store{client: client, bucket: bucket}
+}
+
+func (s *S3Store) Put(ctx context.Context, key string, body io.Reader, opts PutOptions) error {
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		Body:        body,
+		ContentType: aws.String(opts.ContentType),
+	}
+	// S3 accepts a single checksum per request; it rejects the upload if the
+	// bytes it received don't match.
+	if opts.Checksums.SHA256 != "" {
+		input.ChecksumAlgorithm = types.ChecksumAlgorithmSha256
+		input.ChecksumSHA256 = aws.String(opts.Checksums.SHA256)
+	}
+
+	out, err := s.client.PutObject(ctx, input)
+	if err != nil {
+		return err
+	}
+
+	if opts.Checksums.SHA256 != "" && aws.ToString(out.ChecksumSHA256) != opts.Checksums.SHA256 {
+		err := fmt.Errorf("%w: S3 stored sha256 %s, expected %s",
+			ErrChecksumMismatch, aws.ToString(out.ChecksumSHA256), opts.Checksums.SHA256)
+		// A failed delete leaves the corrupted object behind, which the
+		// caller has to know about.
+		deleteErr := s.Delete(ctx, key)
+		if deleteErr != nil {
+			deleteErr = fmt.Errorf("couldn't delete corrupted object: %w", deleteErr)
+		}
+		return errors.Join(err, deleteErr)
+	}
+	return nil
+}
+
+func (s *S3Store) Open(ctx context.Context, key string) (*Object, error) {
+	head, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var notFound *types.NotFound
+		if errors.As(err, &notFound) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	obj := &Object{
+		Size:        aws.ToInt64(head.ContentLength),
+		ModTime:     aws.ToTime(head.LastModified),
+		ETag:        aws.ToString(head.ETag),
+		ContentType: aws.ToString(head.ContentType),
+	}
+	obj.ReadSeekCloser = &s3Reader{
+		ctx:    ctx,
+		client: s.client,
+		bucket: s.bucket,
+		key:    key,
+		etag:   obj.ETag,
+		size:   obj.Size,
+	}
+	return obj, nil
+}
+
+func (s *S3Store) Delete(ctx context.Context, key string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+func (s *S3Store) PresignGet(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	req, err := s3.NewPresignClient(s.client).PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}, s3.WithPresignExpires(ttl))
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
+
+// s3Reader issues a ranged GetObject starting at the current offset on the
+// first Read after a Seek, so only the requested bytes are fetched.
+type s3Reader struct {
+	ctx    context.Context
+	client *s3.Client
+	bucket string
+	key    string
+	etag   string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (r *s3Reader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		input := &s3.GetObjectInput{
+			Bucket: aws.String(r.bucket),
+			Key:    aws.String(r.key),
+			Range:  aws.String(fmt.Sprintf("bytes=%d-", r.offset)),
+		}
+		if r.etag != "" {
+			input.IfMatch = aws.String(r.etag)
+		}
+		out, err := r.client.GetObject(r.ctx, input)
+		if err != nil {
+			return 0, err
+		}
+		r.body = out.Body
+	}
+
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *s3Reader) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = r.offset + offset
+	case io.SeekEnd:
+		abs = r.size + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if abs < 0 {
+		return 0, errors.New("negative position")
+	}
+	if abs != r.offset && r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+	r.offset = abs
+	return abs, nil
+}
+
+func (r *s3Reader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
+
+// Check makes sure the bucket exists and our credentials can reach it.
+func (s *S3Store) Check(ctx context.Context) error {
+	_, err := s.client.HeadBucket(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(s.bucket),
+	})
+	return err
+}
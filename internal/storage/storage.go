@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+var ErrNotFound = errors.New("object not found")
+
+// Store is an object store that holds uploaded video files.
+type Store interface {
+	// Put stores body under key. When opts carries checksums the store
+	// verifies the received bytes against them and fails with
+	// ErrChecksumMismatch instead of keeping a corrupted object.
+	Put(ctx context.Context, key string, body io.Reader, opts PutOptions) error
+	Open(ctx context.Context, key string) (*Object, error)
+	Delete(ctx context.Context, key string) error
+	// Check reports whether the store can currently be reached and written
+	// to.
+	Check(ctx context.Context) error
+}
+
+type PutOptions struct {
+	ContentType string
+	Checksums   Checksums
+}
+
+// Object is an opened object. Reads are streamed from the backing store and
+// Seek does not transfer any data, so an Object can be handed directly to
+// http.ServeContent.
+type Object struct {
+	io.ReadSeekCloser
+	Size        int64
+	ModTime     time.Time
+	ETag        string
+	ContentType string
+}
+
+// Presigner is implemented by stores that can hand out temporary URLs that
+// read an object straight from the backing service.
+type Presigner interface {
+	PresignGet(ctx context.Context, key string, ttl time.Duration) (string, error)
+}
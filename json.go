@@ -2,30 +2,138 @@ package main
 
 import (
 	"encoding/json"
-	"log"
+	"log/slog"
 	"net/http"
 )
 
+// errorCode identifies the kind of an error response. Unlike the detail
+// message, codes are part of the API: clients may branch on them, so they
+// never change once published.
+type errorCode string
+
+const (
+	codeInvalidRequest       errorCode = "invalid_request"
+	codeMalformedBody        errorCode = "malformed_body"
+	codeValidationFailed     errorCode = "validation_failed"
+	codeInvalidID            errorCode = "invalid_id"
+	codeUnauthorized         errorCode = "unauthorized"
+	codeInvalidCredentials   errorCode = "invalid_credentials"
+	codeInvalidToken         errorCode = "invalid_token"
+	codeForbidden            errorCode = "forbidden"
+	codeAccountDisabled      errorCode = "account_disabled"
+	codeInsufficientScope    errorCode = "insufficient_scope"
+	codeNotFound             errorCode = "not_found"
+	codeConflict             errorCode = "conflict"
+	codeEmailTaken           errorCode = "email_taken"
+	codeQuotaExceeded        errorCode = "quota_exceeded"
+	codeUnsupportedMediaType errorCode = "unsupported_media_type"
+	codeInvalidMedia         errorCode = "invalid_media"
+	codeRateLimited          errorCode = "rate_limited"
+	codeInternal             errorCode = "internal_error"
+	codeUpstream             errorCode = "upstream_error"
+)
+
+// statusCodes is the code of errors that don't have a more specific one.
+var statusCodes = map[int]errorCode{
+	http.StatusBadRequest:            codeInvalidRequest,
+	http.StatusUnauthorized:          codeUnauthorized,
+	http.StatusForbidden:             codeForbidden,
+	http.StatusNotFound:              codeNotFound,
+	http.StatusConflict:              codeConflict,
+	http.StatusRequestEntityTooLarge: codeQuotaExceeded,
+	http.StatusUnsupportedMediaType:  codeUnsupportedMediaType,
+	http.StatusUnprocessableEntity:   codeValidationFailed,
+	http.StatusTooManyRequests:       codeRateLimited,
+	http.StatusBadGateway:            codeUpstream,
+}
+
+// problem is an RFC 7807 problem details object. Its type is always
+// about:blank, so its title is the status text; code says what went wrong.
+type problem struct {
+	Type   string    `json:"type"`
+	Title  string    `json:"title"`
+	Status int       `json:"status"`
+	Detail string    `json:"detail"`
+	Code   errorCode `json:"code"`
+	// RequestID lets users quote the failed request in a bug report.
+	RequestID string `json:"request_id,omitempty"`
+	// Errors lists the invalid fields of a validation_failed problem.
+	Errors []fieldError `json:"errors,omitempty"`
+}
+
+// fieldError is a problem with a single field of the request. Field is the
+// JSON name of the field, or the query parameter.
+type fieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// fieldErrors collects the problems of a request's fields so they can all
+// be reported at once.
+type fieldErrors []fieldError
+
+func (fe *fieldErrors) add(field, code, message string) {
+	*fe = append(*fe, fieldError{Field: field, Code: code, Message: message})
+}
+
 func respondWithError(w http.ResponseWriter, code int, msg string, err error) {
-	if err != nil {
-		log.Println(err)
+	errCode, ok := statusCodes[code]
+	if !ok {
+		errCode = codeInternal
 	}
-	if code > 499 {
-		log.Printf("Responding with 5XX error: %s", msg)
+	respondWithProblem(w, problem{Status: code, Code: errCode, Detail: msg}, err)
+}
+
+// respondWithErrorCode is respondWithError for errors clients need to tell
+// apart from others with the same status.
+func respondWithErrorCode(w http.ResponseWriter, code int, errCode errorCode, msg string, err error) {
+	respondWithProblem(w, problem{Status: code, Code: errCode, Detail: msg}, err)
+}
+
+// respondWithFieldErrors rejects a request whose fields are invalid. The
+// detail is the first field's message, for clients that show only one.
+func respondWithFieldErrors(w http.ResponseWriter, errs fieldErrors) {
+	respondWithProblem(w, problem{
+		Status: http.StatusUnprocessableEntity,
+		Code:   codeValidationFailed,
+		Detail: errs[0].Message,
+		Errors: errs,
+	}, nil)
+}
+
+func respondWithProblem(w http.ResponseWriter, p problem, err error) {
+	logger := responseLogger(w)
+	if p.Status > 499 {
+		logger.Error(p.Detail, slog.Int("status", p.Status), slog.String("code", string(p.Code)), slog.Any("err", err))
+	} else if err != nil {
+		logger.Info(p.Detail, slog.Int("status", p.Status), slog.String("code", string(p.Code)), slog.Any("err", err))
 	}
-	type errorResponse struct {
-		Error string `json:"error"`
+
+	p.Type = "about:blank"
+	p.Title = http.StatusText(p.Status)
+	if state := responseState(w); state != nil {
+		p.RequestID = state.id
+	}
+	dat, err := json.Marshal(p)
+	if err != nil {
+		logger.Error("Error marshalling JSON", slog.Any("err", err))
+		w.WriteHeader(500)
+		return
 	}
-	respondWithJSON(w, code, errorResponse{
-		Error: msg,
-	})
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(p.Status)
+	w.Write(dat)
 }
 
 func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
 	w.Header().Set("Content-Type", "application/json")
+	// API responses are per-user and change with every write.
+	w.Header().Set("Cache-Control", "no-store")
 	dat, err := json.Marshal(payload)
 	if err != nil {
-		log.Printf("Error marshalling JSON: %s", err)
+		responseLogger(w).Error("Error marshalling JSON", slog.Any("err", err))
 		w.WriteHeader(500)
 		return
 	}
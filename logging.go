@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds client-supplied request IDs, which end up in
+// every log line of the request.
+const maxRequestIDLength = 128
+
+type requestStateContextKeyType struct{}
+
+var requestStateContextKey = requestStateContextKeyType{}
+
+// requestState is shared by the logging middleware and everything that
+// handles the request, so attributes learned along the way, such as the
+// authenticated user, end up in every later log line and the access log.
+type requestState struct {
+	id string
+	// req is the request as passed to the router, which records the
+	// matched pattern and path values on it.
+	req *http.Request
+
+	mu    sync.Mutex
+	attrs []any
+}
+
+// newLogger builds the process-wide logger. format is json (the default) or
+// text.
+func newLogger(w io.Writer, format, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if level != "" {
+		err := lvl.UnmarshalText([]byte(level))
+		if err != nil {
+			return nil, fmt.Errorf("unknown log level %q", level)
+		}
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	switch format {
+	case "", "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q, must be json or text", format)
+}
+
+// withRequestLogging gives each request an ID, taken from X-Request-ID if
+// the client sent a usable one, and writes an access log line once it has
+// been served.
+func withRequestLogging(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = uuid.NewString()
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		state := &requestState{id: id}
+		if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+			state.attrs = append(state.attrs,
+				slog.String("trace_id", sc.TraceID().String()),
+				slog.String("span_id", sc.SpanID().String()),
+			)
+		}
+		r = r.WithContext(context.WithValue(r.Context(), requestStateContextKey, state))
+		state.req = r
+		lw := &loggingResponseWriter{ResponseWriter: w, state: state}
+
+		next.ServeHTTP(lw, r)
+
+		status, bytes := responseStats(lw)
+		requestLogger(r.Context()).LogAttrs(r.Context(), slog.LevelInfo, "request",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.String("route", r.Pattern),
+			slog.Int("status", status),
+			slog.Int64("bytes", bytes),
+			slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.String("ip", clientIP(r)),
+			slog.String("user_agent", r.UserAgent()),
+		)
+	})
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// addLogAttrs adds attributes to every later log line of the request.
+func addLogAttrs(ctx context.Context, attrs ...any) {
+	state, ok := ctx.Value(requestStateContextKey).(*requestState)
+	if !ok {
+		return
+	}
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.attrs = append(state.attrs, attrs...)
+}
+
+// requestLogger returns a logger that tags lines with the request's ID and
+// trace, its video if the route has one, and whatever was added with
+// addLogAttrs. It falls back to the default logger outside of requests.
+func requestLogger(ctx context.Context) *slog.Logger {
+	state, ok := ctx.Value(requestStateContextKey).(*requestState)
+	if !ok {
+		return slog.Default()
+	}
+	return state.logger()
+}
+
+func (s *requestState) logger() *slog.Logger {
+	attrs := []any{slog.String("request_id", s.id)}
+	if videoID := s.req.PathValue("videoID"); videoID != "" {
+		attrs = append(attrs, slog.String("video_id", videoID))
+	}
+	s.mu.Lock()
+	attrs = append(attrs, s.attrs...)
+	s.mu.Unlock()
+	return slog.Default().With(attrs...)
+}
+
+// loggingResponseWriter records the status and size of a response, and
+// lets respondWithError find the request it answers.
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	state  *requestState
+	status int
+	bytes  int64
+}
+
+func (lw *loggingResponseWriter) WriteHeader(code int) {
+	if lw.status == 0 {
+		lw.status = code
+	}
+	lw.ResponseWriter.WriteHeader(code)
+}
+
+func (lw *loggingResponseWriter) Write(b []byte) (int, error) {
+	if lw.status == 0 {
+		lw.status = http.StatusOK
+	}
+	n, err := lw.ResponseWriter.Write(b)
+	lw.bytes += int64(n)
+	return n, err
+}
+
+func (lw *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return lw.ResponseWriter
+}
+
+// responseState finds the state of the request w answers, if it went
+// through withRequestLogging.
+func responseState(w http.ResponseWriter) *requestState {
+	for {
+		switch rw := w.(type) {
+		case *loggingResponseWriter:
+			return rw.state
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = rw.Unwrap()
+		default:
+			return nil
+		}
+	}
+}
+
+// responseStats returns the status code and size of the response written to
+// w so far, if it goes through withRequestLogging.
+func responseStats(w http.ResponseWriter) (int, int64) {
+	for {
+		switch rw := w.(type) {
+		case *loggingResponseWriter:
+			status := rw.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			return status, rw.bytes
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = rw.Unwrap()
+		default:
+			return http.StatusOK, 0
+		}
+	}
+}
+
+// responseLogger is requestLogger for code that only has the response.
+func responseLogger(w http.ResponseWriter) *slog.Logger {
+	state := responseState(w)
+	if state == nil {
+		return slog.Default()
+	}
+	return state.logger()
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// loginPolicy throttles failed logins for one account or one address. The
+// first freeFailures failures cost nothing; after that each attempt has to
+// wait baseDelay, doubling with every failure up to maxDelay, until
+// lockoutFailures locks the key for lockoutDuration. Failures older than
+// window are forgotten.
+type loginPolicy struct {
+	freeFailures    int
+	lockoutFailures int
+	baseDelay       time.Duration
+	maxDelay        time.Duration
+	lockoutDuration time.Duration
+	window          time.Duration
+}
+
+var (
+	accountLoginPolicy = loginPolicy{
+		freeFailures:    5,
+		lockoutFailures: 10,
+		baseDelay:       time.Second,
+		maxDelay:        5 * time.Minute,
+		lockoutDuration: 15 * time.Minute,
+		window:          time.Hour,
+	}
+	// One address may legitimately serve many users, e.g. behind NAT.
+	ipLoginPolicy = loginPolicy{
+		freeFailures:    20,
+		lockoutFailures: 100,
+		baseDelay:       time.Second,
+		maxDelay:        5 * time.Minute,
+		lockoutDuration: time.Hour,
+		window:          time.Hour,
+	}
+
+	// Every password reset request counts as a failure, since each one
+	// mails the account.
+	accountResetPolicy = loginPolicy{
+		freeFailures:    3,
+		lockoutFailures: 10,
+		baseDelay:       time.Minute,
+		maxDelay:        time.Hour,
+		lockoutDuration: 24 * time.Hour,
+		window:          24 * time.Hour,
+	}
+	ipResetPolicy = loginPolicy{
+		freeFailures:    20,
+		lockoutFailures: 100,
+		baseDelay:       time.Second,
+		maxDelay:        5 * time.Minute,
+		lockoutDuration: time.Hour,
+		window:          time.Hour,
+	}
+)
+
+// retryAfter is how long to wait before the next attempt is allowed.
+func (p loginPolicy) retryAfter(failures database.LoginFailures, now time.Time) time.Duration {
+	if failures.Count < p.freeFailures {
+		return 0
+	}
+
+	var wait time.Duration
+	if failures.Count >= p.lockoutFailures {
+		wait = p.lockoutDuration
+	} else {
+		shift := min(failures.Count-p.freeFailures, 30)
+		wait = min(p.baseDelay<<shift, p.maxDelay)
+	}
+	return max(failures.LastAt.Add(wait).Sub(now), 0)
+}
+
+// loginRetryAfter checks the account and address limits for a login attempt
+// and returns how long the client has to wait, or 0 if it may try now.
+func (cfg *apiConfig) loginRetryAfter(ctx context.Context, email, ip string, now time.Time) (time.Duration, error) {
+	accountFailures, err := cfg.db.WithContext(ctx).GetAccountLoginFailures(email, now.Add(-accountLoginPolicy.window))
+	if err != nil {
+		return 0, err
+	}
+	ipFailures, err := cfg.db.WithContext(ctx).GetIPLoginFailures(ip, now.Add(-ipLoginPolicy.window))
+	if err != nil {
+		return 0, err
+	}
+	return max(
+		accountLoginPolicy.retryAfter(accountFailures, now),
+		ipLoginPolicy.retryAfter(ipFailures, now),
+	), nil
+}
+
+// passwordResetRetryAfter is loginRetryAfter for password reset requests,
+// which count whether or not they are for an account.
+func (cfg *apiConfig) passwordResetRetryAfter(ctx context.Context, email, ip string, now time.Time) (time.Duration, error) {
+	accountRequests, err := cfg.db.WithContext(ctx).GetPasswordResetRequests(email, "", now.Add(-accountResetPolicy.window))
+	if err != nil {
+		return 0, err
+	}
+	ipRequests, err := cfg.db.WithContext(ctx).GetPasswordResetRequests("", ip, now.Add(-ipResetPolicy.window))
+	if err != nil {
+		return 0, err
+	}
+	return max(
+		accountResetPolicy.retryAfter(accountRequests, now),
+		ipResetPolicy.retryAfter(ipRequests, now),
+	), nil
+}
+
+func respondTooManyRequests(w http.ResponseWriter, retryAfter time.Duration, msg string) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	respondWithError(w, http.StatusTooManyRequests, msg, nil)
+}
+
+// loginAttemptEmail is the key failed logins are counted under.
+func loginAttemptEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func (cfg *apiConfig) recordLoginAttempt(r *http.Request, email string, now time.Time, result database.LoginResult) {
+	err := cfg.db.WithContext(r.Context()).CreateLoginAttempt(database.LoginAttempt{
+		CreatedAt: now,
+		Email:     email,
+		IP:        clientIP(r),
+		UserAgent: r.UserAgent(),
+		Result:    result,
+	})
+	if err != nil {
+		requestLogger(r.Context()).Warn("Couldn't record login attempt", slog.String("email", email), slog.Any("err", err))
+	}
+}
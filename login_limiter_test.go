@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/client"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestLoginPolicyRetryAfter(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		policy   loginPolicy
+		failures int
+		since    time.Duration
+		want     time.Duration
+	}{
+		{"free failures", accountLoginPolicy, 4, 0, 0},
+		{"first delay", accountLoginPolicy, 5, 0, time.Second},
+		{"delay doubles", accountLoginPolicy, 7, 0, 4 * time.Second},
+		{"delay counts from last failure", accountLoginPolicy, 7, 3 * time.Second, time.Second},
+		{"delay over", accountLoginPolicy, 7, 5 * time.Second, 0},
+		{"last delay before lockout", accountLoginPolicy, 9, 0, 16 * time.Second},
+		{"lockout", accountLoginPolicy, 10, 0, 15 * time.Minute},
+		{"lockout counts from last failure", accountLoginPolicy, 12, 5 * time.Minute, 10 * time.Minute},
+		{"address free failures", ipLoginPolicy, 19, 0, 0},
+		{"delay capped", ipLoginPolicy, 40, 0, 5 * time.Minute},
+		{"address lockout", ipLoginPolicy, 100, 0, time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			failures := database.LoginFailures{Count: tt.failures, LastAt: now.Add(-tt.since)}
+			got := tt.policy.retryAfter(failures, now)
+			if got != tt.want {
+				t.Errorf("retryAfter(%d failures %v ago) = %v, want %v", tt.failures, tt.since, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestLoginLockout checks the limits through the login endpoint, with
+// failures recorded straight in the database so that the test doesn't have
+// to wait out the delays.
+func TestLoginLockout(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := context.Background()
+	anon := ts.client()
+
+	fail := func(t *testing.T, email, ip string, n int, ago time.Duration) {
+		t.Helper()
+		for range n {
+			err := ts.cfg.db.CreateLoginAttempt(database.LoginAttempt{
+				CreatedAt: time.Now().Add(-ago),
+				Email:     email,
+				IP:        ip,
+				Result:    database.LoginResultFailure,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	login := func(t *testing.T, email, password string) (*http.Response, string) {
+		t.Helper()
+		body := `{"email":` + strconv.Quote(email) + `,"password":` + strconv.Quote(password) + `}`
+		req := mustRequest(t, http.MethodPost, ts.URL+"/api/login", []byte(body))
+		req.Header.Set("Content-Type", "application/json")
+		return ts.do(t, req)
+	}
+	// create signs up without logging in, which would reset the failures
+	// recorded before it.
+	create := func(t *testing.T, email string) *client.User {
+		t.Helper()
+		user, err := anon.CreateUser(ctx, client.CreateUserRequest{Email: email, Password: testPassword})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return user
+	}
+	wantRetryAfter := func(t *testing.T, resp *http.Response, lo, hi int) {
+		t.Helper()
+		if resp.StatusCode != http.StatusTooManyRequests {
+			t.Fatalf("Login answered %d, want %d", resp.StatusCode, http.StatusTooManyRequests)
+		}
+		seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+		if err != nil || seconds < lo || seconds > hi {
+			t.Fatalf("Retry-After is %q, want %d to %d seconds", resp.Header.Get("Retry-After"), lo, hi)
+		}
+	}
+
+	t.Run("account delay", func(t *testing.T) {
+		ts.signup(t, "delay@example.com")
+		fail(t, "delay@example.com", "192.0.2.1", accountLoginPolicy.freeFailures+3, 0)
+		// Even the right password has to wait.
+		resp, _ := login(t, "delay@example.com", testPassword)
+		wantRetryAfter(t, resp, 7, 8)
+	})
+
+	t.Run("account lockout", func(t *testing.T) {
+		create(t, "locked@example.com")
+		fail(t, "locked@example.com", "192.0.2.2", accountLoginPolicy.lockoutFailures, time.Minute)
+		resp, _ := login(t, "locked@example.com", testPassword)
+		wantRetryAfter(t, resp, 14*60-1, 14*60)
+	})
+
+	t.Run("success resets account", func(t *testing.T) {
+		create(t, "reset@example.com")
+		fail(t, "reset@example.com", "192.0.2.3", accountLoginPolicy.freeFailures, time.Minute)
+		_, err := anon.Login(ctx, client.LoginRequest{Email: "reset@example.com", Password: testPassword})
+		if err != nil {
+			t.Fatal(err)
+		}
+		failures, err := ts.cfg.db.GetAccountLoginFailures("reset@example.com", time.Now().Add(-time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if failures.Count != 0 {
+			t.Errorf("Account has %d failures after logging in, want 0", failures.Count)
+		}
+	})
+
+	t.Run("disabled account doesn't reset", func(t *testing.T) {
+		user := create(t, "disabled@example.com")
+		err := ts.cfg.db.SetUserDisabled(user.ID, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fail(t, "disabled@example.com", "192.0.2.4", accountLoginPolicy.freeFailures, time.Minute)
+		_, err = anon.Login(ctx, client.LoginRequest{Email: "disabled@example.com", Password: testPassword})
+		wantProblem(t, err, http.StatusForbidden)
+		failures, err := ts.cfg.db.GetAccountLoginFailures("disabled@example.com", time.Now().Add(-time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if failures.Count != accountLoginPolicy.freeFailures {
+			t.Errorf("Account has %d failures after a disabled login, want %d", failures.Count, accountLoginPolicy.freeFailures)
+		}
+	})
+
+	t.Run("address lockout", func(t *testing.T) {
+		// The test server sees every client at 127.0.0.1, so this goes last.
+		fail(t, "other@example.com", "127.0.0.1", ipLoginPolicy.lockoutFailures, 0)
+		resp, _ := login(t, "fresh@example.com", testPassword)
+		wantRetryAfter(t, resp, 59*60, 60*60)
+	})
+}
+
+// TestDummyPasswordHash makes sure logins to unknown emails really pay for
+// an argon2id hash rather than failing to parse it.
+func TestDummyPasswordHash(t *testing.T) {
+	match, err := auth.CheckPasswordHash(testPassword, dummyPasswordHash)
+	if err != nil {
+		t.Fatalf("Couldn't check the dummy hash: %v", err)
+	}
+	if match {
+		t.Error("The dummy hash matches the test password")
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/mailer"
+)
+
+const (
+	emailVerificationDuration = 48 * time.Hour
+	passwordResetDuration     = time.Hour
+	mailTimeout               = 30 * time.Second
+)
+
+// sendMail sends msg in the background, so neither a slow mail server nor
+// the time it takes reveals anything to the client.
+func (cfg *apiConfig) sendMail(msg mailer.Message) {
+	done := cfg.metrics.startJob(jobMail)
+	cfg.background.Add(1)
+	go func() {
+		defer cfg.background.Done()
+		defer done()
+		ctx, cancel := context.WithTimeout(context.Background(), mailTimeout)
+		defer cancel()
+		err := cfg.mailer.Send(ctx, msg)
+		if err != nil {
+			slog.Error("Couldn't send mail", slog.String("to", msg.To), slog.String("subject", msg.Subject), slog.Any("err", err))
+		}
+	}()
+}
+
+// issueUserToken stores a new single-use token for user and returns the
+// token itself, which is only ever sent by mail.
+func (cfg *apiConfig) issueUserToken(ctx context.Context, user database.User, purpose database.TokenPurpose, ttl time.Duration) (string, error) {
+	token, err := auth.MakeRefreshToken()
+	if err != nil {
+		return "", err
+	}
+	err = cfg.db.WithContext(ctx).CreateUserToken(database.CreateUserTokenParams{
+		TokenHash: auth.HashToken(token),
+		UserID:    user.ID,
+		Purpose:   purpose,
+		Email:     user.Email,
+		ExpiresAt: time.Now().UTC().Add(ttl),
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// appLink is a link into the web app that hands it a query parameter.
+func (cfg *apiConfig) appLink(param, value string) string {
+	return fmt.Sprintf("%s/app/?%s=%s", cfg.publicURL, param, url.QueryEscape(value))
+}
+
+func (cfg *apiConfig) sendVerificationEmail(ctx context.Context, user database.User) error {
+	token, err := cfg.issueUserToken(ctx, user, database.TokenPurposeEmailVerification, emailVerificationDuration)
+	if err != nil {
+		return err
+	}
+	cfg.sendMail(mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your Tubely email address",
+		Body: fmt.Sprintf(`Welcome to Tubely!
+
+Confirm that this is your email address by opening this link:
+
+%s
+
+The link expires in two days. If you didn't sign up for Tubely, ignore this
+email.
+`, cfg.appLink("verify_token", token)),
+	})
+	return nil
+}
+
+func (cfg *apiConfig) sendPasswordResetEmail(ctx context.Context, user database.User) error {
+	token, err := cfg.issueUserToken(ctx, user, database.TokenPurposePasswordReset, passwordResetDuration)
+	if err != nil {
+		return err
+	}
+	cfg.sendMail(mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your Tubely password",
+		Body: fmt.Sprintf(`Someone asked to reset the password of your Tubely account.
+
+Choose a new password by opening this link:
+
+%s
+
+The link expires in an hour and works once. If you didn't ask for this,
+ignore this email; your password hasn't changed.
+`, cfg.appLink("reset_token", token)),
+	})
+	return nil
+}
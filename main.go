@@ -2,21 +2,37 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"sync"
+	"time"
 
-	"github.com/aws/aws-sdk-go-v2/config"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/config"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/mailer"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/oidc"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
 
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/aws/aws-sdk-go-v2/otelaws"
 )
 
 type apiConfig struct {
 	db               database.Client
-	jwtSecret        string
+	jwtKeys          *auth.KeySet
+	accessTokenTTL   time.Duration
+	denylist         *accessTokenDenylist
+	metrics          *metrics
 	platform         string
 	filepathRoot     string
 	assetsRoot       string
@@ -24,85 +40,176 @@ type apiConfig struct {
 	s3Region         string
 	s3CfDistribution string
 	port             string
+	publicURL        string
 	s3Client         *s3.Client
+	storageBackend   string
+	store            storage.Store
+	plans            map[string]plan
+	mailer           mailer.Mailer
+	passwordPolicy   auth.PasswordPolicy
+	// transferTimeout replaces the server's timeouts for uploads and
+	// streams.
+	transferTimeout time.Duration
+	// playbackKey signs the stream URLs of private videos.
+	playbackKey []byte
+	// oidc is nil unless single sign-on is configured.
+	oidc *oidc.Provider
+	// background tracks work that outlives the request that started it, so
+	// shutdown can wait for it.
+	background *sync.WaitGroup
 }
 
 func main() {
 	godotenv.Load(".env")
 
-	pathToDB := os.Getenv("DB_PATH")
-	if pathToDB == "" {
-		log.Fatal("DB_URL must be set")
+	conf, args, err := config.Load(os.Args[1:], os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		fmt.Fprint(os.Stderr, commandUsage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration:\n%v\n", err)
+		os.Exit(2)
+	}
+	// Printing the configuration needs nothing else, so it works even when
+	// the database or storage is unreachable.
+	if len(args) > 0 && args[0] == "config" {
+		err := conf.Write(os.Stdout)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
-	db, err := database.NewClient(pathToDB)
+	logger, err := newLogger(os.Stderr, conf.Log.Format, conf.Log.Level)
 	if err != nil {
-		log.Fatalf("Couldn't connect to database: %v", err)
+		log.Fatal(err)
 	}
+	// Also routes the standard log package, and so log.Fatal, through logger.
+	slog.SetDefault(logger)
 
-	jwtSecret := os.Getenv("JWT_SECRET")
-	if jwtSecret == "" {
-		log.Fatal("JWT_SECRET environment variable is not set")
+	shutdownTracing, err := setupTracing(context.Background(), conf.Tracing.Exporter)
+	if err != nil {
+		log.Fatalf("Couldn't set up tracing: %v", err)
 	}
 
-	platform := os.Getenv("PLATFORM")
-	if platform == "" {
-		log.Fatal("PLATFORM environment variable is not set")
+	db, err := database.NewClient(conf.Database.Path)
+	if err != nil {
+		log.Fatalf("Couldn't connect to database: %v", err)
 	}
 
-	filepathRoot := os.Getenv("FILEPATH_ROOT")
-	if filepathRoot == "" {
-		log.Fatal("FILEPATH_ROOT environment variable is not set")
+	// Without a key directory access tokens are signed with the JWT secret.
+	// With one, the secret only keeps tokens it signed valid until it is
+	// removed.
+	var jwtKeys *auth.KeySet
+	if conf.Auth.JWTKeysDir != "" {
+		jwtKeys, err = auth.LoadKeySet(conf.Auth.JWTKeysDir, conf.Auth.JWTSigningKey, conf.Auth.JWTSecret)
+		if err != nil {
+			log.Fatalf("Couldn't load JWT keys: %v", err)
+		}
+	} else {
+		jwtKeys = auth.NewHMACKeySet(conf.Auth.JWTSecret)
 	}
 
-	assetsRoot := os.Getenv("ASSETS_ROOT")
-	if assetsRoot == "" {
-		log.Fatal("ASSETS_ROOT environment variable is not set")
+	var store storage.Store
+	var client *s3.Client
+	switch conf.Storage.Backend {
+	case "s3":
+		defaultAwsConfig, err := awsconfig.LoadDefaultConfig(context.TODO(), awsconfig.WithRegion(conf.S3.Region))
+		if err != nil {
+			log.Fatalf("Cannot load the default AWS SDK config: %v", err)
+		}
+		// S3 calls join the trace of the request that makes them.
+		otelaws.AppendMiddlewares(&defaultAwsConfig.APIOptions)
+		client = s3.NewFromConfig(defaultAwsConfig)
+		store = storage.NewS3Store(client, conf.S3.Bucket)
+	case "filesystem":
+		store, err = storage.NewFileStore(conf.Storage.Root)
+		if err != nil {
+			log.Fatalf("Couldn't create storage directory: %v", err)
+		}
 	}
 
-	s3Bucket := os.Getenv("S3_BUCKET")
-	if s3Bucket == "" {
-		log.Fatal("S3_BUCKET environment variable is not set")
+	plans, err := loadPlans(conf.Plans.File)
+	if err != nil {
+		log.Fatalf("Couldn't load plans: %v", err)
 	}
 
-	s3Region := os.Getenv("S3_REGION")
-	if s3Region == "" {
-		log.Fatal("S3_REGION environment variable is not set")
+	passwordPolicy, err := auth.NewPasswordPolicy(conf.Auth.PasswordMinLength, maxPasswordLength, conf.Auth.BreachedPasswordsFile)
+	if err != nil {
+		log.Fatalf("Couldn't load breached passwords: %v", err)
 	}
 
-	s3CfDistribution := os.Getenv("S3_CF_DISTRO")
-	if s3CfDistribution == "" {
-		log.Fatal("S3_CF_DISTRO environment variable is not set")
+	var mail mailer.Mailer
+	switch conf.Mail.Mailer {
+	case "log":
+		mail = mailer.LogMailer{}
+	case "file":
+		mail, err = mailer.NewFileMailer(conf.Mail.Dir, conf.Mail.From)
+		if err != nil {
+			log.Fatalf("Couldn't create mail directory: %v", err)
+		}
+	case "smtp":
+		mail, err = mailer.NewSMTPMailer(conf.Mail.SMTPAddr, conf.Mail.SMTPUsername, conf.Mail.SMTPPassword, conf.Mail.From)
+		if err != nil {
+			log.Fatalf("Invalid SMTP_ADDR: %v", err)
+		}
 	}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		log.Fatal("PORT environment variable is not set")
+	// Signed stream URLs are short-lived, so a random key only costs a
+	// restart's worth of playing videos.
+	playbackKey := []byte(conf.Storage.URLSecret)
+	if len(playbackKey) == 0 {
+		playbackKey = make([]byte, 32)
+		_, err = rand.Read(playbackKey)
+		if err != nil {
+			log.Fatalf("Couldn't create playback URL key: %v", err)
+		}
 	}
 
-	// Use config.LoadDefaultConfig to auto load the default AWS SDK config (the keys you set with aws configure)
-	// 	As arguments, give it an empty Context and pass config.WithRegion(s3Region) to use the region that's set in your .env file.
-	// Create a client with your config using s3.NewFromConfig
-	// Assign the client to the s3Client field
-	// Update the S3_BUCKET and S3_REGION variables in your .env file. They'll be saved into your apiConfig.
-	defaultAwsConfig, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion(s3Region))
-	if err != nil {
-		log.Fatalf("Cannot load the default AWS SDK config: %v", err)
+	var oidcProvider *oidc.Provider
+	if conf.OIDC.Issuer != "" {
+		oidcProvider = oidc.NewProvider(conf.OIDC.Issuer, conf.OIDC.ClientID, conf.OIDC.ClientSecret, conf.OIDCRedirectURL())
 	}
 
-	client := s3.NewFromConfig(defaultAwsConfig)
+	serverMetrics := newMetrics()
+	db.ObserveQueries(serverMetrics.observeQuery)
 
 	cfg := apiConfig{
 		db:               db,
-		jwtSecret:        jwtSecret,
-		platform:         platform,
-		filepathRoot:     filepathRoot,
-		assetsRoot:       assetsRoot,
-		s3Bucket:         s3Bucket,
-		s3Region:         s3Region,
-		s3CfDistribution: s3CfDistribution,
-		port:             port,
+		jwtKeys:          jwtKeys,
+		accessTokenTTL:   conf.Auth.AccessTokenTTL,
+		denylist:         newAccessTokenDenylist(db),
+		metrics:          serverMetrics,
+		platform:         conf.Server.Platform,
+		filepathRoot:     conf.Server.FilepathRoot,
+		assetsRoot:       conf.Server.AssetsRoot,
+		s3Bucket:         conf.S3.Bucket,
+		s3Region:         conf.S3.Region,
+		s3CfDistribution: conf.S3.CFDistribution,
+		port:             conf.Server.Port,
+		publicURL:        conf.PublicBaseURL(),
 		s3Client:         client,
+		storageBackend:   conf.Storage.Backend,
+		store:            store,
+		plans:            plans,
+		mailer:           mail,
+		passwordPolicy:   passwordPolicy,
+		transferTimeout:  conf.Server.TransferTimeout,
+		playbackKey:      playbackKey,
+		oidc:             oidcProvider,
+		background:       &sync.WaitGroup{},
+	}
+
+	if len(args) > 0 {
+		os.Exit(cfg.runCommand(context.Background(), args, os.Stdout, os.Stderr))
+	}
+
+	removed, err := removeStaleUploads(os.TempDir(), conf.Server.StaleUploadAge)
+	if err != nil {
+		slog.Warn("Couldn't clean up stale uploads", slog.Any("err", err))
+	} else if removed > 0 {
+		slog.Info("Removed stale upload temp files", slog.Int("count", removed))
 	}
 
 	err = cfg.ensureAssetsDir()
@@ -110,33 +217,102 @@ func main() {
 		log.Fatalf("Couldn't create assets directory: %v", err)
 	}
 
+	trustedProxies, err := conf.TrustedProxyPrefixes()
+	if err != nil {
+		log.Fatalf("Couldn't parse trusted proxies: %v", err)
+	}
+	srv := &http.Server{
+		Addr:              ":" + cfg.port,
+		Handler:           withTracing(withClientAddr(trustedProxies, withRequestLogging(cfg.metrics.instrument(withSpanRoute(cfg.routes()))))),
+		ErrorLog:          slog.NewLogLogger(logger.Handler(), slog.LevelWarn),
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       conf.Server.RequestTimeout,
+		WriteTimeout:      conf.Server.RequestTimeout,
+		IdleTimeout:       2 * time.Minute,
+	}
+
+	servers := []*http.Server{srv}
+	if conf.Server.MetricsAddr != "" {
+		metricsSrv := cfg.metrics.server(conf.Server.MetricsAddr)
+		metricsSrv.ErrorLog = srv.ErrorLog
+		servers = append(servers, metricsSrv)
+		slog.Info("Serving metrics", slog.String("addr", conf.Server.MetricsAddr))
+	}
+
+	slog.Info("Serving", slog.String("url", cfg.publicURL+"/app/"))
+	err = cfg.serve(servers, conf.Server.ShutdownTimeout)
+	shutdownErr := shutdownTracing(context.Background())
+	if shutdownErr != nil {
+		slog.Error("Couldn't flush traces", slog.Any("err", shutdownErr))
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// routes builds the server's router, without the middleware that wraps it.
+func (cfg *apiConfig) routes() *http.ServeMux {
 	mux := http.NewServeMux()
-	appHandler := http.StripPrefix("/app", http.FileServer(http.Dir(filepathRoot)))
+	appHandler := http.StripPrefix("/app", revalidateCacheMiddleware(cfg.filepathRoot, http.FileServer(http.Dir(cfg.filepathRoot))))
 	mux.Handle("/app/", appHandler)
 
-	assetsHandler := http.StripPrefix("/assets", http.FileServer(http.Dir(assetsRoot)))
-	mux.Handle("/assets/", noCacheMiddleware(assetsHandler))
+	assetsHandler := http.StripPrefix("/assets", immutableCacheMiddleware(cfg.assetsRoot, http.FileServer(http.Dir(cfg.assetsRoot))))
+	mux.Handle("/assets/", assetsHandler)
 
+	// Routes declare who may call them. Login, refresh and revoke carry their
+	// own credentials in the body or as a refresh token.
+	mux.HandleFunc("GET /.well-known/jwks.json", cfg.handlerJWKS)
+	mux.HandleFunc("GET /api/openapi.json", cfg.handlerOpenAPI)
 	mux.HandleFunc("POST /api/login", cfg.handlerLogin)
+	mux.HandleFunc("POST /api/login/mfa", cfg.handlerLoginMFA)
+	mux.HandleFunc("POST /api/login/oidc", cfg.handlerLoginOIDC)
+	mux.HandleFunc("GET /api/oidc/login", cfg.handlerOIDCLogin)
+	mux.HandleFunc("GET /api/oidc/callback", cfg.handlerOIDCCallback)
 	mux.HandleFunc("POST /api/refresh", cfg.handlerRefresh)
 	mux.HandleFunc("POST /api/revoke", cfg.handlerRevoke)
+	mux.HandleFunc("GET /api/sessions", cfg.withAuth(requireUser, cfg.handlerSessionsList))
+	mux.HandleFunc("DELETE /api/sessions", cfg.withAuth(requireUser, cfg.handlerSessionsRevokeAll))
+	mux.HandleFunc("DELETE /api/sessions/{sessionID}", cfg.withAuth(requireUser, cfg.handlerSessionRevoke))
 
 	mux.HandleFunc("POST /api/users", cfg.handlerUsersCreate)
+	mux.HandleFunc("GET /api/users/me", cfg.withAuth(requireUser, cfg.handlerUserGet))
+	mux.HandleFunc("PUT /api/users/me/email", cfg.withAuth(requireUser, cfg.handlerUserEmailUpdate))
+	mux.HandleFunc("PUT /api/users/me/password", cfg.withAuth(requireUser, cfg.handlerUserPasswordUpdate))
+	mux.HandleFunc("DELETE /api/users/me", cfg.withAuth(requireUser, cfg.handlerUserDelete))
+	mux.HandleFunc("POST /api/users/me/totp", cfg.withAuth(requireUser, cfg.handlerTOTPEnroll))
+	mux.HandleFunc("POST /api/users/me/totp/confirm", cfg.withAuth(requireUser, cfg.handlerTOTPConfirm))
+	mux.HandleFunc("DELETE /api/users/me/totp", cfg.withAuth(requireUser, cfg.handlerTOTPDisable))
+	mux.HandleFunc("POST /api/users/me/recovery_codes", cfg.withAuth(requireUser, cfg.handlerRecoveryCodesRegenerate))
+	mux.HandleFunc("GET /api/users/me/identities", cfg.withAuth(requireUser, cfg.handlerUserIdentitiesList))
+	mux.HandleFunc("POST /api/email_verification", cfg.withAuth(requireUser, cfg.handlerEmailVerificationRequest))
+	mux.HandleFunc("POST /api/email_verification/confirm", cfg.handlerEmailVerificationConfirm)
+	mux.HandleFunc("POST /api/password_reset", cfg.handlerPasswordResetRequest)
+	mux.HandleFunc("POST /api/password_reset/confirm", cfg.handlerPasswordResetConfirm)
+	mux.HandleFunc("GET /api/usage", cfg.withAuth(requireScope(auth.ScopeVideosRead), cfg.handlerUsageGet))
 
-	mux.HandleFunc("POST /api/videos", cfg.handlerVideoMetaCreate)
-	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}", cfg.handlerUploadThumbnail)
-	mux.HandleFunc("POST /api/video_upload/{videoID}", cfg.handlerUploadVideo)
-	mux.HandleFunc("GET /api/videos", cfg.handlerVideosRetrieve)
-	mux.HandleFunc("GET /api/videos/{videoID}", cfg.handlerVideoGet)
-	mux.HandleFunc("DELETE /api/videos/{videoID}", cfg.handlerVideoMetaDelete)
+	mux.HandleFunc("POST /api/api_keys", cfg.withAuth(requireUser, cfg.handlerAPIKeyCreate))
+	mux.HandleFunc("GET /api/api_keys", cfg.withAuth(requireUser, cfg.handlerAPIKeysList))
+	mux.HandleFunc("DELETE /api/api_keys/{keyID}", cfg.withAuth(requireUser, cfg.handlerAPIKeyRevoke))
 
-	mux.HandleFunc("POST /admin/reset", cfg.handlerReset)
+	mux.HandleFunc("POST /api/videos", cfg.withAuth(requireScope(auth.ScopeVideosWrite), cfg.handlerVideoMetaCreate))
+	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}", cfg.withAuth(requireScope(auth.ScopeVideosWrite), cfg.handlerUploadThumbnail))
+	mux.HandleFunc("POST /api/video_upload/{videoID}", cfg.withAuth(requireScope(auth.ScopeVideosWrite), cfg.handlerUploadVideo))
+	mux.HandleFunc("GET /api/videos", cfg.withAuth(requireScope(auth.ScopeVideosRead), cfg.handlerVideosRetrieve))
+	mux.HandleFunc("GET /api/videos/{videoID}", cfg.withAuth(optionalScope(auth.ScopeVideosRead), cfg.handlerVideoGet))
+	mux.HandleFunc("GET /api/videos/{videoID}/stream", cfg.withAuth(optionalScope(auth.ScopeVideosRead), cfg.handlerVideoStream))
+	mux.HandleFunc("DELETE /api/videos/{videoID}", cfg.withAuth(requireScope(auth.ScopeVideosWrite), cfg.handlerVideoMetaDelete))
 
-	srv := &http.Server{
-		Addr:    ":" + port,
-		Handler: mux,
-	}
+	mux.HandleFunc("GET /healthz", cfg.handlerHealthz)
+	mux.HandleFunc("GET /readyz", cfg.handlerReadyz)
 
-	log.Printf("Serving on: http://localhost:%s/app/\n", port)
-	log.Fatal(srv.ListenAndServe())
+	mux.HandleFunc("POST /admin/reset", cfg.handlerReset)
+	mux.HandleFunc("GET /admin/users", cfg.withAuth(requirePermission(permListUsers), cfg.handlerAdminUsersList))
+	mux.HandleFunc("POST /admin/users/{userID}/disable", cfg.withAuth(requirePermission(permManageUsers), cfg.handlerAdminUserDisable))
+	mux.HandleFunc("POST /admin/users/{userID}/enable", cfg.withAuth(requirePermission(permManageUsers), cfg.handlerAdminUserEnable))
+	mux.HandleFunc("PUT /admin/users/{userID}/role", cfg.withAuth(requirePermission(permManageUsers), cfg.handlerAdminUserRoleUpdate))
+	mux.HandleFunc("GET /admin/videos/{videoID}", cfg.withAuth(requirePermission(permViewAnyVideo), cfg.handlerAdminVideoGet))
+	mux.HandleFunc("DELETE /admin/videos/{videoID}", cfg.withAuth(requirePermission(permDeleteAnyVideo), cfg.handlerAdminVideoDelete))
+	mux.HandleFunc("GET /admin/audit_log", cfg.withAuth(requirePermission(permViewAuditLog), cfg.handlerAdminAuditLog))
+	mux.HandleFunc("GET /admin/login_attempts", cfg.withAuth(requirePermission(permViewAuditLog), cfg.handlerAdminLoginAttempts))
+	return mux
 }
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/client"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/mailer"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+const testPassword = "correct horse battery staple"
+
+func TestMain(m *testing.M) {
+	// Request logs would bury test failures.
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// testServer runs the real handlers against a temporary SQLite database,
+// the filesystem storage backend and stand-ins for ffmpeg and ffprobe. Its
+// clients check every response against openapi.json.
+type testServer struct {
+	*httptest.Server
+	cfg        *apiConfig
+	mail       *testMailer
+	storageDir string
+	spec       *specTransport
+	httpClient *http.Client
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	installFakeFFmpeg(t)
+	dir := t.TempDir()
+
+	db, err := database.NewClient(filepath.Join(dir, "tubely.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	storageDir := filepath.Join(dir, "storage")
+	store, err := storage.NewFileStore(storageDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plans, err := loadPlans("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	passwordPolicy, err := auth.NewPasswordPolicy(8, maxPasswordLength, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverMetrics := newMetrics()
+	db.ObserveQueries(serverMetrics.observeQuery)
+
+	mail := &testMailer{}
+	cfg := &apiConfig{
+		db:              db,
+		jwtKeys:         auth.NewHMACKeySet("test secret"),
+		accessTokenTTL:  15 * time.Minute,
+		denylist:        newAccessTokenDenylist(db),
+		metrics:         serverMetrics,
+		platform:        "dev",
+		filepathRoot:    filepath.Join(dir, "app"),
+		assetsRoot:      filepath.Join(dir, "assets"),
+		storageBackend:  "filesystem",
+		store:           store,
+		plans:           plans,
+		mailer:          mail,
+		passwordPolicy:  passwordPolicy,
+		transferTimeout: time.Minute,
+		playbackKey:     []byte("test playback key"),
+		background:      &sync.WaitGroup{},
+	}
+	err = cfg.ensureAssetsDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(withRequestLogging(cfg.metrics.instrument(withSpanRoute(cfg.routes()))))
+	t.Cleanup(func() {
+		srv.Close()
+		cfg.background.Wait()
+	})
+	cfg.publicURL = srv.URL
+
+	spec := &specTransport{t: t, doc: loadOpenAPIDoc(t), base: srv.Client().Transport, seen: map[string]map[int]bool{}}
+	httpClient := &http.Client{
+		Transport: spec,
+		// Redirects leave the API, so they are checked rather than followed.
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return &testServer{Server: srv, cfg: cfg, mail: mail, storageDir: storageDir, spec: spec, httpClient: httpClient}
+}
+
+// client returns an API client of the server using opts.
+func (ts *testServer) client(opts ...client.Option) *client.Client {
+	return client.New(ts.URL, append([]client.Option{client.WithHTTPClient(ts.httpClient)}, opts...)...)
+}
+
+// signup creates a user and returns a client logged in as them.
+func (ts *testServer) signup(t *testing.T, email string) (*client.Client, client.LoginSession) {
+	t.Helper()
+	ctx := context.Background()
+	anon := ts.client()
+	_, err := anon.CreateUser(ctx, client.CreateUserRequest{Email: email, Password: testPassword})
+	if err != nil {
+		t.Fatalf("Couldn't sign up %s: %v", email, err)
+	}
+	resp, err := anon.Login(ctx, client.LoginRequest{Email: email, Password: testPassword})
+	if err != nil {
+		t.Fatalf("Couldn't log in %s: %v", email, err)
+	}
+	if resp.LoginSession == nil {
+		t.Fatalf("Login of %s asked for a second factor", email)
+	}
+	return ts.client(client.WithToken(resp.Token)), *resp.LoginSession
+}
+
+// setRole changes a user's role straight in the database, the way the
+// set-role command does.
+func (ts *testServer) setRole(t *testing.T, user client.User, role database.Role) {
+	t.Helper()
+	err := ts.cfg.db.UpdateUserRole(user.ID, role)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testMailer keeps the messages the server sends.
+type testMailer struct {
+	mu   sync.Mutex
+	sent []mailer.Message
+	// block, if set, holds up sending until it is closed.
+	block chan struct{}
+}
+
+func (m *testMailer) Send(ctx context.Context, msg mailer.Message) error {
+	m.mu.Lock()
+	block := m.block
+	m.mu.Unlock()
+	if block != nil {
+		<-block
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+var mailTokenRegexp = regexp.MustCompile(`_token=(\S+)`)
+
+// mailedToken waits for mail to be sent and returns the token of the last
+// link sent to email.
+func (ts *testServer) mailedToken(t *testing.T, email string) string {
+	t.Helper()
+	ts.cfg.background.Wait()
+	ts.mail.mu.Lock()
+	defer ts.mail.mu.Unlock()
+	for i := len(ts.mail.sent) - 1; i >= 0; i-- {
+		msg := ts.mail.sent[i]
+		if msg.To != email {
+			continue
+		}
+		match := mailTokenRegexp.FindStringSubmatch(msg.Body)
+		if match == nil {
+			t.Fatalf("Mail to %s has no link: %q", email, msg.Body)
+		}
+		token, err := url.QueryUnescape(match[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	t.Fatalf("No mail was sent to %s", email)
+	return ""
+}
+
+// installFakeFFmpeg puts scripts standing in for ffmpeg and ffprobe first
+// on PATH. The fake ffmpeg copies its input, rejects files containing
+// "notavideo" after starting its output and waits while the file named by TUBELY_TEST_FFMPEG_GATE
+// exists. The fake ffprobe reports a 1920x1080 video.
+func installFakeFFmpeg(t *testing.T) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake ffmpeg is a shell script")
+	}
+	dir := t.TempDir()
+	scripts := map[string]string{
+		"ffmpeg": `#!/bin/sh
+if [ "$1" = "-version" ]; then echo "ffmpeg version test"; exit 0; fi
+while [ -n "$TUBELY_TEST_FFMPEG_GATE" ] && [ -e "$TUBELY_TEST_FFMPEG_GATE" ]; do sleep 0.01; done
+in="$2"
+eval out=\${$#}
+if grep -q notavideo "$in"; then : > "$out"; echo "Invalid data found when processing input" >&2; exit 1; fi
+cp "$in" "$out"
+`,
+		"ffprobe": `#!/bin/sh
+if [ "$1" = "-version" ]; then echo "ffprobe version test"; exit 0; fi
+echo '{"streams":[{"codec_type":"video","width":1920,"height":1080}]}'
+`,
+	}
+	for name, script := range scripts {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(script), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+// testVideo is an MP4 upload of content, which the fake ffmpeg accepts
+// unless it contains "notavideo".
+func testVideo(content string) client.File {
+	return client.File{Name: "video.mp4", ContentType: "video/mp4", Content: strings.NewReader(content)}
+}
+
+// do sends a request the client can't, e.g. a malformed one, and returns
+// the response with its body read.
+func (ts *testServer) do(t *testing.T, req *http.Request) (*http.Response, string) {
+	t.Helper()
+	resp, err := ts.httpClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(body)
+}
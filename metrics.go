@@ -0,0 +1,155 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Stages of video processing timed by tubely_processing_duration_seconds.
+const (
+	stageFastStart   = "faststart"
+	stageAspectRatio = "aspect_ratio"
+	stageStoragePut  = "storage_put"
+)
+
+// Background jobs counted by tubely_jobs_in_progress. Uploads are processed
+// while the client waits, so the number in progress is the backlog.
+const (
+	jobVideoProcessing = "video_processing"
+	jobMail            = "mail"
+)
+
+// metrics holds the server's Prometheus collectors. They are registered on
+// their own registry rather than the global one, so any number of servers
+// can be built and inspected in one process.
+type metrics struct {
+	registry         *prometheus.Registry
+	requests         *prometheus.CounterVec
+	requestDuration  *prometheus.HistogramVec
+	requestsInFlight prometheus.Gauge
+	uploadBytes      *prometheus.CounterVec
+	stageDuration    *prometheus.HistogramVec
+	jobsInProgress   *prometheus.GaugeVec
+	dbQueryDuration  *prometheus.HistogramVec
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tubely_http_requests_total",
+			Help: "HTTP requests served, by route pattern and status code.",
+		}, []string{"method", "route", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "tubely_http_request_duration_seconds",
+			Help:    "Time to serve HTTP requests, by route pattern.",
+			Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120},
+		}, []string{"method", "route"}),
+		requestsInFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "tubely_http_requests_in_flight",
+			Help: "HTTP requests being served.",
+		}),
+		uploadBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tubely_upload_bytes_total",
+			Help: "Bytes of uploaded files received, by kind.",
+		}, []string{"kind"}),
+		stageDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "tubely_processing_duration_seconds",
+			Help:    "Time spent in each stage of processing an uploaded video.",
+			Buckets: prometheus.ExponentialBuckets(0.01, 2, 15),
+		}, []string{"stage", "result"}),
+		jobsInProgress: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "tubely_jobs_in_progress",
+			Help: "Background jobs started but not finished, by job.",
+		}, []string{"job"}),
+		dbQueryDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "tubely_db_query_duration_seconds",
+			Help:    "Database call latency, by database client operation.",
+			Buckets: []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, 1},
+		}, []string{"operation"}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests,
+		m.requestDuration,
+		m.requestsInFlight,
+		m.uploadBytes,
+		m.stageDuration,
+		m.jobsInProgress,
+		m.dbQueryDuration,
+	)
+	// Export the job gauges at zero before the first job runs.
+	m.jobsInProgress.WithLabelValues(jobVideoProcessing)
+	m.jobsInProgress.WithLabelValues(jobMail)
+	return m
+}
+
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// server serves GET /metrics on addr. It is separate from the API server so
+// that metrics can be kept off the network clients reach the API on.
+func (m *metrics) server(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", m.handler())
+	return &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		WriteTimeout:      time.Minute,
+	}
+}
+
+// instrument counts and times requests by the route pattern that matched,
+// which keeps the number of series bounded no matter what paths clients
+// request. It has to wrap the router, which records the pattern on the
+// request.
+func (m *metrics) instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		m.requestsInFlight.Inc()
+		defer m.requestsInFlight.Dec()
+
+		next.ServeHTTP(w, r)
+
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		status, _ := responseStats(w)
+		m.requests.WithLabelValues(r.Method, route, strconv.Itoa(status)).Inc()
+		m.requestDuration.WithLabelValues(r.Method, route).Observe(time.Since(start).Seconds())
+	})
+}
+
+// timeStage starts timing a processing stage; call the returned function
+// with the stage's error when it is done.
+func (m *metrics) timeStage(stage string) func(err error) {
+	start := time.Now()
+	return func(err error) {
+		result := "ok"
+		if err != nil {
+			result = "error"
+		}
+		m.stageDuration.WithLabelValues(stage, result).Observe(time.Since(start).Seconds())
+	}
+}
+
+// startJob counts a job as in progress; call the returned function when it
+// is done.
+func (m *metrics) startJob(job string) func() {
+	gauge := m.jobsInProgress.WithLabelValues(job)
+	gauge.Inc()
+	return gauge.Dec
+}
+
+func (m *metrics) observeQuery(operation string, duration time.Duration) {
+	m.dbQueryDuration.WithLabelValues(operation).Observe(duration.Seconds())
+}
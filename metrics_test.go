@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/client"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestMetricsRouteLabels(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := context.Background()
+	c, _ := ts.signup(t, "route@example.com")
+
+	for range 2 {
+		video, err := c.CreateVideo(ctx, client.CreateVideoRequest{Title: "Route"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = c.GetVideo(ctx, video.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	resp, _ := ts.do(t, mustRequest(t, http.MethodGet, ts.URL+"/no/such/path", nil))
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Unknown path answered %d", resp.StatusCode)
+	}
+
+	requests := ts.cfg.metrics.requests
+	tests := []struct {
+		method, route, status string
+		want                  float64
+	}{
+		{"GET", "GET /api/videos/{videoID}", "200", 2},
+		{"POST", "POST /api/videos", "201", 2},
+		{"POST", "POST /api/users", "201", 1},
+		{"POST", "POST /api/login", "200", 1},
+		{"GET", "unmatched", "404", 1},
+	}
+	for _, tt := range tests {
+		got := testutil.ToFloat64(requests.WithLabelValues(tt.method, tt.route, tt.status))
+		if got != tt.want {
+			t.Errorf("tubely_http_requests_total{method=%q,route=%q,status=%q} = %v, want %v", tt.method, tt.route, tt.status, got, tt.want)
+		}
+	}
+
+	// Paths with IDs in them would make a series per video.
+	for _, family := range gather(t, ts.cfg.metrics) {
+		if !strings.HasPrefix(family.GetName(), "tubely_http_") {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			route := label(metric, "route")
+			if family.GetName() != "tubely_http_requests_in_flight" && route != "unmatched" && !strings.Contains(route, " /") {
+				t.Errorf("%s has route label %q, want a route pattern", family.GetName(), route)
+			}
+		}
+	}
+	if got := histogramCount(t, ts.cfg.metrics, "tubely_http_request_duration_seconds", map[string]string{"method": "GET", "route": "GET /api/videos/{videoID}"}); got != 2 {
+		t.Errorf("Request duration count of GET /api/videos/{videoID} = %d, want 2", got)
+	}
+	if got := testutil.ToFloat64(ts.cfg.metrics.requestsInFlight); got != 0 {
+		t.Errorf("Requests in flight after all were answered = %v, want 0", got)
+	}
+}
+
+func TestMetricsUploads(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := context.Background()
+	c, _ := ts.signup(t, "upload@example.com")
+
+	video, err := c.CreateVideo(ctx, client.CreateVideoRequest{Title: "Upload"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := strings.Repeat("video bytes ", 1000)
+	_, err = c.UploadVideo(ctx, video.ID, testVideo(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	thumbnail := strings.Repeat("png", 100)
+	_, err = c.UploadThumbnail(ctx, video.ID, client.File{Name: "thumb.png", ContentType: "image/png", Content: strings.NewReader(thumbnail)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.UploadVideo(ctx, video.ID, testVideo("notavideo"))
+	if err == nil {
+		t.Fatal("Upload of an invalid video succeeded")
+	}
+
+	uploadBytes := ts.cfg.metrics.uploadBytes
+	if got, want := testutil.ToFloat64(uploadBytes.WithLabelValues("video")), float64(len(content)+len("notavideo")); got != want {
+		t.Errorf("Video upload bytes = %v, want %v", got, want)
+	}
+	if got, want := testutil.ToFloat64(uploadBytes.WithLabelValues("thumbnail")), float64(len(thumbnail)); got != want {
+		t.Errorf("Thumbnail upload bytes = %v, want %v", got, want)
+	}
+
+	stages := []struct {
+		stage, result string
+		want          uint64
+	}{
+		{stageFastStart, "ok", 1},
+		{stageFastStart, "error", 1},
+		{stageAspectRatio, "ok", 1},
+		{stageAspectRatio, "error", 0},
+		{stageStoragePut, "ok", 1},
+		{stageStoragePut, "error", 0},
+	}
+	for _, tt := range stages {
+		got := histogramCount(t, ts.cfg.metrics, "tubely_processing_duration_seconds", map[string]string{"stage": tt.stage, "result": tt.result})
+		if got != tt.want {
+			t.Errorf("Processing duration count of stage %s, result %s = %d, want %d", tt.stage, tt.result, got, tt.want)
+		}
+	}
+
+	if got := histogramCount(t, ts.cfg.metrics, "tubely_db_query_duration_seconds", map[string]string{"operation": "CreateContentHash"}); got != 1 {
+		t.Errorf("Database call count of CreateContentHash = %d, want 1", got)
+	}
+}
+
+func TestMetricsJobGauges(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := context.Background()
+	c, _ := ts.signup(t, "jobs@example.com")
+	jobs := ts.cfg.metrics.jobsInProgress
+
+	for _, job := range []string{jobVideoProcessing, jobMail} {
+		if got := testutil.ToFloat64(jobs.WithLabelValues(job)); got != 0 {
+			t.Errorf("Jobs in progress of %s before any ran = %v, want 0", job, got)
+		}
+	}
+
+	// Hold up mail while its job is counted.
+	ts.mail.mu.Lock()
+	ts.mail.block = make(chan struct{})
+	ts.mail.mu.Unlock()
+	err := ts.client().RequestPasswordReset(ctx, client.PasswordResetRequest{Email: "jobs@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForGauge(t, jobs.WithLabelValues(jobMail), 1)
+	close(ts.mail.block)
+	ts.cfg.background.Wait()
+	waitForGauge(t, jobs.WithLabelValues(jobMail), 0)
+
+	// Hold up ffmpeg while the upload is processed.
+	gate := filepath.Join(t.TempDir(), "gate")
+	err = os.WriteFile(gate, nil, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TUBELY_TEST_FFMPEG_GATE", gate)
+	video, err := c.CreateVideo(ctx, client.CreateVideoRequest{Title: "Jobs"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploaded := make(chan error, 1)
+	go func() {
+		_, err := c.UploadVideo(ctx, video.ID, testVideo("a video"))
+		uploaded <- err
+	}()
+	waitForGauge(t, jobs.WithLabelValues(jobVideoProcessing), 1)
+	err = os.Remove(gate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = <-uploaded
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForGauge(t, jobs.WithLabelValues(jobVideoProcessing), 0)
+}
+
+func TestMetricsHandler(t *testing.T) {
+	ts := newTestServer(t)
+	ts.signup(t, "scrape@example.com")
+
+	// Metrics are only served on their own listener.
+	resp, err := ts.Client().Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /metrics on the API server answered %d", resp.StatusCode)
+	}
+
+	rec := httptest.NewRecorder()
+	ts.cfg.metrics.server("").Handler.ServeHTTP(rec, mustRequest(t, http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /metrics answered %d", rec.Code)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		`tubely_http_requests_total{method="POST",route="POST /api/users",status="201"} 1`,
+		`tubely_jobs_in_progress{job="mail"} 0`,
+		`tubely_jobs_in_progress{job="video_processing"} 0`,
+		`tubely_db_query_duration_seconds_count{operation="CreateUser"} 1`,
+		"go_goroutines ",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("GET /metrics lacks %q", want)
+		}
+	}
+}
+
+func mustRequest(t *testing.T, method, url string, body []byte) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func gather(t *testing.T, m *metrics) []*dto.MetricFamily {
+	t.Helper()
+	families, err := m.registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return families
+}
+
+func label(metric *dto.Metric, name string) string {
+	for _, l := range metric.GetLabel() {
+		if l.GetName() == name {
+			return l.GetValue()
+		}
+	}
+	return ""
+}
+
+// histogramCount returns the number of observations of the histogram
+// series with labels, or 0 if there is none.
+func histogramCount(t *testing.T, m *metrics, name string, labels map[string]string) uint64 {
+	t.Helper()
+	for _, family := range gather(t, m) {
+		if family.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, metric := range family.GetMetric() {
+			for k, v := range labels {
+				if label(metric, k) != v {
+					continue metrics
+				}
+			}
+			return metric.GetHistogram().GetSampleCount()
+		}
+	}
+	return 0
+}
+
+// waitForGauge waits for a gauge changed by a background job to reach want.
+func waitForGauge(t *testing.T, gauge prometheus.Gauge, want float64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := testutil.ToFloat64(gauge)
+		if got == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Gauge is %v, want %v", got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+type principalKind string
+
+const (
+	principalAnonymous principalKind = "anonymous"
+	principalUser      principalKind = "user"
+	principalAPIKey    principalKind = "api_key"
+)
+
+// principal is whoever a request acts on behalf of.
+type principal struct {
+	Kind     principalKind
+	UserID   uuid.UUID
+	Role     database.Role
+	APIKeyID uuid.UUID
+	// Scopes granted to an API key. Users logged in with a JWT have every
+	// scope.
+	Scopes []string
+}
+
+func (p principal) authenticated() bool {
+	return p.Kind != principalAnonymous
+}
+
+// can reports whether the principal holds a privileged permission. Privileges
+// are never delegated to API keys.
+func (p principal) can(perm permission) bool {
+	return p.Kind == principalUser && roleHasPermission(p.Role, perm)
+}
+
+func (p principal) hasScope(scope string) bool {
+	switch p.Kind {
+	case principalUser:
+		return true
+	case principalAPIKey:
+		for _, s := range p.Scopes {
+			if s == scope {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// authRequirement declares, per route, who may call it.
+type authRequirement struct {
+	// optional lets anonymous requests through. Credentials that are sent
+	// must still be valid.
+	optional bool
+	// userOnly rejects API keys, for routes that manage the account itself.
+	userOnly bool
+	// scope an API key must have been granted.
+	scope string
+	// permission the user's role must grant.
+	permission permission
+}
+
+var requireUser = authRequirement{userOnly: true}
+
+func requireScope(scope string) authRequirement {
+	return authRequirement{scope: scope}
+}
+
+func requirePermission(perm permission) authRequirement {
+	return authRequirement{userOnly: true, permission: perm}
+}
+
+func optionalScope(scope string) authRequirement {
+	return authRequirement{optional: true, scope: scope}
+}
+
+type contextKey int
+
+const principalContextKey contextKey = iota
+
+var (
+	errInvalidCredentials = errors.New("invalid credentials")
+	errAccountDisabled    = errors.New("account is disabled")
+)
+
+// withAuth resolves the request's principal, enforces req and stores the
+// principal in the request context for the handler.
+func (cfg *apiConfig) withAuth(req authRequirement, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, err := cfg.resolvePrincipal(r)
+		if errors.Is(err, errInvalidCredentials) {
+			respondUnauthorized(w, codeInvalidToken, "Invalid credentials", err)
+			return
+		}
+		if errors.Is(err, errAccountDisabled) {
+			respondWithErrorCode(w, http.StatusForbidden, codeAccountDisabled, "Account is disabled", err)
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't authenticate request", err)
+			return
+		}
+
+		if p.authenticated() {
+			addLogAttrs(r.Context(), slog.String("user_id", p.UserID.String()))
+			if p.Kind == principalAPIKey {
+				addLogAttrs(r.Context(), slog.String("api_key_id", p.APIKeyID.String()))
+			}
+		}
+
+		if !p.authenticated() {
+			if !req.optional {
+				respondUnauthorized(w, codeUnauthorized, "Authentication required", nil)
+				return
+			}
+		} else {
+			if req.userOnly && p.Kind != principalUser {
+				respondWithError(w, http.StatusForbidden, "API keys can't be used for this endpoint", nil)
+				return
+			}
+			if req.scope != "" && !p.hasScope(req.scope) {
+				respondWithErrorCode(w, http.StatusForbidden, codeInsufficientScope, fmt.Sprintf("API key lacks the %s scope", req.scope), nil)
+				return
+			}
+			if req.permission != "" && !p.can(req.permission) {
+				respondWithError(w, http.StatusForbidden, "You don't have permission to do this", nil)
+				return
+			}
+		}
+
+		ctx := context.WithValue(r.Context(), principalContextKey, p)
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// resolvePrincipal authenticates the Authorization header, which may hold a
+// Bearer access JWT, an ApiKey or nothing at all, and loads the user's role.
+func (cfg *apiConfig) resolvePrincipal(r *http.Request) (principal, error) {
+	p, err := cfg.resolveCredentials(r)
+	if err != nil || !p.authenticated() {
+		return p, err
+	}
+
+	user, err := cfg.db.WithContext(r.Context()).GetUser(p.UserID)
+	if err != nil {
+		return principal{}, err
+	}
+	if user == nil {
+		return principal{}, fmt.Errorf("%w: user %v no longer exists", errInvalidCredentials, p.UserID)
+	}
+	if user.DisabledAt != nil {
+		return principal{}, fmt.Errorf("%w: user %v", errAccountDisabled, p.UserID)
+	}
+	p.Role = user.Role
+	return p, nil
+}
+
+func (cfg *apiConfig) resolveCredentials(r *http.Request) (principal, error) {
+	header := r.Header.Get("Authorization")
+	switch {
+	case header == "":
+		return principal{Kind: principalAnonymous}, nil
+
+	case strings.HasPrefix(header, "ApiKey "):
+		rawKey, err := auth.GetAPIKey(r.Header)
+		if err != nil {
+			return principal{}, fmt.Errorf("%w: %v", errInvalidCredentials, err)
+		}
+		keyID, err := auth.ParseAPIKeyID(rawKey)
+		if err != nil {
+			return principal{}, fmt.Errorf("%w: %v", errInvalidCredentials, err)
+		}
+		key, err := cfg.db.WithContext(r.Context()).GetAPIKeyByPrefix(keyID)
+		if err != nil {
+			return principal{}, err
+		}
+		if key.KeyHash == "" || subtle.ConstantTimeCompare([]byte(key.KeyHash), []byte(auth.HashAPIKey(rawKey))) != 1 {
+			return principal{}, fmt.Errorf("%w: unknown API key", errInvalidCredentials)
+		}
+		if key.RevokedAt != nil {
+			return principal{}, fmt.Errorf("%w: API key has been revoked", errInvalidCredentials)
+		}
+		if key.ExpiresAt != nil && time.Now().UTC().After(*key.ExpiresAt) {
+			return principal{}, fmt.Errorf("%w: API key has expired", errInvalidCredentials)
+		}
+		err = cfg.db.WithContext(r.Context()).TouchAPIKey(key.ID)
+		if err != nil {
+			requestLogger(r.Context()).Warn("Couldn't update last use of API key", slog.String("api_key_id", key.ID.String()), slog.Any("err", err))
+		}
+		return principal{
+			Kind:     principalAPIKey,
+			UserID:   key.UserID,
+			APIKeyID: key.ID,
+			Scopes:   key.Scopes,
+		}, nil
+
+	default:
+		token, err := auth.GetBearerToken(r.Header)
+		if err != nil {
+			return principal{}, fmt.Errorf("%w: %v", errInvalidCredentials, err)
+		}
+		accessToken, err := auth.ValidateJWT(token, cfg.jwtKeys, cfg.denylist)
+		if errors.Is(err, auth.ErrRevocationCheckFailed) {
+			return principal{}, err
+		}
+		if err != nil {
+			return principal{}, fmt.Errorf("%w: %v", errInvalidCredentials, err)
+		}
+		return principal{
+			Kind:   principalUser,
+			UserID: accessToken.UserID,
+		}, nil
+	}
+}
+
+func respondUnauthorized(w http.ResponseWriter, errCode errorCode, msg string, err error) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="tubely", ApiKey realm="tubely"`)
+	respondWithErrorCode(w, http.StatusUnauthorized, errCode, msg, err)
+}
+
+// principalFromContext returns the principal resolved by withAuth.
+func principalFromContext(ctx context.Context) principal {
+	p, ok := ctx.Value(principalContextKey).(principal)
+	if !ok {
+		return principal{Kind: principalAnonymous}
+	}
+	return p
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/client"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/oidc"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	fakeIdPClientID     = "tubely"
+	fakeIdPClientSecret = "tubely secret"
+	fakeIdPKeyID        = "test-key"
+)
+
+// fakeIdP is an OpenID provider serving discovery, its signing keys and a
+// token endpoint. Tests play the user's part at the authorization endpoint
+// with authorize.
+type fakeIdP struct {
+	*httptest.Server
+	t   *testing.T
+	key *rsa.PrivateKey
+
+	mu     sync.Mutex
+	logins map[string]fakeIdPLogin
+	// verifiers are the PKCE verifiers the token endpoint received.
+	verifiers []string
+}
+
+// fakeIdPLogin is a login at the provider waiting for its code to be
+// exchanged. claims override and, where nil, remove the ID token's default
+// claims.
+type fakeIdPLogin struct {
+	redirectURI   string
+	codeChallenge string
+	nonce         string
+	claims        jwt.MapClaims
+	kid           string
+}
+
+func newFakeIdP(t *testing.T) *fakeIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &fakeIdP{t: t, key: key, logins: map[string]fakeIdPLogin{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		respondWithJSON(w, http.StatusOK, map[string]string{
+			"issuer":                 idp.URL,
+			"authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint":         idp.URL + "/token",
+			"jwks_uri":               idp.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		respondWithJSON(w, http.StatusOK, map[string]any{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": fakeIdPKeyID,
+				"use": "sig",
+				"alg": "RS256",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("POST /token", idp.handlerToken)
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+func (idp *fakeIdP) handlerToken(w http.ResponseWriter, r *http.Request) {
+	tokenError := func(code string) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": code})
+	}
+
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok || clientID != fakeIdPClientID || clientSecret != url.QueryEscape(fakeIdPClientSecret) {
+		tokenError("invalid_client")
+		return
+	}
+	err := r.ParseForm()
+	if err != nil || r.PostForm.Get("grant_type") != "authorization_code" {
+		tokenError("invalid_request")
+		return
+	}
+
+	idp.mu.Lock()
+	login, ok := idp.logins[r.PostForm.Get("code")]
+	delete(idp.logins, r.PostForm.Get("code"))
+	verifier := r.PostForm.Get("code_verifier")
+	idp.verifiers = append(idp.verifiers, verifier)
+	idp.mu.Unlock()
+	if !ok || r.PostForm.Get("redirect_uri") != login.redirectURI || oidc.PKCEChallenge(verifier) != login.codeChallenge {
+		tokenError("invalid_grant")
+		return
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":            idp.URL,
+		"aud":            fakeIdPClientID,
+		"sub":            "subject",
+		"iat":            now.Unix(),
+		"exp":            now.Add(5 * time.Minute).Unix(),
+		"nonce":          login.nonce,
+		"email_verified": true,
+	}
+	for name, value := range login.claims {
+		if value == nil {
+			delete(claims, name)
+			continue
+		}
+		claims[name] = value
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = login.kid
+	idToken, err := token.SignedString(idp.key)
+	if err != nil {
+		idp.t.Errorf("Couldn't sign ID token: %v", err)
+		tokenError("server_error")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{
+		"access_token": "access token",
+		"token_type":   "Bearer",
+		"id_token":     idToken,
+	})
+}
+
+// authorize logs the user in at the provider for the authorization request
+// authURL and returns the state and code the provider sends the browser
+// back with. The ID token gets claims and is signed with kid, or the
+// provider's key if kid is empty.
+func (idp *fakeIdP) authorize(t *testing.T, authURL string, claims jwt.MapClaims, kid string) (state, code string) {
+	t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := u.Scheme + "://" + u.Host + u.Path; got != idp.URL+"/authorize" {
+		t.Fatalf("Login was sent to %s, want the authorization endpoint", got)
+	}
+	query := u.Query()
+	for name, want := range map[string]string{
+		"response_type":         "code",
+		"client_id":             fakeIdPClientID,
+		"code_challenge_method": "S256",
+	} {
+		if got := query.Get(name); got != want {
+			t.Errorf("Authorization request has %s %q, want %q", name, got, want)
+		}
+	}
+	for _, name := range []string{"state", "nonce", "code_challenge", "redirect_uri"} {
+		if query.Get(name) == "" {
+			t.Fatalf("Authorization request has no %s", name)
+		}
+	}
+
+	if kid == "" {
+		kid = fakeIdPKeyID
+	}
+	code, err = oidc.RandomString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.logins[code] = fakeIdPLogin{
+		redirectURI:   query.Get("redirect_uri"),
+		codeChallenge: query.Get("code_challenge"),
+		nonce:         query.Get("nonce"),
+		claims:        claims,
+		kid:           kid,
+	}
+	return query.Get("state"), code
+}
+
+// oidcBrowser is a browser going through single sign-on at the test server.
+type oidcBrowser struct {
+	ts   *testServer
+	http *http.Client
+}
+
+func newOIDCBrowser(t *testing.T, ts *testServer) *oidcBrowser {
+	t.Helper()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc := *ts.httpClient
+	hc.Jar = jar
+	return &oidcBrowser{ts: ts, http: &hc}
+}
+
+// start starts a login and returns the provider URL it redirects to.
+func (b *oidcBrowser) start(t *testing.T) string {
+	t.Helper()
+	resp, body := b.get(t, "/api/oidc/login")
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("Starting login answered %d: %s", resp.StatusCode, body)
+	}
+	return resp.Header.Get("Location")
+}
+
+// callback comes back from the provider and returns the response.
+func (b *oidcBrowser) callback(t *testing.T, state, code string) (*http.Response, string) {
+	t.Helper()
+	return b.get(t, "/api/oidc/callback?"+url.Values{"state": {state}, "code": {code}}.Encode())
+}
+
+// login goes through single sign-on as the user claims describes and
+// trades the login code for a session.
+func (b *oidcBrowser) login(t *testing.T, idp *fakeIdP, claims jwt.MapClaims) *client.LoginResponse {
+	t.Helper()
+	state, code := idp.authorize(t, b.start(t), claims, "")
+	resp, body := b.callback(t, state, code)
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("Callback answered %d: %s", resp.StatusCode, body)
+	}
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	loginCode := location.Query().Get("login_code")
+	if loginCode == "" {
+		t.Fatalf("Callback redirected to %s, want a login code", location)
+	}
+	session, err := b.ts.client().LoginOIDC(context.Background(), client.LoginOIDCRequest{Code: loginCode})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.LoginSession == nil {
+		t.Fatal("Single sign-on asked for a second factor")
+	}
+	return session
+}
+
+func (b *oidcBrowser) get(t *testing.T, path string) (*http.Response, string) {
+	t.Helper()
+	req := mustRequest(t, http.MethodGet, b.ts.URL+path, nil)
+	resp, err := b.http.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(body)
+}
+
+// newOIDCTestServer returns a test server using a fake provider for single
+// sign-on.
+func newOIDCTestServer(t *testing.T) (*testServer, *fakeIdP) {
+	t.Helper()
+	ts := newTestServer(t)
+	idp := newFakeIdP(t)
+	ts.cfg.oidc = oidc.NewProvider(idp.URL, fakeIdPClientID, fakeIdPClientSecret, ts.URL+"/api/oidc/callback")
+	return ts, idp
+}
+
+func TestOIDCLoginNewUser(t *testing.T) {
+	ts, idp := newOIDCTestServer(t)
+	ctx := context.Background()
+	b := newOIDCBrowser(t, ts)
+
+	session := b.login(t, idp, jwt.MapClaims{"sub": "new-user", "email": "Grace@Example.com"})
+	if session.Email != "grace@example.com" {
+		t.Errorf("New user has email %q, want grace@example.com", session.Email)
+	}
+	if session.EmailVerifiedAt == nil {
+		t.Error("New user's email isn't verified, though the provider verified it")
+	}
+
+	idp.mu.Lock()
+	verifiers := idp.verifiers
+	idp.mu.Unlock()
+	if len(verifiers) != 1 || verifiers[0] == "" {
+		t.Errorf("Token endpoint received verifiers %q, want one", verifiers)
+	}
+
+	identities, err := ts.client(client.WithToken(session.Token)).ListIdentities(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(identities) != 1 || identities[0].Issuer != idp.URL || identities[0].Subject != "new-user" {
+		t.Errorf("New user's identities are %+v, want subject new-user of %s", identities, idp.URL)
+	}
+
+	// The identity logs in as the same user, whatever email it has now.
+	again := b.login(t, idp, jwt.MapClaims{"sub": "new-user", "email": "grace@example.org"})
+	if again.ID != session.ID {
+		t.Errorf("Second login is user %s, want %s", again.ID, session.ID)
+	}
+}
+
+func TestOIDCLoginExistingUser(t *testing.T) {
+	ts, idp := newOIDCTestServer(t)
+	ctx := context.Background()
+	b := newOIDCBrowser(t, ts)
+	c, user := ts.signup(t, "frank@example.com")
+
+	// An unverified account could be someone else's claim to the address.
+	state, code := idp.authorize(t, b.start(t), jwt.MapClaims{"sub": "frank", "email": "frank@example.com"}, "")
+	resp, body := b.callback(t, state, code)
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("Callback for an unverified account answered %d, want %d: %s", resp.StatusCode, http.StatusConflict, body)
+	}
+
+	err := c.RequestEmailVerification(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ts.client().ConfirmEmailVerification(ctx, client.TokenRequest{Token: ts.mailedToken(t, "frank@example.com")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := b.login(t, idp, jwt.MapClaims{"sub": "frank", "email": "frank@example.com"})
+	if session.ID != user.ID {
+		t.Errorf("Single sign-on logged in user %s, want %s", session.ID, user.ID)
+	}
+	identities, err := c.ListIdentities(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(identities) != 1 || identities[0].Subject != "frank" {
+		t.Errorf("Frank's identities are %+v, want subject frank", identities)
+	}
+}
+
+func TestOIDCLoginRejected(t *testing.T) {
+	ts, idp := newOIDCTestServer(t)
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		kid    string
+		// state replaces the state the provider sends back if set.
+		state      string
+		wantStatus int
+	}{
+		{name: "wrong state", state: "forged", wantStatus: http.StatusBadRequest},
+		{name: "wrong nonce", claims: jwt.MapClaims{"nonce": "replayed"}, wantStatus: http.StatusUnauthorized},
+		{name: "no nonce", claims: jwt.MapClaims{"nonce": nil}, wantStatus: http.StatusUnauthorized},
+		{name: "expired", claims: jwt.MapClaims{"iat": now.Add(-time.Hour).Unix(), "exp": now.Add(-10 * time.Minute).Unix()}, wantStatus: http.StatusUnauthorized},
+		{name: "unknown key", kid: "other-key", wantStatus: http.StatusUnauthorized},
+		{name: "wrong audience", claims: jwt.MapClaims{"aud": "other-client"}, wantStatus: http.StatusUnauthorized},
+		{name: "wrong issuer", claims: jwt.MapClaims{"iss": "https://idp.example.com"}, wantStatus: http.StatusUnauthorized},
+		{name: "unverified email", claims: jwt.MapClaims{"email_verified": false}, wantStatus: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newOIDCBrowser(t, ts)
+			// A login that wrongly succeeds mustn't link the identity the
+			// next case uses.
+			claims := jwt.MapClaims{"sub": tt.name, "email": "mallory@example.com"}
+			for name, value := range tt.claims {
+				claims[name] = value
+			}
+			state, code := idp.authorize(t, b.start(t), claims, tt.kid)
+			if tt.state != "" {
+				state = tt.state
+			}
+			resp, body := b.callback(t, state, code)
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("Callback answered %d, want %d: %s", resp.StatusCode, tt.wantStatus, body)
+			}
+		})
+	}
+
+	users, err := ts.cfg.db.GetUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 0 {
+		t.Errorf("Rejected logins created %d users", len(users))
+	}
+}
+
+func TestOIDCLoginNotConfigured(t *testing.T) {
+	ts := newTestServer(t)
+	b := newOIDCBrowser(t, ts)
+	for _, path := range []string{"/api/oidc/login", "/api/oidc/callback?state=x&code=y"} {
+		resp, body := b.get(t, path)
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("GET %s without single sign-on answered %d, want %d: %s", path, resp.StatusCode, http.StatusNotFound, body)
+		}
+	}
+}
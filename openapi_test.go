@@ -0,0 +1,1048 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"mime"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/client"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// openAPIDoc is the parts of the embedded OpenAPI document the tests check
+// responses against.
+type openAPIDoc struct {
+	Paths      map[string]map[string]openAPIOperation `json:"paths"`
+	Components struct {
+		Responses map[string]openAPIResponse `json:"responses"`
+		Schemas   map[string]any             `json:"schemas"`
+	} `json:"components"`
+}
+
+type openAPIOperation struct {
+	OperationID string                     `json:"operationId"`
+	Responses   map[string]openAPIResponse `json:"responses"`
+}
+
+type openAPIResponse struct {
+	Ref     string `json:"$ref"`
+	Content map[string]struct {
+		Schema any `json:"schema"`
+	} `json:"content"`
+}
+
+func loadOpenAPIDoc(t testing.TB) *openAPIDoc {
+	t.Helper()
+	var doc openAPIDoc
+	err := json.Unmarshal(openAPISpec, &doc)
+	if err != nil {
+		t.Fatalf("Couldn't parse openapi.json: %v", err)
+	}
+	return &doc
+}
+
+// operation finds the operation serving method and path, and its path
+// template.
+func (doc *openAPIDoc) operation(method, path string) (string, openAPIOperation, bool) {
+	requested := strings.Split(path, "/")
+	for template, ops := range doc.Paths {
+		segments := strings.Split(template, "/")
+		if len(segments) != len(requested) {
+			continue
+		}
+		match := true
+		for i, segment := range segments {
+			isParam := strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}")
+			if !isParam && segment != requested[i] || isParam && requested[i] == "" {
+				match = false
+				break
+			}
+		}
+		if !match {
+			continue
+		}
+		op, ok := ops[strings.ToLower(method)]
+		if ok {
+			return template, op, true
+		}
+	}
+	return "", openAPIOperation{}, false
+}
+
+// checkResponse reports how a response differs from what the document
+// promises for the request: an undocumented status, a media type that isn't
+// one of the response's, or a body that doesn't match its schema.
+func (doc *openAPIDoc) checkResponse(method, path string, status int, contentType string, body []byte) (operationID string, problems []string) {
+	template, op, ok := doc.operation(method, path)
+	if !ok {
+		// The router answers requests no route matches; TestOpenAPIRoutes
+		// checks the routes.
+		return "", nil
+	}
+	resp, ok := op.Responses[strconv.Itoa(status)]
+	if !ok {
+		return op.OperationID, []string{fmt.Sprintf("%s %s: status %d isn't documented", method, template, status)}
+	}
+	if resp.Ref != "" {
+		resp = doc.Components.Responses[strings.TrimPrefix(resp.Ref, "#/components/responses/")]
+	}
+
+	if len(resp.Content) == 0 {
+		// Redirects carry a short HTML note for browsers.
+		if len(body) > 0 && status/100 != 3 {
+			return op.OperationID, []string{fmt.Sprintf("%s %s: status %d has a body but documents none", method, template, status)}
+		}
+		return op.OperationID, nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return op.OperationID, []string{fmt.Sprintf("%s %s: status %d has Content-Type %q", method, template, status, contentType)}
+	}
+	content, ok := resp.Content[mediaType]
+	if !ok {
+		return op.OperationID, []string{fmt.Sprintf("%s %s: status %d has Content-Type %s, documented are %v", method, template, status, mediaType, slices.Sorted(mapKeys(resp.Content)))}
+	}
+	if mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json") {
+		return op.OperationID, nil
+	}
+
+	var value any
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	err = dec.Decode(&value)
+	if err != nil {
+		return op.OperationID, []string{fmt.Sprintf("%s %s: status %d body isn't JSON: %v", method, template, status, err)}
+	}
+	for _, p := range doc.validate(content.Schema, value, "body", false) {
+		problems = append(problems, fmt.Sprintf("%s %s: status %d %s", method, template, status, p))
+	}
+	return op.OperationID, problems
+}
+
+func mapKeys[V any](m map[string]V) func(yield func(string) bool) {
+	return func(yield func(string) bool) {
+		for k := range m {
+			if !yield(k) {
+				return
+			}
+		}
+	}
+}
+
+var dateTimeRegexp = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(\.\d+)?(Z|[+-]\d{2}:\d{2})$`)
+
+// validate checks value against a JSON schema of the document. It supports
+// the keywords the document uses. Objects may only have the properties their
+// schema lists unless allowExtra is set, which allOf uses to check each of
+// its parts.
+func (doc *openAPIDoc) validate(schema any, value any, at string, allowExtra bool) []string {
+	s, ok := schema.(map[string]any)
+	if !ok {
+		return nil
+	}
+	if ref, ok := s["$ref"].(string); ok {
+		return doc.validate(doc.Components.Schemas[strings.TrimPrefix(ref, "#/components/schemas/")], value, at, allowExtra)
+	}
+
+	var problems []string
+	fail := func(format string, args ...any) {
+		problems = append(problems, at+": "+fmt.Sprintf(format, args...))
+	}
+
+	if all, ok := s["allOf"].([]any); ok {
+		for _, part := range all {
+			problems = append(problems, doc.validate(part, value, at, true)...)
+		}
+		if obj, ok := value.(map[string]any); ok && !allowExtra {
+			known := doc.properties(s)
+			for name := range obj {
+				if !known[name] {
+					fail("has undocumented property %q", name)
+				}
+			}
+		}
+		return problems
+	}
+	if one, ok := s["oneOf"].([]any); ok {
+		matches := 0
+		for _, branch := range one {
+			if len(doc.validate(branch, value, at, allowExtra)) == 0 {
+				matches++
+			}
+		}
+		if matches != 1 {
+			fail("matches %d of the oneOf schemas, want 1", matches)
+		}
+		return problems
+	}
+
+	if typ, ok := s["type"]; ok && !matchesType(typ, value) {
+		fail("is %s, want type %v", jsonType(value), typ)
+		return problems
+	}
+	if enum, ok := s["enum"].([]any); ok && !slices.ContainsFunc(enum, func(e any) bool { return jsonEqual(e, value) }) {
+		fail("is %v, want one of %v", value, enum)
+	}
+	if c, ok := s["const"]; ok && !jsonEqual(c, value) {
+		fail("is %v, want %v", value, c)
+	}
+
+	switch v := value.(type) {
+	case string:
+		if min, ok := s["minLength"].(float64); ok && float64(len([]rune(v))) < min {
+			fail("is shorter than %v", min)
+		}
+		if max, ok := s["maxLength"].(float64); ok && float64(len([]rune(v))) > max {
+			fail("is longer than %v", max)
+		}
+		if !validFormat(s["format"], v) {
+			fail("%q isn't a valid %v", v, s["format"])
+		}
+	case json.Number:
+		n, _ := v.Float64()
+		if min, ok := s["minimum"].(float64); ok && n < min {
+			fail("is less than %v", min)
+		}
+		if max, ok := s["maximum"].(float64); ok && n > max {
+			fail("is more than %v", max)
+		}
+	case []any:
+		if min, ok := s["minItems"].(float64); ok && float64(len(v)) < min {
+			fail("has fewer than %v items", min)
+		}
+		for i, item := range v {
+			problems = append(problems, doc.validate(s["items"], item, fmt.Sprintf("%s[%d]", at, i), false)...)
+		}
+	case map[string]any:
+		properties, _ := s["properties"].(map[string]any)
+		if required, ok := s["required"].([]any); ok {
+			for _, name := range required {
+				if _, ok := v[name.(string)]; !ok {
+					fail("lacks required property %q", name)
+				}
+			}
+		}
+		names := slices.Sorted(mapKeys(v))
+		for _, name := range names {
+			if property, ok := properties[name]; ok {
+				problems = append(problems, doc.validate(property, v[name], at+"."+name, false)...)
+				continue
+			}
+			switch additional := s["additionalProperties"].(type) {
+			case map[string]any:
+				problems = append(problems, doc.validate(additional, v[name], at+"."+name, false)...)
+			case bool:
+				if !additional {
+					fail("has undocumented property %q", name)
+				}
+			default:
+				// Objects without listed properties are free-form.
+				if !allowExtra && properties != nil {
+					fail("has undocumented property %q", name)
+				}
+			}
+		}
+	}
+	return problems
+}
+
+// properties lists the properties a schema defines, through allOf and
+// references.
+func (doc *openAPIDoc) properties(schema any) map[string]bool {
+	known := map[string]bool{}
+	s, ok := schema.(map[string]any)
+	if !ok {
+		return known
+	}
+	if ref, ok := s["$ref"].(string); ok {
+		return doc.properties(doc.Components.Schemas[strings.TrimPrefix(ref, "#/components/schemas/")])
+	}
+	properties, _ := s["properties"].(map[string]any)
+	for name := range properties {
+		known[name] = true
+	}
+	if all, ok := s["allOf"].([]any); ok {
+		for _, part := range all {
+			for name := range doc.properties(part) {
+				known[name] = true
+			}
+		}
+	}
+	return known
+}
+
+func jsonType(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return "integer"
+		}
+		return "number"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func matchesType(typ any, value any) bool {
+	var types []string
+	switch t := typ.(type) {
+	case string:
+		types = []string{t}
+	case []any:
+		for _, s := range t {
+			types = append(types, s.(string))
+		}
+	}
+	actual := jsonType(value)
+	for _, want := range types {
+		if want == actual || want == "number" && actual == "integer" {
+			return true
+		}
+	}
+	return false
+}
+
+func jsonEqual(a, b any) bool {
+	if n, ok := b.(json.Number); ok {
+		f, err := n.Float64()
+		return err == nil && a == f
+	}
+	return a == b
+}
+
+func validFormat(format any, s string) bool {
+	switch format {
+	case "uuid":
+		_, err := uuid.Parse(s)
+		return err == nil
+	case "date-time":
+		_, err := time.Parse(time.RFC3339Nano, s)
+		return err == nil && dateTimeRegexp.MatchString(s)
+	case "email":
+		_, err := mail.ParseAddress(s)
+		return err == nil
+	case "uri":
+		u, err := url.Parse(s)
+		return err == nil && u.Scheme != ""
+	}
+	return true
+}
+
+// specTransport checks every response against the OpenAPI document and
+// records which operations answered with which status.
+type specTransport struct {
+	t    testing.TB
+	doc  *openAPIDoc
+	base http.RoundTripper
+
+	mu sync.Mutex
+	// seen maps operation IDs to the statuses they answered with.
+	seen map[string]map[int]bool
+}
+
+func (st *specTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := st.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	operationID, problems := st.doc.checkResponse(req.Method, req.URL.Path, resp.StatusCode, resp.Header.Get("Content-Type"), body)
+	for _, p := range problems {
+		st.t.Errorf("Response doesn't match openapi.json: %s\n%s", p, body)
+	}
+	if operationID != "" {
+		st.mu.Lock()
+		if st.seen[operationID] == nil {
+			st.seen[operationID] = map[int]bool{}
+		}
+		st.seen[operationID][resp.StatusCode] = true
+		st.mu.Unlock()
+	}
+	return resp, nil
+}
+
+// statuses returns the statuses an operation answered with, sorted.
+func (st *specTransport) statuses(operationID string) []int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var statuses []int
+	for status := range st.seen[operationID] {
+		statuses = append(statuses, status)
+	}
+	sort.Ints(statuses)
+	return statuses
+}
+
+func TestOpenAPIRoutes(t *testing.T) {
+	doc := loadOpenAPIDoc(t)
+
+	documented := map[string]bool{}
+	for path, ops := range doc.Paths {
+		for method := range ops {
+			documented[strings.ToUpper(method)+" "+path] = true
+		}
+	}
+
+	// Read the routes from main.go rather than the router, which can't list
+	// them.
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "main.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registered := map[string]bool{}
+	ast.Inspect(file, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok || len(call.Args) == 0 {
+			return true
+		}
+		sel, ok := call.Fun.(*ast.SelectorExpr)
+		if !ok || sel.Sel.Name != "Handle" && sel.Sel.Name != "HandleFunc" {
+			return true
+		}
+		lit, ok := call.Args[0].(*ast.BasicLit)
+		if !ok || lit.Kind != token.STRING {
+			t.Errorf("%v: route pattern isn't a string literal", fset.Position(call.Pos()))
+			return true
+		}
+		pattern, err := strconv.Unquote(lit.Value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The web app and thumbnails are static files, not API.
+		if !strings.Contains(pattern, " ") {
+			return true
+		}
+		registered[pattern] = true
+		return true
+	})
+	if len(registered) == 0 {
+		t.Fatal("Found no routes in main.go")
+	}
+
+	for route := range registered {
+		if !documented[route] {
+			t.Errorf("Route %s isn't in openapi.json", route)
+		}
+	}
+	for route := range documented {
+		if !registered[route] {
+			t.Errorf("openapi.json documents %s, which main.go doesn't serve", route)
+		}
+	}
+}
+
+func TestOpenAPICheckResponse(t *testing.T) {
+	doc := loadOpenAPIDoc(t)
+	const user = `{"id":"5f0c7a3e-8d0b-4c47-9f2e-1d7b2c9a4e10","created_at":"2024-01-02T03:04:05Z","updated_at":"2024-01-02T03:04:05Z","email":"a@example.com","plan":"free","role":"user","disabled_at":null,"email_verified_at":null,"totp_enabled_at":null}`
+	tests := []struct {
+		name        string
+		status      int
+		contentType string
+		body        string
+		wantProblem string
+	}{
+		{"valid", 200, "application/json", user, ""},
+		{"undocumented status", 201, "application/json", user, "status 201 isn't documented"},
+		{"wrong media type", 200, "text/plain", user, "has Content-Type text/plain"},
+		{"not JSON", 200, "application/json", "{", "isn't JSON"},
+		{"missing property", 200, "application/json", strings.Replace(user, `"plan":"free",`, "", 1), `lacks required property "plan"`},
+		{"extra property", 200, "application/json", strings.Replace(user, `"plan"`, `"password":"x","plan"`, 1), `undocumented property "password"`},
+		{"wrong enum", 200, "application/json", strings.Replace(user, `"role":"user"`, `"role":"owner"`, 1), "want one of"},
+		{"wrong format", 200, "application/json", strings.Replace(user, `"created_at":"2024-01-02T03:04:05Z"`, `"created_at":"yesterday"`, 1), "isn't a valid date-time"},
+		{"wrong type", 200, "application/json", strings.Replace(user, `"disabled_at":null`, `"disabled_at":3`, 1), "body.disabled_at"},
+		{"problem", 401, "application/problem+json", `{"type":"about:blank","title":"Unauthorized","status":401,"detail":"Couldn't find JWT","code":"unauthorized"}`, ""},
+		{"problem without code", 401, "application/problem+json", `{"type":"about:blank","title":"Unauthorized","status":401,"detail":"Couldn't find JWT"}`, `lacks required property "code"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			operationID, problems := doc.checkResponse(http.MethodGet, "/api/users/me", tt.status, tt.contentType, []byte(tt.body))
+			if operationID != "getCurrentUser" {
+				t.Errorf("Operation is %q, want getCurrentUser", operationID)
+			}
+			if tt.wantProblem == "" {
+				if len(problems) > 0 {
+					t.Errorf("Valid response has problems %v", problems)
+				}
+				return
+			}
+			if !slices.ContainsFunc(problems, func(p string) bool { return strings.Contains(p, tt.wantProblem) }) {
+				t.Errorf("Problems are %v, want one containing %q", problems, tt.wantProblem)
+			}
+		})
+	}
+}
+
+// TestOpenAPIOperations calls every operation but the OIDC ones, which need
+// an identity provider, and has the spec transport check each response,
+// errors included.
+func TestOpenAPIOperations(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := context.Background()
+	anon := ts.client()
+
+	alice, aliceSession := ts.signup(t, "alice@example.com")
+	bob, bobSession := ts.signup(t, "bob@example.com")
+
+	t.Run("auth", func(t *testing.T) {
+		_, err := anon.CreateUser(ctx, client.CreateUserRequest{Email: "alice@example.com", Password: testPassword})
+		wantProblem(t, err, http.StatusConflict)
+		_, err = anon.CreateUser(ctx, client.CreateUserRequest{Email: "not an email", Password: testPassword})
+		wantProblem(t, err, http.StatusUnprocessableEntity)
+		wantStatus(t, ts, http.MethodPost, "/api/users", "", "{", http.StatusBadRequest)
+
+		_, err = anon.Login(ctx, client.LoginRequest{Email: "alice@example.com", Password: "wrong password"})
+		wantProblem(t, err, http.StatusUnauthorized)
+		wantStatus(t, ts, http.MethodPost, "/api/login", "", "{", http.StatusBadRequest)
+		for range accountLoginPolicy.freeFailures {
+			_, err = anon.Login(ctx, client.LoginRequest{Email: "mallory@example.com", Password: "guess"})
+			wantProblem(t, err, http.StatusUnauthorized)
+		}
+		_, err = anon.Login(ctx, client.LoginRequest{Email: "mallory@example.com", Password: "guess"})
+		wantProblem(t, err, http.StatusTooManyRequests)
+
+		login, err := anon.Login(ctx, client.LoginRequest{Email: "alice@example.com", Password: testPassword})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens, err := anon.RefreshSession(ctx, login.RefreshToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = anon.RefreshSession(ctx, "not a refresh token")
+		wantProblem(t, err, http.StatusUnauthorized)
+
+		sessions, err := alice.ListSessions(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sessions) != 2 {
+			t.Errorf("Alice has %d sessions, want 2", len(sessions))
+		}
+		_, err = anon.ListSessions(ctx)
+		wantProblem(t, err, http.StatusUnauthorized)
+		err = alice.RevokeSession(ctx, bobSession.SessionID)
+		wantProblem(t, err, http.StatusNotFound)
+		err = alice.RevokeSession(ctx, tokens.SessionID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Logging out is idempotent, only missing credentials are refused.
+		err = anon.Logout(ctx, tokens.RefreshToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantStatus(t, ts, http.MethodPost, "/api/revoke", "", "", http.StatusUnauthorized)
+
+		login, err = anon.Login(ctx, client.LoginRequest{Email: "alice@example.com", Password: testPassword})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = anon.Logout(ctx, login.RefreshToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		carol, _ := ts.signup(t, "carol@example.com")
+		err = carol.RevokeAllSessions(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = carol.GetCurrentUser(ctx)
+		wantProblem(t, err, http.StatusUnauthorized)
+	})
+
+	t.Run("api keys", func(t *testing.T) {
+		_, err := alice.CreateAPIKey(ctx, client.CreateAPIKeyRequest{Name: "", Scopes: []client.Scope{"videos:delete"}})
+		wantProblem(t, err, http.StatusUnprocessableEntity)
+		wantStatus(t, ts, http.MethodPost, "/api/api_keys", aliceSession.Token, "{", http.StatusBadRequest)
+		key, err := alice.CreateAPIKey(ctx, client.CreateAPIKeyRequest{Name: "read only", Scopes: []client.Scope{client.ScopeVideosRead}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys, err := alice.ListAPIKeys(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != 1 || keys[0].ID != key.ID {
+			t.Errorf("Alice's API keys are %v, want %s", keys, key.ID)
+		}
+
+		readOnly := ts.client(client.WithAPIKey(key.Key))
+		_, err = readOnly.ListVideos(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = readOnly.CreateVideo(ctx, client.CreateVideoRequest{Title: "Denied"})
+		wantProblem(t, err, http.StatusForbidden)
+		_, err = readOnly.ListAPIKeys(ctx)
+		wantProblem(t, err, http.StatusForbidden)
+		_, err = readOnly.ListSessions(ctx)
+		wantProblem(t, err, http.StatusForbidden)
+		_, err = readOnly.GetCurrentUser(ctx)
+		wantProblem(t, err, http.StatusForbidden)
+
+		err = bob.RevokeAPIKey(ctx, key.ID)
+		wantProblem(t, err, http.StatusNotFound)
+		wantStatus(t, ts, http.MethodDelete, "/api/api_keys/not-an-id", aliceSession.Token, "", http.StatusBadRequest)
+		err = alice.RevokeAPIKey(ctx, key.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = readOnly.ListVideos(ctx)
+		wantProblem(t, err, http.StatusUnauthorized)
+	})
+
+	t.Run("account", func(t *testing.T) {
+		user, err := alice.GetCurrentUser(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.ID != aliceSession.ID {
+			t.Errorf("Current user is %s, want %s", user.ID, aliceSession.ID)
+		}
+		_, err = anon.GetCurrentUser(ctx)
+		wantProblem(t, err, http.StatusUnauthorized)
+		_, err = alice.GetUsage(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		identities, err := alice.ListIdentities(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(identities) != 0 {
+			t.Errorf("Alice has identities %v, want none", identities)
+		}
+
+		_, err = alice.UpdateEmail(ctx, client.UpdateEmailRequest{Email: "bob@example.com", Password: testPassword})
+		wantProblem(t, err, http.StatusConflict)
+		_, err = alice.UpdateEmail(ctx, client.UpdateEmailRequest{Email: "not an email", Password: testPassword})
+		wantProblem(t, err, http.StatusUnprocessableEntity)
+		_, err = alice.UpdateEmail(ctx, client.UpdateEmailRequest{Email: "alice@example.org", Password: "wrong password"})
+		wantProblem(t, err, http.StatusForbidden)
+		wantStatus(t, ts, http.MethodPut, "/api/users/me/email", aliceSession.Token, "{", http.StatusBadRequest)
+		_, err = alice.UpdateEmail(ctx, client.UpdateEmailRequest{Email: "alice@example.org", Password: testPassword})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = alice.RequestEmailVerification(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = anon.ConfirmEmailVerification(ctx, client.TokenRequest{Token: "not a token"})
+		wantProblem(t, err, http.StatusBadRequest)
+		err = anon.ConfirmEmailVerification(ctx, client.TokenRequest{Token: ts.mailedToken(t, "alice@example.org")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = alice.RequestEmailVerification(ctx)
+		wantProblem(t, err, http.StatusConflict)
+
+		err = alice.UpdatePassword(ctx, client.UpdatePasswordRequest{CurrentPassword: testPassword, NewPassword: "short"})
+		wantProblem(t, err, http.StatusUnprocessableEntity)
+		err = alice.UpdatePassword(ctx, client.UpdatePasswordRequest{CurrentPassword: "wrong password", NewPassword: testPassword + " again"})
+		wantProblem(t, err, http.StatusForbidden)
+		err = alice.UpdatePassword(ctx, client.UpdatePasswordRequest{CurrentPassword: testPassword, NewPassword: testPassword + " again"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = anon.RequestPasswordReset(ctx, client.PasswordResetRequest{Email: "not an email"})
+		wantProblem(t, err, http.StatusUnprocessableEntity)
+		wantStatus(t, ts, http.MethodPost, "/api/password_reset", "", "{", http.StatusBadRequest)
+		err = anon.RequestPasswordReset(ctx, client.PasswordResetRequest{Email: "alice@example.org"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		token := ts.mailedToken(t, "alice@example.org")
+		err = anon.ConfirmPasswordReset(ctx, client.PasswordResetConfirmRequest{Token: "not a token", Password: testPassword})
+		wantProblem(t, err, http.StatusBadRequest)
+		err = anon.ConfirmPasswordReset(ctx, client.PasswordResetConfirmRequest{Token: token, Password: "short"})
+		wantProblem(t, err, http.StatusUnprocessableEntity)
+		err = anon.ConfirmPasswordReset(ctx, client.PasswordResetConfirmRequest{Token: token, Password: testPassword})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Changing the password ended Alice's sessions.
+		_, err = alice.GetCurrentUser(ctx)
+		wantProblem(t, err, http.StatusUnauthorized)
+		login, err := anon.Login(ctx, client.LoginRequest{Email: "alice@example.org", Password: testPassword})
+		if err != nil {
+			t.Fatal(err)
+		}
+		alice, aliceSession = ts.client(client.WithToken(login.Token)), *login.LoginSession
+	})
+
+	t.Run("totp", func(t *testing.T) {
+		dave, _ := ts.signup(t, "dave@example.com")
+		_, err := dave.ConfirmTOTP(ctx, client.CodeRequest{Code: "000000"})
+		wantProblem(t, err, http.StatusConflict)
+		enrollment, err := dave.EnrollTOTP(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = dave.ConfirmTOTP(ctx, client.CodeRequest{Code: "12345"})
+		wantProblem(t, err, http.StatusBadRequest)
+		codes, err := dave.ConfirmTOTP(ctx, client.CodeRequest{Code: testTOTPCode(t, enrollment.Secret, time.Now())})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = dave.EnrollTOTP(ctx)
+		wantProblem(t, err, http.StatusConflict)
+
+		login, err := anon.Login(ctx, client.LoginRequest{Email: "dave@example.com", Password: testPassword})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if login.MFAChallenge == nil {
+			t.Fatal("Login with TOTP enabled didn't ask for a second factor")
+		}
+		_, err = anon.LoginMFA(ctx, client.LoginMFARequest{MFAToken: login.MFAToken, Code: "000000"})
+		wantProblem(t, err, http.StatusUnauthorized)
+		_, err = anon.LoginMFA(ctx, client.LoginMFARequest{MFAToken: "not a token", Code: codes.RecoveryCodes[0]})
+		wantProblem(t, err, http.StatusUnauthorized)
+		wantStatus(t, ts, http.MethodPost, "/api/login/mfa", "", "{", http.StatusBadRequest)
+		_, err = anon.LoginMFA(ctx, client.LoginMFARequest{MFAToken: login.MFAToken, Code: codes.RecoveryCodes[0]})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = dave.RegenerateRecoveryCodes(ctx, client.PasswordRequest{Password: "wrong password"})
+		wantProblem(t, err, http.StatusForbidden)
+		codes, err = dave.RegenerateRecoveryCodes(ctx, client.PasswordRequest{Password: testPassword})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = dave.DisableTOTP(ctx, client.DisableTOTPRequest{Password: "wrong password", Code: &codes.RecoveryCodes[0]})
+		wantProblem(t, err, http.StatusForbidden)
+		err = dave.DisableTOTP(ctx, client.DisableTOTPRequest{Password: testPassword})
+		wantProblem(t, err, http.StatusForbidden)
+		err = dave.DisableTOTP(ctx, client.DisableTOTPRequest{Password: testPassword, Code: &codes.RecoveryCodes[0]})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = dave.RegenerateRecoveryCodes(ctx, client.PasswordRequest{Password: testPassword})
+		wantProblem(t, err, http.StatusConflict)
+
+		err = dave.DeleteCurrentUser(ctx, client.PasswordRequest{Password: "wrong password"})
+		wantProblem(t, err, http.StatusForbidden)
+		err = dave.DeleteCurrentUser(ctx, client.PasswordRequest{Password: testPassword})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("videos", func(t *testing.T) {
+		_, err := bob.CreateVideo(ctx, client.CreateVideoRequest{Title: ""})
+		wantProblem(t, err, http.StatusUnprocessableEntity)
+		wantStatus(t, ts, http.MethodPost, "/api/videos", bobSession.Token, "{", http.StatusBadRequest)
+		_, err = anon.CreateVideo(ctx, client.CreateVideoRequest{Title: "Anonymous"})
+		wantProblem(t, err, http.StatusUnauthorized)
+
+		private := client.VisibilityPrivate
+		video, err := bob.CreateVideo(ctx, client.CreateVideoRequest{Title: "Holiday", Visibility: &private})
+		if err != nil {
+			t.Fatal(err)
+		}
+		videos, err := bob.ListVideos(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(videos) != 1 {
+			t.Errorf("Bob has %d videos, want 1", len(videos))
+		}
+		_, err = bob.GetVideo(ctx, video.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = alice.GetVideo(ctx, video.ID)
+		wantProblem(t, err, http.StatusNotFound)
+		_, err = anon.GetVideo(ctx, uuid.New())
+		wantProblem(t, err, http.StatusNotFound)
+		wantStatus(t, ts, http.MethodGet, "/api/videos/not-an-id", "", "", http.StatusBadRequest)
+
+		_, err = bob.UploadThumbnail(ctx, video.ID, client.File{Name: "thumb.txt", ContentType: "text/plain", Content: strings.NewReader("text")})
+		wantProblem(t, err, http.StatusUnsupportedMediaType)
+		_, err = alice.UploadThumbnail(ctx, video.ID, client.File{Name: "thumb.png", ContentType: "image/png", Content: strings.NewReader("png")})
+		wantProblem(t, err, http.StatusForbidden)
+		_, err = bob.UploadThumbnail(ctx, video.ID, client.File{Name: "thumb.png", ContentType: "image/png", Content: strings.NewReader("png")})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = bob.UploadVideo(ctx, video.ID, client.File{Name: "video.avi", ContentType: "video/x-msvideo", Content: strings.NewReader("avi")})
+		wantProblem(t, err, http.StatusUnsupportedMediaType)
+		_, err = bob.UploadVideo(ctx, video.ID, testVideo("notavideo"))
+		wantProblem(t, err, http.StatusUnprocessableEntity)
+		wantStatus(t, ts, http.MethodPost, "/api/video_upload/"+video.ID.String(), bobSession.Token, "not a form", http.StatusBadRequest)
+		free := ts.cfg.plans["free"]
+		small := free
+		small.MaxVideoBytes = 10
+		ts.cfg.plans["free"] = small
+		_, err = bob.UploadVideo(ctx, video.ID, testVideo(strings.Repeat("too long ", 100)))
+		wantProblem(t, err, http.StatusRequestEntityTooLarge)
+		ts.cfg.plans["free"] = free
+		content := strings.Repeat("holiday video ", 100)
+		video, err = bob.UploadVideo(ctx, video.ID, testVideo(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The private video streams through its signed URL only.
+		_, err = anon.StreamVideo(ctx, video.ID, client.StreamVideoParams{})
+		wantProblem(t, err, http.StatusUnauthorized)
+		signed, err := url.Parse(*video.VideoURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		params := client.StreamVideoParams{Expires: signed.Query().Get("expires"), Signature: signed.Query().Get("signature")}
+		stream, err := anon.StreamVideo(ctx, video.ID, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(stream)
+		stream.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != content {
+			t.Errorf("Streamed %d bytes, want %d", len(got), len(content))
+		}
+		_, err = anon.StreamVideo(ctx, video.ID, client.StreamVideoParams{Expires: params.Expires, Signature: "tampered"})
+		wantProblem(t, err, http.StatusUnauthorized)
+		_, err = anon.StreamVideo(ctx, uuid.New(), client.StreamVideoParams{})
+		wantProblem(t, err, http.StatusNotFound)
+		wantStatus(t, ts, http.MethodGet, "/api/videos/not-an-id/stream", "", "", http.StatusBadRequest)
+
+		req := mustRequest(t, http.MethodGet, *video.VideoURL, nil)
+		req.Header.Set("Range", "bytes=0-9")
+		resp, body := ts.do(t, req)
+		if resp.StatusCode != http.StatusPartialContent || body != content[:10] {
+			t.Errorf("Range request answered %d %q, want %d %q", resp.StatusCode, body, http.StatusPartialContent, content[:10])
+		}
+
+		err = alice.DeleteVideo(ctx, video.ID)
+		wantProblem(t, err, http.StatusForbidden)
+		wantStatus(t, ts, http.MethodDelete, "/api/videos/not-an-id", bobSession.Token, "", http.StatusBadRequest)
+		err = bob.DeleteVideo(ctx, video.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = bob.GetVideo(ctx, video.ID)
+		wantProblem(t, err, http.StatusNotFound)
+	})
+
+	t.Run("admin", func(t *testing.T) {
+		erin, erinSession := ts.signup(t, "erin@example.com")
+		_, err := erin.ListUsers(ctx)
+		wantProblem(t, err, http.StatusForbidden)
+		_, err = anon.ListUsers(ctx)
+		wantProblem(t, err, http.StatusUnauthorized)
+		ts.setRole(t, erinSession.User, database.RoleAdmin)
+
+		users, err := erin.ListUsers(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(users) < 3 {
+			t.Errorf("Listed %d users, want at least 3", len(users))
+		}
+		_, err = erin.UpdateUserRole(ctx, bobSession.ID, client.UpdateRoleRequest{Role: "owner"})
+		wantProblem(t, err, http.StatusUnprocessableEntity)
+		_, err = erin.UpdateUserRole(ctx, uuid.New(), client.UpdateRoleRequest{Role: client.RoleModerator})
+		wantProblem(t, err, http.StatusNotFound)
+		wantStatus(t, ts, http.MethodPut, "/admin/users/not-an-id/role", erinSession.Token, `{"role":"moderator"}`, http.StatusBadRequest)
+		_, err = erin.UpdateUserRole(ctx, bobSession.ID, client.UpdateRoleRequest{Role: client.RoleModerator})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		video, err := alice.CreateVideo(ctx, client.CreateVideoRequest{Title: "Reported"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = erin.AdminGetVideo(ctx, video.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = erin.AdminGetVideo(ctx, uuid.New())
+		wantProblem(t, err, http.StatusNotFound)
+		wantStatus(t, ts, http.MethodGet, "/admin/videos/not-an-id", erinSession.Token, "", http.StatusBadRequest)
+		err = erin.AdminDeleteVideo(ctx, uuid.New(), client.AdminDeleteVideoParams{Reason: "spam"})
+		wantProblem(t, err, http.StatusNotFound)
+		err = erin.AdminDeleteVideo(ctx, video.ID, client.AdminDeleteVideoParams{Reason: "spam"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = erin.DisableUser(ctx, uuid.New())
+		wantProblem(t, err, http.StatusNotFound)
+		wantStatus(t, ts, http.MethodPost, "/admin/users/not-an-id/disable", erinSession.Token, "", http.StatusBadRequest)
+		_, err = erin.DisableUser(ctx, aliceSession.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Disabling ends the user's sessions.
+		_, err = alice.GetCurrentUser(ctx)
+		wantProblem(t, err, http.StatusUnauthorized)
+		_, err = anon.Login(ctx, client.LoginRequest{Email: "alice@example.org", Password: testPassword})
+		wantProblem(t, err, http.StatusForbidden)
+		_, err = anon.RefreshSession(ctx, aliceSession.RefreshToken)
+		wantProblem(t, err, http.StatusUnauthorized)
+		_, err = erin.EnableUser(ctx, uuid.New())
+		wantProblem(t, err, http.StatusNotFound)
+		wantStatus(t, ts, http.MethodPost, "/admin/users/not-an-id/enable", erinSession.Token, "", http.StatusBadRequest)
+		_, err = erin.EnableUser(ctx, aliceSession.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		entries, err := erin.ListAuditLog(ctx, client.ListAuditLogParams{Limit: 100})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) == 0 {
+			t.Error("Audit log is empty after admin actions")
+		}
+		_, err = erin.ListAuditLog(ctx, client.ListAuditLogParams{Limit: -1})
+		wantProblem(t, err, http.StatusUnprocessableEntity)
+		attempts, err := erin.ListLoginAttempts(ctx, client.ListLoginAttemptsParams{Email: "mallory@example.com"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(attempts) == 0 {
+			t.Error("No login attempts of mallory@example.com were listed")
+		}
+		_, err = erin.ListLoginAttempts(ctx, client.ListLoginAttemptsParams{Limit: -1})
+		wantProblem(t, err, http.StatusUnprocessableEntity)
+	})
+
+	t.Run("meta", func(t *testing.T) {
+		_, err := anon.GetJWKS(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = anon.CheckHealth(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = anon.CheckReadiness(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = anon.GetOpenAPI(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = anon.ResetDatabase(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts.cfg.platform = "prod"
+		_, err = anon.ResetDatabase(ctx)
+		wantProblem(t, err, http.StatusForbidden)
+	})
+
+	// The OIDC operations are covered by oidc_test.go's identity provider.
+	skipped := []string{"startOIDCLogin", "finishOIDCLogin", "loginOIDC"}
+	doc := loadOpenAPIDoc(t)
+	for _, ops := range doc.Paths {
+		for _, op := range ops {
+			if slices.Contains(skipped, op.OperationID) {
+				continue
+			}
+			statuses := ts.spec.statuses(op.OperationID)
+			if !slices.ContainsFunc(statuses, func(status int) bool { return status/100 == 2 }) {
+				t.Errorf("%s wasn't called successfully, answered %v", op.OperationID, statuses)
+			}
+		}
+	}
+}
+
+// wantProblem checks that a call failed with a problem response of status.
+func wantProblem(t *testing.T, err error, status int) {
+	t.Helper()
+	var problem *client.Problem
+	if !errors.As(err, &problem) {
+		t.Fatalf("Call returned %v, want a %d problem", err, status)
+	}
+	if problem.Status != status {
+		t.Fatalf("Call failed with %v, want status %d", problem, status)
+	}
+}
+
+// wantStatus sends a request the client can't, authenticated with token if
+// it isn't empty, and checks its status.
+func wantStatus(t *testing.T, ts *testServer, method, path, token, body string, status int) {
+	t.Helper()
+	req := mustRequest(t, method, ts.URL+path, []byte(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, got := ts.do(t, req)
+	if resp.StatusCode != status {
+		t.Fatalf("%s %s answered %d, want %d: %s", method, path, resp.StatusCode, status, got)
+	}
+}
+
+// testTOTPCode computes the code an authenticator app shows for secret at
+// now: RFC 6238 with SHA-1, 6 digits and 30 second steps.
+func testTOTPCode(t *testing.T, secret string, now time.Time) string {
+	t.Helper()
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(now.Unix()/30))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1_000_000)
+}
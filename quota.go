@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/google/uuid"
+)
+
+// multipartOverhead is the allowance for multipart boundaries and headers on
+// top of the file itself when limiting request bodies.
+const multipartOverhead = 1 << 20
+
+type plan struct {
+	MaxStorageBytes   int64 `json:"max_storage_bytes"`
+	MaxVideos         int   `json:"max_videos"`
+	MaxVideoBytes     int64 `json:"max_video_bytes"`
+	MaxThumbnailBytes int64 `json:"max_thumbnail_bytes"`
+}
+
+var defaultPlans = map[string]plan{
+	"free": {
+		MaxStorageBytes:   5 << 30,
+		MaxVideos:         25,
+		MaxVideoBytes:     1 << 30,
+		MaxThumbnailBytes: 10 << 20,
+	},
+	"pro": {
+		MaxStorageBytes:   500 << 30,
+		MaxVideos:         1000,
+		MaxVideoBytes:     10 << 30,
+		MaxThumbnailBytes: 20 << 20,
+	},
+}
+
+// loadPlans returns the default plans, overridden and extended by the JSON
+// object of plan name to limits in the file at path, if any.
+func loadPlans(path string) (map[string]plan, error) {
+	plans := map[string]plan{}
+	for name, p := range defaultPlans {
+		plans[name] = p
+	}
+	if path == "" {
+		return plans, nil
+	}
+
+	dat, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	custom := map[string]plan{}
+	err = json.Unmarshal(dat, &custom)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse %s: %w", path, err)
+	}
+	for name, p := range custom {
+		plans[name] = p
+	}
+	return plans, nil
+}
+
+type quota struct {
+	Plan       string `json:"plan"`
+	Limits     plan   `json:"limits"`
+	UsedBytes  int64  `json:"used_bytes"`
+	VideoCount int    `json:"video_count"`
+}
+
+func (q quota) remainingBytes() int64 {
+	return max(q.Limits.MaxStorageBytes-q.UsedBytes, 0)
+}
+
+func (cfg *apiConfig) userQuota(ctx context.Context, userID uuid.UUID) (quota, error) {
+	user, err := cfg.db.WithContext(ctx).GetUser(userID)
+	if err != nil {
+		return quota{}, err
+	}
+	if user == nil {
+		return quota{}, fmt.Errorf("user %v not found", userID)
+	}
+	limits, ok := cfg.plans[user.Plan]
+	if !ok {
+		return quota{}, fmt.Errorf("user %v has unknown plan %q", userID, user.Plan)
+	}
+
+	usage, err := cfg.db.WithContext(ctx).GetUserUsage(userID)
+	if err != nil {
+		return quota{}, err
+	}
+	return quota{
+		Plan:       user.Plan,
+		Limits:     limits,
+		UsedBytes:  usage.Bytes,
+		VideoCount: usage.Videos,
+	}, nil
+}
+
+func (cfg *apiConfig) handlerUsageGet(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		quota
+		RemainingBytes int64 `json:"remaining_bytes"`
+	}
+
+	userID := principalFromContext(r.Context()).UserID
+
+	q, err := cfg.userQuota(r.Context(), userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get usage", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		quota:          q,
+		RemainingBytes: q.remainingBytes(),
+	})
+}
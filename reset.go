@@ -4,12 +4,11 @@ import "net/http"
 
 func (cfg *apiConfig) handlerReset(w http.ResponseWriter, r *http.Request) {
 	if cfg.platform != "dev" {
-		w.WriteHeader(http.StatusForbidden)
-		w.Write([]byte("Reset is only allowed in dev environment."))
+		respondWithError(w, http.StatusForbidden, "Reset is only allowed in dev environment", nil)
 		return
 	}
 
-	err := cfg.db.Reset()
+	err := cfg.db.WithContext(r.Context()).Reset()
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't reset database", err)
 		return
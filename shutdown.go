@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// uploadTempPattern names the temp files uploads are spooled to, and the
+// files ffmpeg writes next to them.
+const uploadTempPattern = "tubely-upload.mp4"
+
+// serve runs the servers until the process gets SIGINT or SIGTERM, then
+// stops accepting connections and waits up to shutdownTimeout for in-flight
+// requests and background jobs to finish. If any server fails, serve stops
+// the others and returns its error.
+func (cfg *apiConfig) serve(servers []*http.Server, shutdownTimeout time.Duration) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	serveErr := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func() {
+			serveErr <- srv.ListenAndServe()
+		}()
+	}
+
+	select {
+	case err := <-serveErr:
+		for _, srv := range servers {
+			srv.Close()
+		}
+		return err
+	case <-ctx.Done():
+	}
+	// A second signal kills the process right away.
+	stop()
+
+	slog.Info("Shutting down, draining requests", slog.Duration("timeout", shutdownTimeout))
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	var errs []error
+	for _, srv := range servers {
+		errs = append(errs, srv.Shutdown(shutdownCtx))
+	}
+	err := errors.Join(errs...)
+	if err != nil {
+		return err
+	}
+	err = waitGroupContext(shutdownCtx, cfg.background)
+	if err != nil {
+		return errors.New("background jobs didn't finish in time")
+	}
+	slog.Info("Shut down cleanly")
+	return nil
+}
+
+// allowLongTransfer gives an upload or stream the transfer timeout to read
+// its request and write its response, instead of the server's short
+// timeouts that keep slow clients from holding on to connections.
+func (cfg *apiConfig) allowLongTransfer(w http.ResponseWriter, r *http.Request) {
+	deadline := time.Now().Add(cfg.transferTimeout)
+	rc := http.NewResponseController(w)
+	err := errors.Join(rc.SetReadDeadline(deadline), rc.SetWriteDeadline(deadline))
+	if err != nil {
+		requestLogger(r.Context()).Warn("Couldn't extend connection deadlines", slog.Any("err", err))
+	}
+}
+
+// waitGroupContext waits for wg, or until ctx is done.
+func waitGroupContext(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// removeStaleUploads deletes upload temp files in dir that were last written
+// more than olderThan ago; they were left behind by a server that was
+// killed mid-upload. Younger files may belong to another server sharing the
+// directory.
+func removeStaleUploads(dir string, olderThan time.Duration) (int, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, uploadTempPattern+"*"))
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, path := range paths {
+		info, err := os.Lstat(path)
+		if err != nil || !info.Mode().IsRegular() || time.Since(info.ModTime()) < olderThan {
+			continue
+		}
+		err = os.Remove(path)
+		if err != nil {
+			slog.Warn("Couldn't remove stale upload", slog.String("path", path), slog.Any("err", err))
+			continue
+		}
+		removed++
+	}
+	return removed, nil
+}
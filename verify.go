@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/storage"
+)
+
+// verifyObjects re-reads every stored video file and compares it with the
+// checksums recorded when it was uploaded, reporting each object to out. It
+// returns the number of objects that are missing or corrupted.
+func (cfg *apiConfig) verifyObjects(ctx context.Context, out io.Writer) (int, error) {
+	videos, err := cfg.db.WithContext(ctx).GetAllVideos()
+	if err != nil {
+		return 0, err
+	}
+
+	checked := map[string]bool{}
+	failed := 0
+	for _, video := range videos {
+		key, ok := cfg.videoObjectKey(video)
+		if !ok || checked[key] {
+			continue
+		}
+		checked[key] = true
+
+		if video.ChecksumSHA256 == nil {
+			fmt.Fprintf(out, "SKIP     %v (video %v): no recorded checksums\n", key, video.ID)
+			continue
+		}
+		expected := storage.Checksums{SHA256: *video.ChecksumSHA256}
+
+		err := verifyObject(ctx, cfg.store, key, expected)
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			failed++
+			fmt.Fprintf(out, "MISSING  %v (video %v)\n", key, video.ID)
+		case errors.Is(err, storage.ErrChecksumMismatch):
+			failed++
+			fmt.Fprintf(out, "MISMATCH %v (video %v): %v\n", key, video.ID, err)
+		case err != nil:
+			return failed, fmt.Errorf("couldn't verify %v: %w", key, err)
+		default:
+			fmt.Fprintf(out, "OK       %v (video %v)\n", key, video.ID)
+		}
+	}
+
+	fmt.Fprintf(out, "%d objects checked, %d failed\n", len(checked), failed)
+	return failed, nil
+}
+
+func verifyObject(ctx context.Context, store storage.Store, key string, expected storage.Checksums) error {
+	obj, err := store.Open(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+
+	actual, err := storage.ComputeChecksums(obj)
+	if err != nil {
+		return err
+	}
+	return actual.Verify(expected)
+}
@@ -2,21 +2,25 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"os/exec"
 )
 
-func getVideoAspectRatio(filePath string) (string, error) {
+var errNoVideoStream = errors.New("file has no video stream")
+
+func getVideoAspectRatio(ctx context.Context, filePath string) (string, error) {
 	// It should use exec.Command to run the same ffprobe command as above. In this case, the command is ffprobe and the arguments are -v, error,
 	// -print_format, json, -show_streams, and the file path.
-	cmd := exec.Command("ffprobe", "-v", "error", "-print_format", "json", "-show_streams", filePath)
+	cmd := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-print_format", "json", "-show_streams", filePath)
 
 	// Set the resulting exec.Cmd's Stdout field to a pointer to a new bytes.Buffer.
 	var b bytes.Buffer
 	cmd.Stdout = &b
 
 	// .Run() the command
-	err := cmd.Run()
+	err := runTraced(ctx, cmd)
 	if err != nil {
 		return "", err
 	}
@@ -29,8 +33,15 @@ func getVideoAspectRatio(filePath string) (string, error) {
 		return "", err
 	}
 
-	width := int(result["streams"][0]["width"].(float64))
-	height := int(result["streams"][0]["height"].(float64))
+	if len(result["streams"]) == 0 {
+		return "", errNoVideoStream
+	}
+	w, okWidth := result["streams"][0]["width"].(float64)
+	h, okHeight := result["streams"][0]["height"].(float64)
+	if !okWidth || !okHeight {
+		return "", errNoVideoStream
+	}
+	width, height := int(w), int(h)
 
 	// I did a bit of math to determine the ratio, then returned one of three strings: 16:9, 9:16, or other.
 	if width > height {
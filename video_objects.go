@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// deleteVideo removes a video and, best effort, its stored file and
+// thumbnail. The files released are those the video had when its row was
+// deleted, which a concurrent upload may have changed since it was read.
+func (cfg *apiConfig) deleteVideo(ctx context.Context, videoID uuid.UUID) error {
+	video, err := cfg.db.WithContext(ctx).DeleteVideo(videoID)
+	if err != nil {
+		return err
+	}
+	if video.ID == uuid.Nil {
+		return nil
+	}
+
+	err = cfg.releaseVideoObject(ctx, video)
+	if err != nil {
+		requestLogger(ctx).Warn("Couldn't release file of video", slog.String("video_id", video.ID.String()), slog.Any("err", err))
+	}
+	err = cfg.removeThumbnail(video)
+	if err != nil {
+		requestLogger(ctx).Warn("Couldn't remove thumbnail of video", slog.String("video_id", video.ID.String()), slog.Any("err", err))
+	}
+	return nil
+}
+
+// releaseVideoObject drops the video's reference on its stored file and
+// deletes the object once no other video points at it.
+func (cfg *apiConfig) releaseVideoObject(ctx context.Context, video database.Video) error {
+	if video.ContentHash == nil {
+		// Files uploaded before deduplication belong to a single video.
+		key, ok := cfg.videoObjectKey(video)
+		if !ok {
+			return nil
+		}
+		return cfg.store.Delete(ctx, key)
+	}
+
+	ref, err := cfg.db.WithContext(ctx).ReleaseContentHash(*video.ContentHash)
+	if err != nil {
+		return err
+	}
+	if ref.RefCount > 0 {
+		return nil
+	}
+	return cfg.store.Delete(ctx, ref.VideoKey)
+}
+
+// removeThumbnail deletes the video's thumbnail from the assets directory.
+func (cfg *apiConfig) removeThumbnail(video database.Video) error {
+	if video.ThumbnailKey == nil {
+		return nil
+	}
+	err := os.Remove(filepath.Join(cfg.assetsRoot, *video.ThumbnailKey))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}